@@ -0,0 +1,362 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/didoarellano/short/internal/audit"
+	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/redirector"
+	"github.com/didoarellano/short/internal/session"
+	"github.com/didoarellano/short/internal/subscriptions"
+	"github.com/didoarellano/short/internal/templ"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+const usersPageSize = 50
+
+type AdminHandler struct {
+	template            *templ.Templ
+	queries             *db.Queries
+	sessionStore        session.SessionStore
+	redisClient         *redis.Client
+	sessionManager      *auth.SessionManager
+	subscriptionService *subscriptions.UserSubscriptionService
+	auditLogger         *audit.Logger
+}
+
+func NewAdminHandlers(t *templ.Templ, q *db.Queries, s session.SessionStore, r *redis.Client, sm *auth.SessionManager, us *subscriptions.UserSubscriptionService, a *audit.Logger) *AdminHandler {
+	return &AdminHandler{
+		template:            t,
+		queries:             q,
+		sessionStore:        s,
+		redisClient:         r,
+		sessionManager:      sm,
+		subscriptionService: us,
+		auditLogger:         a,
+	}
+}
+
+func adminPath(format string, a ...any) string {
+	return "/" + config.AppData.AppPathPrefix + "/admin" + fmt.Sprintf(format, a...)
+}
+
+func pathID(r *http.Request) (int32, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	return int32(id), err == nil
+}
+
+func (ah *AdminHandler) Users(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	query := r.URL.Query().Get("q")
+	page := audit.Page(r)
+
+	// One extra row tells us whether there's a next page
+	users, err := ah.queries.SearchUsers(context.Background(), db.SearchUsersParams{
+		Query:  query,
+		Limit:  usersPageSize + 1,
+		Offset: int32((page - 1) * usersPageSize),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to search users", logging.Err(err))
+		http.Error(w, "Failed to search users", http.StatusInternalServerError)
+		return
+	}
+
+	hasNextPage := len(users) > usersPageSize
+	if hasNextPage {
+		users = users[:usersPageSize]
+	}
+
+	data := map[string]interface{}{
+		"user":     user,
+		"query":    query,
+		"users":    users,
+		"prevHref": audit.PageHref(r, page-1),
+		"nextHref": audit.PageHref(r, page+1),
+		"hasPrev":  page > 1,
+		"hasNext":  hasNextPage,
+	}
+
+	if err := ah.template.ExecuteTemplate(w, r, "admin_users.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (ah *AdminHandler) User(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	ctx := context.Background()
+
+	id, ok := pathID(r)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	account, err := ah.queries.GetUserForAdmin(ctx, id)
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve user", logging.Err(err))
+		http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
+		return
+	}
+
+	workspaces, err := ah.queries.GetWorkspacesForUserAdmin(ctx, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve user's workspaces", logging.Err(err))
+		http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
+		return
+	}
+
+	plans, err := ah.queries.GetSubscriptions(ctx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve subscriptions", logging.Err(err))
+		http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
+		return
+	}
+
+	var message string
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message, _ = flashes[0].(string)
+	}
+	session.Save(r, w)
+
+	data := map[string]interface{}{
+		"user":          user,
+		"account":       account,
+		"isSelf":        account.ID == user.UserID,
+		"workspaces":    workspaces,
+		"subscriptions": plans,
+		"message":       message,
+	}
+
+	if err := ah.template.ExecuteTemplate(w, r, "admin_user.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (ah *AdminHandler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	ah.setUserDisabled(w, r, true)
+}
+
+func (ah *AdminHandler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	ah.setUserDisabled(w, r, false)
+}
+
+// Disabling a user also signs them out everywhere and drops their links from
+// the redirect cache so they stop being served straight away. That's every
+// link they created in every workspace, shared ones included: disabling is
+// for abuse, and a shared workspace is no reason to keep serving it.
+func (ah *AdminHandler) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	ctx := context.Background()
+
+	id, ok := pathID(r)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if id == user.UserID {
+		http.Error(w, "You can't disable yourself", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ah.queries.GetUserForAdmin(ctx, id); err == pgx.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	err := ah.queries.SetUserDisabled(ctx, db.SetUserDisabledParams{
+		ID:       id,
+		Disabled: disabled,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update user", logging.Err(err))
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	if disabled {
+		if err := ah.sessionManager.RevokeAll(ctx, id); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to revoke user's sessions", logging.Err(err))
+		}
+	}
+
+	// Disabled users' links are cached as not found until they're enabled
+	links, err := ah.queries.GetLinkCacheKeysForUser(ctx, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve user's links", logging.Err(err))
+	}
+	var keys []string
+	for _, link := range links {
+		keys = append(keys, redirector.CacheKey(link.DomainID, link.ShortCode))
+	}
+	if len(keys) > 0 {
+		if err := ah.redisClient.Del(ctx, keys...).Err(); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to invalidate cached links", logging.Err(err))
+		}
+	}
+
+	ah.auditLogger.Record(audit.Entry{
+		ActorUserID: user.UserID,
+		Action:      audit.ActionUpdate,
+		TargetType:  audit.TargetUser,
+		TargetID:    strconv.Itoa(int(id)),
+		Before:      map[string]bool{"disabled": !disabled},
+		After:       map[string]bool{"disabled": disabled},
+	}.WithRequest(r))
+
+	if disabled {
+		session.AddFlash("User disabled")
+	} else {
+		session.AddFlash("User enabled")
+	}
+	session.Save(r, w)
+	http.Redirect(w, r, adminPath("/users/%d", id), http.StatusSeeOther)
+}
+
+func (ah *AdminHandler) ChangeSubscription(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+
+	workspaceID, ok := pathID(r)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	r.ParseForm()
+	subscriptionID, err := strconv.ParseInt(r.FormValue("subscription_id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid subscription", http.StatusBadRequest)
+		return
+	}
+
+	// Admins skip the usual upgrade and downgrade rules, changes apply now
+	err = ah.subscriptionService.ChangeSubscription(r, workspaceID, user.UserID, int32(subscriptionID))
+	if err == pgx.ErrNoRows || err == subscriptions.ErrNoActiveSubscription {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to change subscription", logging.Err(err))
+		http.Error(w, "Failed to change subscription", http.StatusInternalServerError)
+		return
+	}
+
+	session.AddFlash("Subscription changed")
+	session.Save(r, w)
+
+	returnTo := adminPath("/users")
+	if userID, err := strconv.Atoi(r.FormValue("user_id")); err == nil {
+		returnTo = adminPath("/users/%d", userID)
+	}
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+}
+
+func (ah *AdminHandler) Links(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	query := r.URL.Query().Get("q")
+
+	var links []db.SearchLinksRow
+	if query != "" {
+		var err error
+		links, err = ah.queries.SearchLinks(context.Background(), query)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to search links", logging.Err(err))
+			http.Error(w, "Failed to search links", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var message string
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message, _ = flashes[0].(string)
+	}
+	session.Save(r, w)
+
+	data := map[string]interface{}{
+		"user":    user,
+		"query":   query,
+		"links":   links,
+		"message": message,
+	}
+
+	if err := ah.template.ExecuteTemplate(w, r, "admin_links.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (ah *AdminHandler) DisableLink(w http.ResponseWriter, r *http.Request) {
+	ah.setLinkDisabled(w, r, true)
+}
+
+func (ah *AdminHandler) EnableLink(w http.ResponseWriter, r *http.Request) {
+	ah.setLinkDisabled(w, r, false)
+}
+
+func (ah *AdminHandler) setLinkDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	ctx := context.Background()
+
+	id, ok := pathID(r)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	link, err := ah.queries.SetLinkDisabled(ctx, db.SetLinkDisabledParams{
+		ID:       id,
+		Disabled: disabled,
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update link", logging.Err(err))
+		http.Error(w, "Failed to update link", http.StatusInternalServerError)
+		return
+	}
+
+	if err := ah.redisClient.Del(ctx, redirector.CacheKey(link.DomainID, link.ShortCode)).Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to invalidate cached link", logging.Err(err))
+	}
+
+	ah.auditLogger.Record(audit.Entry{
+		WorkspaceID: link.WorkspaceID,
+		ActorUserID: user.UserID,
+		Action:      audit.ActionUpdate,
+		TargetType:  audit.TargetLink,
+		TargetID:    strconv.Itoa(int(link.ID)),
+		Before:      map[string]bool{"disabled": !disabled},
+		After:       map[string]bool{"disabled": disabled},
+	}.WithRequest(r))
+
+	if disabled {
+		session.AddFlash(fmt.Sprintf("Disabled /%s", link.ShortCode))
+	} else {
+		session.AddFlash(fmt.Sprintf("Enabled /%s", link.ShortCode))
+	}
+	session.Save(r, w)
+
+	r.ParseForm()
+	http.Redirect(w, r, adminPath("/links?q=%s", url.QueryEscape(r.FormValue("q"))), http.StatusSeeOther)
+}
@@ -0,0 +1,38 @@
+package admin
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/session"
+)
+
+// RequireAdmin hands anyone who isn't an admin to notFound so the console's
+// existence isn't advertised. The role is checked against the database on
+// every request rather than trusted from the session. It must run after
+// auth.PrivateRoute.
+func RequireAdmin(queries *db.Queries, sessionStore session.SessionStore, notFound http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, _ := sessionStore.Get(r, "session")
+			user := session.Values["user"].(auth.UserSession)
+
+			access, err := queries.GetUserAccess(context.Background(), user.UserID)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to get user access", logging.Err(err))
+				notFound.ServeHTTP(w, r)
+				return
+			}
+			if access.Role != "admin" || access.DisabledAt.Valid {
+				notFound.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/didoarellano/short/internal/clientip"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+type Action string
+
+const (
+	ActionCreate             Action = "create"
+	ActionUpdate             Action = "update"
+	ActionDelete             Action = "delete"
+	ActionLogin              Action = "login"
+	ActionSubscriptionChange Action = "subscription_change"
+)
+
+var Actions = []Action{ActionCreate, ActionUpdate, ActionDelete, ActionLogin, ActionSubscriptionChange}
+
+const (
+	TargetLink            = "link"
+	TargetUser            = "user"
+	TargetUserIdentity    = "user_identity"
+	TargetWorkspace       = "workspace"
+	TargetWorkspaceMember = "workspace_member"
+	TargetDomain          = "domain"
+)
+
+var TargetTypes = []string{TargetLink, TargetUser, TargetUserIdentity, TargetWorkspace, TargetWorkspaceMember, TargetDomain}
+
+// Entry is a single change. Before and After are snapshots of the target and
+// are stored as JSON; leave Before nil for creations and After nil for
+// deletions.
+type Entry struct {
+	WorkspaceID int32
+	ActorUserID int32
+	Action      Action
+	TargetType  string
+	TargetID    string
+	Before      any
+	After       any
+	IPAddress   string
+	UserAgent   string
+}
+
+// WithRequest fills in the metadata of the request that caused the change.
+func (e Entry) WithRequest(r *http.Request) Entry {
+	e.IPAddress = clientip.FromRequest(r)
+	e.UserAgent = r.UserAgent()
+	return e
+}
+
+type Logger struct {
+	queries *db.Queries
+}
+
+func NewLogger(q *db.Queries) *Logger {
+	return &Logger{queries: q}
+}
+
+// Record appends e to the audit log. The change it describes has already
+// happened so failures are logged rather than returned.
+func (l *Logger) Record(e Entry) {
+	before, err := marshalSnapshot(e.Before)
+	if err != nil {
+		slog.Error("Failed to marshal audit log snapshot", logging.Err(err))
+		return
+	}
+	after, err := marshalSnapshot(e.After)
+	if err != nil {
+		slog.Error("Failed to marshal audit log snapshot", logging.Err(err))
+		return
+	}
+
+	err = l.queries.CreateAuditLogEntry(context.Background(), db.CreateAuditLogEntryParams{
+		WorkspaceID: pgtype.Int4{Int32: e.WorkspaceID, Valid: e.WorkspaceID != 0},
+		ActorUserID: pgtype.Int4{Int32: e.ActorUserID, Valid: e.ActorUserID != 0},
+		Action:      string(e.Action),
+		TargetType:  e.TargetType,
+		TargetID:    e.TargetID,
+		Before:      before,
+		After:       after,
+		IpAddress:   pgtype.Text{String: e.IPAddress, Valid: e.IPAddress != ""},
+		UserAgent:   pgtype.Text{String: e.UserAgent, Valid: e.UserAgent != ""},
+	})
+	if err != nil {
+		slog.Error("Failed to record audit log entry", logging.Err(err))
+	}
+}
+
+func marshalSnapshot(v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+type Change struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// Diff compares two JSON object snapshots field by field and returns the
+// fields that differ, sorted by name. Either snapshot may be empty.
+func Diff(before, after []byte) []Change {
+	b := map[string]any{}
+	a := map[string]any{}
+	if len(before) > 0 {
+		json.Unmarshal(before, &b)
+	}
+	if len(after) > 0 {
+		json.Unmarshal(after, &a)
+	}
+
+	fields := map[string]bool{}
+	for k := range b {
+		fields[k] = true
+	}
+	for k := range a {
+		fields[k] = true
+	}
+
+	var changes []Change
+	for field := range fields {
+		bv, av := formatValue(b[field]), formatValue(a[field])
+		if bv != av {
+			changes = append(changes, Change{Field: field, Before: bv, After: av})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+
+	return changes
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+type ListItem struct {
+	ID         int64
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Changes    []Change
+	IPAddress  string
+	UserAgent  string
+	CreatedAt  pgtype.Timestamp
+}
+
+func ListItems(rows []db.GetAuditLogForWorkspaceRow) []ListItem {
+	var items []ListItem
+	for _, row := range rows {
+		actor := row.ActorEmail.String
+		if !row.ActorUserID.Valid {
+			actor = "System"
+		} else if actor == "" {
+			actor = fmt.Sprintf("Deleted user #%d", row.ActorUserID.Int32)
+		}
+
+		items = append(items, ListItem{
+			ID:         row.ID,
+			Actor:      actor,
+			Action:     row.Action,
+			TargetType: row.TargetType,
+			TargetID:   row.TargetID,
+			Changes:    Diff(row.Before, row.After),
+			IPAddress:  row.IpAddress.String,
+			UserAgent:  row.UserAgent.String,
+			CreatedAt:  row.CreatedAt,
+		})
+	}
+	return items
+}
+
+const PageSize = 50
+
+// Page reads the page query param of an audit log view. No page query param
+// defaults to page 1.
+func Page(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// PageHref is the current URL with its page query param replaced so filters
+// are kept when paginating.
+func PageHref(r *http.Request, page int) string {
+	query := r.URL.Query()
+	query.Set("page", strconv.Itoa(page))
+	return r.URL.Path + "?" + query.Encode()
+}
@@ -0,0 +1,55 @@
+package audit
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		before string
+		after  string
+		want   []Change
+	}{
+		{
+			name:   "update",
+			before: `{"destination_url": "https://a.example", "title": "A", "notes": ""}`,
+			after:  `{"destination_url": "https://b.example", "title": "A", "notes": "moved"}`,
+			want: []Change{
+				{Field: "destination_url", Before: "https://a.example", After: "https://b.example"},
+				{Field: "notes", Before: "", After: "moved"},
+			},
+		},
+		{
+			name:  "create",
+			after: `{"title": "A", "max_links": 10}`,
+			want: []Change{
+				{Field: "max_links", Before: "", After: "10"},
+				{Field: "title", Before: "", After: "A"},
+			},
+		},
+		{
+			name:   "delete",
+			before: `{"title": "A"}`,
+			want: []Change{
+				{Field: "title", Before: "A", After: ""},
+			},
+		},
+		{
+			name:   "no changes",
+			before: `{"title": "A"}`,
+			after:  `{"title": "A"}`,
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Diff([]byte(tt.before), []byte(tt.after))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,18 +1,119 @@
 package auth
 
 import (
+	"log/slog"
 	"os"
 
+	"github.com/didoarellano/short/internal/logging"
 	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/github"
+	"github.com/markbates/goth/providers/gitlab"
 	"github.com/markbates/goth/providers/google"
+	"github.com/markbates/goth/providers/microsoftonline"
+	"github.com/markbates/goth/providers/openidConnect"
 )
 
+type Provider struct {
+	Name  string
+	Label string
+}
+
+// providers are the sign in options in the order they're shown
+var providers []Provider
+
+// trustedEmailProviders only return email addresses the user has verified so
+// a new identity from one of them can be linked to the existing user with the
+// same email. Identities from any other provider have to be linked while
+// signed in. GitLab isn't one, goth passes its email on whether or not it's
+// been confirmed.
+var trustedEmailProviders = map[string]bool{
+	EmailProvider: true,
+	"google":      true,
+	"github":      true,
+}
+
+// Initialise registers every provider whose credentials are set in the
+// environment, e.g. GITHUB_CLIENT_ID, GITHUB_CLIENT_SECRET and
+// GITHUB_REDIRECT_URL. The generic OpenID Connect provider also needs
+// OIDC_DISCOVERY_URL and can be renamed with OIDC_NAME and OIDC_LABEL.
 func Initialise() {
-	goth.UseProviders(
-		google.New(
-			os.Getenv("GOOGLE_CLIENT_ID"),
-			os.Getenv("GOOGLE_CLIENT_SECRET"),
-			os.Getenv("GOOGLE_REDIRECT_URL"),
-		),
-	)
+	var gothProviders []goth.Provider
+
+	if key, secret, callback, ok := providerEnv("GOOGLE"); ok {
+		gothProviders = append(gothProviders, google.New(key, secret, callback))
+		providers = append(providers, Provider{Name: "google", Label: "Google"})
+	}
+
+	if key, secret, callback, ok := providerEnv("GITHUB"); ok {
+		gothProviders = append(gothProviders, github.New(key, secret, callback, "user:email"))
+		providers = append(providers, Provider{Name: "github", Label: "GitHub"})
+	}
+
+	if key, secret, callback, ok := providerEnv("GITLAB"); ok {
+		gothProviders = append(gothProviders, gitlab.New(key, secret, callback, "read_user"))
+		providers = append(providers, Provider{Name: "gitlab", Label: "GitLab"})
+	}
+
+	if key, secret, callback, ok := providerEnv("MICROSOFT"); ok {
+		gothProviders = append(gothProviders, microsoftonline.New(key, secret, callback))
+		providers = append(providers, Provider{Name: "microsoftonline", Label: "Microsoft"})
+	}
+
+	if key, secret, callback, ok := providerEnv("OIDC"); ok {
+		name := envOrDefault("OIDC_NAME", "oidc")
+		p, err := openidConnect.NewNamed(name, key, secret, callback, os.Getenv("OIDC_DISCOVERY_URL"), "email", "profile")
+		if err != nil {
+			// Don't take the app down with an unreachable identity provider
+			slog.Error("Failed to configure OpenID Connect provider", logging.Err(err))
+		} else {
+			gothProviders = append(gothProviders, p)
+			providers = append(providers, Provider{Name: name, Label: envOrDefault("OIDC_LABEL", "Single sign-on")})
+		}
+	}
+
+	if len(gothProviders) == 0 {
+		slog.Warn("No OAuth providers are configured, nobody will be able to sign in")
+	}
+
+	goth.UseProviders(gothProviders...)
+}
+
+func providerEnv(prefix string) (key, secret, callback string, ok bool) {
+	key = os.Getenv(prefix + "_CLIENT_ID")
+	secret = os.Getenv(prefix + "_CLIENT_SECRET")
+	callback = os.Getenv(prefix + "_REDIRECT_URL")
+	return key, secret, callback, key != "" && secret != "" && callback != ""
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Providers returns the configured sign in providers.
+func Providers() []Provider {
+	return providers
+}
+
+func IsProviderEnabled(name string) bool {
+	for _, p := range providers {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func providerLabel(name string) string {
+	if name == EmailProvider {
+		return "Email"
+	}
+	for _, p := range providers {
+		if p.Name == name {
+			return p.Label
+		}
+	}
+	return name
 }
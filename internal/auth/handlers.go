@@ -2,34 +2,59 @@ package auth
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/didoarellano/short/internal/audit"
 	"github.com/didoarellano/short/internal/config"
 	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/mailer"
 	"github.com/didoarellano/short/internal/session"
 	"github.com/didoarellano/short/internal/templ"
 	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 )
 
+// SubscriptionService is satisfied by subscriptions.UserSubscriptionService.
+// It can't be imported directly as subscriptions depends on auth.
+type SubscriptionService interface {
+	AddBasicSubscription(r *http.Request, workspaceID, actorUserID int32) (db.AddBasicSubscriptionRow, error)
+	MemberLimit(workspaceID int32) (int32, error)
+}
+
 type AuthHandler struct {
-	template     *templ.Templ
-	queries      *db.Queries
-	sessionStore session.SessionStore
-	redisClient  *redis.Client
+	template            *templ.Templ
+	queries             *db.Queries
+	sessionStore        session.SessionStore
+	redisClient         *redis.Client
+	subscriptionService SubscriptionService
+	auditLogger         *audit.Logger
+	mailer              mailer.Mailer
+	sessionManager      *SessionManager
 }
 
-func NewAuthHandlers(t *templ.Templ, q *db.Queries, s session.SessionStore, r *redis.Client) *AuthHandler {
+// NewAuthHandlers creates the auth handlers. Email sign in is disabled when m
+// is nil.
+func NewAuthHandlers(t *templ.Templ, q *db.Queries, s session.SessionStore, r *redis.Client, ss SubscriptionService, a *audit.Logger, m mailer.Mailer, sm *SessionManager) *AuthHandler {
 	return &AuthHandler{
-		template:     t,
-		queries:      q,
-		sessionStore: s,
-		redisClient:  r,
+		template:            t,
+		queries:             q,
+		sessionStore:        s,
+		redisClient:         r,
+		subscriptionService: ss,
+		auditLogger:         a,
+		mailer:              m,
+		sessionManager:      sm,
 	}
 }
 
@@ -38,92 +63,395 @@ func (ah *AuthHandler) BeginAuth(w http.ResponseWriter, r *http.Request) {
 }
 
 type UserSession struct {
-	UserID   int32
-	Username string
+	UserID      int32
+	Username    string
+	WorkspaceID int32
+	IsAdmin     bool
+	SignedInAt  time.Time
+	LastSeenAt  time.Time
 }
 
+var (
+	errIdentityNotLinked = errors.New("identity isn't linked to the user with its email")
+	errNoEmail           = errors.New("provider didn't share an email address")
+)
+
 func (ah *AuthHandler) OAuthCallback(w http.ResponseWriter, r *http.Request) {
 	session, err := ah.sessionStore.Get(r, "session")
 	if err != nil {
-		log.Printf("Error retrieving session: %v", err)
+		slog.ErrorContext(r.Context(), "Error retrieving session", logging.Err(err))
 		http.Error(w, "Failed to retrieve session", http.StatusInternalServerError)
 		return
 	}
 
-	if session.Values["user"] != nil {
-		// user is already logged in
-		http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/links", http.StatusSeeOther)
-		return
-	}
-
 	gothUser, err := gothic.CompleteUserAuth(w, r)
 	if err != nil {
 		http.Error(w, "Authentication failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// Signed in users are here to link another provider to their account
+	if sessionUser, ok := session.Values["user"].(UserSession); ok {
+		ah.linkIdentity(w, r, session, sessionUser, gothUser)
+		return
+	}
+
+	ah.signIn(w, r, session, gothUser)
+}
+
+// signIn starts a session for the user gothUser's identity belongs to,
+// creating the user, their personal workspace and its basic subscription if
+// needed. Every sign in method ends here.
+func (ah *AuthHandler) signIn(w http.ResponseWriter, r *http.Request, session *sessions.Session, gothUser goth.User) {
 	ctx := context.Background()
-	user, err := ah.queries.GetUserByEmail(ctx, gothUser.Email)
-	var subscription db.GetUserSubscriptionRow
+	user, newIdentity, err := ah.findOrCreateUser(ctx, gothUser)
+
+	if err == errIdentityNotLinked {
+		session.AddFlash(fmt.Sprintf("An account with %s already exists. Sign in the way you usually do and link %s from your account page.", gothUser.Email, providerLabel(gothUser.Provider)))
+		session.Save(r, w)
+		http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/signin", http.StatusFound)
+		return
+	}
+	if err == errNoEmail {
+		session.AddFlash(fmt.Sprintf("%s didn't share an email address with us. Make sure your email is visible and try again.", providerLabel(gothUser.Provider)))
+		session.Save(r, w)
+		http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/signin", http.StatusFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get user", logging.Err(err))
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
+	if user.DisabledAt.Valid {
+		session.AddFlash("This account has been disabled.")
+		session.Save(r, w)
+		http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/signin", http.StatusFound)
+		return
+	}
 
+	workspaceID, err := ah.queries.GetDefaultWorkspaceForUser(ctx, user.ID)
+
+	// Every user gets a personal workspace which owns their links and subscription
 	if err == pgx.ErrNoRows {
-		newUser, err := ah.queries.CreateUser(ctx, db.CreateUserParams{
-			Name:          pgtype.Text{String: gothUser.NickName, Valid: gothUser.NickName != ""},
-			Email:         gothUser.Email,
-			OauthProvider: pgtype.Text{String: gothUser.Provider, Valid: gothUser.Provider != ""},
+		workspaceID, err = ah.queries.CreateWorkspace(ctx, db.CreateWorkspaceParams{
+			Name:   "Personal",
+			UserID: user.ID,
 		})
-
 		if err != nil {
-			log.Printf("Failed to create user: %v", err)
-			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Failed to create workspace", logging.Err(err))
+			http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
 			return
 		}
 
-		// Workaround for sqlc not generating a shared type for GetUserByEmail and CreateUser queries.
-		// Make sure the two queries in queries.sql always return the same columns.
-		user = db.GetUserByEmailRow(newUser)
-
-		sub, err := ah.queries.AddBasicSubscription(ctx, user.ID)
-		if err != nil {
-			log.Println("Adding basic subscription to user failed", err)
-			http.Error(w, "Adding basic subscription to user failed", http.StatusInternalServerError)
+		if _, err := ah.subscriptionService.AddBasicSubscription(r, workspaceID, user.ID); err != nil {
+			slog.ErrorContext(r.Context(), "Adding basic subscription to workspace failed", logging.Err(err))
+			http.Error(w, "Adding basic subscription to workspace failed", http.StatusInternalServerError)
 			return
 		}
-		subscription = db.GetUserSubscriptionRow(sub)
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get default workspace", logging.Err(err))
+		http.Error(w, "Failed to get workspace", http.StatusInternalServerError)
+		return
 	}
 
-	session.Values["user"] = UserSession{
-		UserID:   user.ID,
-		Username: user.Name.String,
+	err = ah.sessionManager.Start(w, r, session, UserSession{
+		UserID:      user.ID,
+		Username:    user.Name.String,
+		WorkspaceID: workspaceID,
+		IsAdmin:     user.Role == "admin",
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to start session", logging.Err(err))
+		http.Error(w, "Failed to set session", http.StatusInternalServerError)
+		return
 	}
-	err = session.Save(r, w)
 
+	if newIdentity != nil {
+		ah.recordIdentityChange(r, workspaceID, user.ID, audit.ActionCreate, *newIdentity)
+	}
+
+	ah.auditLogger.Record(audit.Entry{
+		WorkspaceID: workspaceID,
+		ActorUserID: user.ID,
+		Action:      audit.ActionLogin,
+		TargetType:  audit.TargetUser,
+		TargetID:    strconv.Itoa(int(user.ID)),
+		After:       map[string]string{"provider": gothUser.Provider},
+	}.WithRequest(r))
+
+	http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/links", http.StatusSeeOther)
+}
+
+// findOrCreateUser returns the user gothUser's identity belongs to. Unknown
+// identities are linked to the user with the same verified email if the
+// provider can be trusted with emails, otherwise a new user is created. Only
+// users created through a trusted provider have their email verified. The
+// identity is returned if it was created.
+func (ah *AuthHandler) findOrCreateUser(ctx context.Context, gothUser goth.User) (db.GetUserByEmailRow, *db.UserIdentity, error) {
+	user, err := ah.queries.GetUserByIdentity(ctx, db.GetUserByIdentityParams{
+		Provider:       gothUser.Provider,
+		ProviderUserID: gothUser.UserID,
+	})
+	if err == nil {
+		return db.GetUserByEmailRow(user), nil, nil
+	}
+	if err != pgx.ErrNoRows {
+		return db.GetUserByEmailRow{}, nil, err
+	}
+
+	if gothUser.Email == "" {
+		return db.GetUserByEmailRow{}, nil, errNoEmail
+	}
+
+	existingUser, err := ah.queries.GetUserByEmail(ctx, gothUser.Email)
+	if err == nil {
+		if !trustedEmailProviders[gothUser.Provider] {
+			return existingUser, nil, errIdentityNotLinked
+		}
+		identity, err := ah.createIdentity(ctx, existingUser.ID, gothUser)
+		return existingUser, &identity, err
+	}
+	if err != pgx.ErrNoRows {
+		return existingUser, nil, err
+	}
+
+	newUser, err := ah.queries.CreateUser(ctx, db.CreateUserParams{
+		Name:          pgtype.Text{String: gothUser.NickName, Valid: gothUser.NickName != ""},
+		Email:         gothUser.Email,
+		EmailVerified: trustedEmailProviders[gothUser.Provider],
+	})
 	if err != nil {
-		log.Fatal(err)
-		http.Error(w, "Failed to set session", http.StatusInternalServerError)
+		return db.GetUserByEmailRow{}, nil, err
+	}
+
+	identity, err := ah.createIdentity(ctx, newUser.ID, gothUser)
+
+	// Workaround for sqlc not generating a shared type for GetUserByEmail and CreateUser queries.
+	// Make sure the two queries in queries.sql always return the same columns.
+	return db.GetUserByEmailRow(newUser), &identity, err
+}
+
+func (ah *AuthHandler) createIdentity(ctx context.Context, userID int32, gothUser goth.User) (db.UserIdentity, error) {
+	return ah.queries.CreateUserIdentity(ctx, db.CreateUserIdentityParams{
+		UserID:         userID,
+		Provider:       gothUser.Provider,
+		ProviderUserID: gothUser.UserID,
+		Email:          pgtype.Text{String: gothUser.Email, Valid: gothUser.Email != ""},
+	})
+}
+
+func (ah *AuthHandler) linkIdentity(w http.ResponseWriter, r *http.Request, session *sessions.Session, user UserSession, gothUser goth.User) {
+	ctx := context.Background()
+	label := providerLabel(gothUser.Provider)
+
+	redirectWithMessage := func(message string) {
+		session.AddFlash(message)
+		session.Save(r, w)
+		http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/account", http.StatusFound)
+	}
+
+	identity, err := ah.queries.GetIdentity(ctx, db.GetIdentityParams{
+		Provider:       gothUser.Provider,
+		ProviderUserID: gothUser.UserID,
+	})
+	if err == nil {
+		if identity.UserID == user.UserID {
+			redirectWithMessage(fmt.Sprintf("%s is already linked", label))
+		} else {
+			redirectWithMessage(fmt.Sprintf("That %s account is linked to another user", label))
+		}
+		return
+	}
+	if err != pgx.ErrNoRows {
+		slog.ErrorContext(r.Context(), "Failed to look up identity", logging.Err(err))
+		http.Error(w, "Failed to link account", http.StatusInternalServerError)
 		return
 	}
 
-	if subscription.Name == "" {
-		subscription, err = ah.queries.GetUserSubscription(ctx, user.ID)
-		if err != nil {
-			log.Printf("Failed to get user subscription: %v", err)
-			http.Error(w, "Failed to get user subscription", http.StatusInternalServerError)
-			return
+	identity, err = ah.createIdentity(ctx, user.UserID, gothUser)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create identity", logging.Err(err))
+		http.Error(w, "Failed to link account", http.StatusInternalServerError)
+		return
+	}
+	ah.recordIdentityChange(r, user.WorkspaceID, user.UserID, audit.ActionCreate, identity)
+
+	redirectWithMessage(fmt.Sprintf("You can now sign in with %s", label))
+}
+
+func (ah *AuthHandler) recordIdentityChange(r *http.Request, workspaceID, userID int32, action audit.Action, identity db.UserIdentity) {
+	state := map[string]string{
+		"provider": identity.Provider,
+		"email":    identity.Email.String,
+	}
+	entry := audit.Entry{
+		WorkspaceID: workspaceID,
+		ActorUserID: userID,
+		Action:      action,
+		TargetType:  audit.TargetUserIdentity,
+		TargetID:    strconv.Itoa(int(identity.ID)),
+	}
+	if action == audit.ActionDelete {
+		entry.Before = state
+	} else {
+		entry.After = state
+	}
+	ah.auditLogger.Record(entry.WithRequest(r))
+}
+
+type IdentityListItem struct {
+	ID       int32
+	Label    string
+	Email    string
+	LinkedAt time.Time
+}
+
+func (ah *AuthHandler) Account(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(UserSession)
+
+	identities, err := ah.queries.GetIdentitiesForUser(context.Background(), user.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve user's identities", logging.Err(err))
+		http.Error(w, "Failed to retrieve account", http.StatusInternalServerError)
+		return
+	}
+
+	linked := make(map[string]bool)
+	var items []IdentityListItem
+	for _, identity := range identities {
+		linked[identity.Provider] = true
+		items = append(items, IdentityListItem{
+			ID:       identity.ID,
+			Label:    providerLabel(identity.Provider),
+			Email:    identity.Email.String,
+			LinkedAt: identity.CreatedAt.Time,
+		})
+	}
+
+	var unlinked []Provider
+	for _, p := range Providers() {
+		if !linked[p.Name] {
+			unlinked = append(unlinked, p)
 		}
 	}
 
-	_, err = ah.redisClient.Get(ctx, fmt.Sprintf("user:%d:subscription", user.ID)).Result()
-	if err == redis.Nil {
-		b, err := json.Marshal(subscription)
-		if err != nil {
-			log.Printf("JSON conversion failed: %v", err)
-			http.Error(w, "Error", http.StatusInternalServerError)
+	activeSessions, err := ah.sessionManager.List(r.Context(), user.UserID, session.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve user's sessions", logging.Err(err))
+		http.Error(w, "Failed to retrieve account", http.StatusInternalServerError)
+		return
+	}
+
+	var message string
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message, _ = flashes[0].(string)
+	}
+	session.Save(r, w)
+
+	data := map[string]interface{}{
+		"user":              user,
+		"identities":        items,
+		"canUnlink":         len(items) > 1,
+		"unlinkedProviders": unlinked,
+		"sessions":          activeSessions,
+		"message":           message,
+	}
+
+	if err := ah.template.ExecuteTemplate(w, r, "account.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (ah *AuthHandler) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(UserSession)
+	ctx := context.Background()
+	accountPath := "/" + config.AppData.AppPathPrefix + "/account"
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	identities, err := ah.queries.GetIdentitiesForUser(ctx, user.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve user's identities", logging.Err(err))
+		http.Error(w, "Failed to unlink account", http.StatusInternalServerError)
+		return
+	}
+
+	var identity *db.UserIdentity
+	for i := range identities {
+		if identities[i].ID == int32(id) {
+			identity = &identities[i]
 		}
-		ah.redisClient.Set(ctx, fmt.Sprintf("user:%d:subscription", user.ID), string(b), 0)
+	}
+	if identity == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
 	}
 
-	http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/links", http.StatusSeeOther)
+	deleted, err := ah.queries.DeleteUserIdentity(ctx, db.DeleteUserIdentityParams{
+		ID:     identity.ID,
+		UserID: user.UserID,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete identity", logging.Err(err))
+		http.Error(w, "Failed to unlink account", http.StatusInternalServerError)
+		return
+	}
+
+	if deleted == 0 {
+		session.AddFlash("You can't unlink the only way you can sign in")
+	} else {
+		ah.recordIdentityChange(r, user.WorkspaceID, user.UserID, audit.ActionDelete, *identity)
+		session.AddFlash(fmt.Sprintf("Unlinked %s", providerLabel(identity.Provider)))
+	}
+	session.Save(r, w)
+	http.Redirect(w, r, accountPath, http.StatusSeeOther)
+}
+
+func (ah *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(UserSession)
+	handle := mux.Vars(r)["id"]
+
+	// Revoking the session you're using is just signing out
+	if handle == sessionHandle(session.ID) {
+		ah.Signout(w, r)
+		return
+	}
+
+	revoked, err := ah.sessionManager.Revoke(r.Context(), user.UserID, handle)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to revoke session", logging.Err(err))
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	session.AddFlash("Signed out the session")
+	session.Save(r, w)
+	http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/account", http.StatusSeeOther)
+}
+
+func (ah *AuthHandler) SignoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	user := session.Values["user"].(UserSession)
+
+	if err := ah.sessionManager.RevokeAll(r.Context(), user.UserID); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to revoke sessions", logging.Err(err))
+		http.Error(w, "Failed to sign out everywhere", http.StatusInternalServerError)
+		return
+	}
+
+	ah.Signout(w, r)
 }
 
 func (ah *AuthHandler) Signin(w http.ResponseWriter, r *http.Request) {
@@ -133,18 +461,31 @@ func (ah *AuthHandler) Signin(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/links", http.StatusSeeOther)
 		return
 	}
-	if err := ah.template.ExecuteTemplate(w, "signin.html", nil); err != nil {
+
+	var message string
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message, _ = flashes[0].(string)
+	}
+	session.Save(r, w)
+
+	data := map[string]interface{}{
+		"providers":   Providers(),
+		"emailSignin": ah.mailer != nil,
+		"message":     message,
+	}
+
+	if err := ah.template.ExecuteTemplate(w, r, "signin.html", data); err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 	}
 }
 
 func (ah *AuthHandler) Signout(w http.ResponseWriter, r *http.Request) {
 	session, _ := ah.sessionStore.Get(r, "session")
-	session.Options.MaxAge = -1
-	err := session.Save(r, w)
+	err := ah.sessionManager.End(w, r, session)
 
 	if err != nil {
-		log.Fatal("Failed to delete session", err)
+		slog.ErrorContext(r.Context(), "Failed to delete session", logging.Err(err))
+		http.Error(w, "Failed to sign out", http.StatusInternalServerError)
 		return
 	}
 
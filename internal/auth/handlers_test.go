@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/didoarellano/short/internal/db"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/markbates/goth"
+)
+
+// Needs a database with migrations/schema.sql applied, e.g.
+// TEST_DATABASE_URL=$DEV_HOST_DB_URL
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestUntrustedSignUpDoesNotClaimEmail(t *testing.T) {
+	pool := testPool(t)
+	ah := &AuthHandler{queries: db.New(pool)}
+	ctx := context.Background()
+	email := fmt.Sprintf("victim-%d@example.com", time.Now().UnixNano())
+	t.Cleanup(func() {
+		pool.Exec(ctx, "DELETE FROM users WHERE email = $1", email)
+	})
+
+	attacker, _, err := ah.findOrCreateUser(ctx, goth.User{
+		Provider: "untrusted",
+		UserID:   "attacker",
+		Email:    email,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	victim, _, err := ah.findOrCreateUser(ctx, goth.User{
+		Provider: "google",
+		UserID:   fmt.Sprintf("victim-%d", time.Now().UnixNano()),
+		Email:    email,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if victim.ID == attacker.ID {
+		t.Fatalf("Expected the victim to get their own account, got the attacker's (%d)", attacker.ID)
+	}
+
+	user, err := ah.queries.GetUserByEmail(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != victim.ID {
+		t.Errorf("GetUserByEmail() = user %d, want %d", user.ID, victim.ID)
+	}
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/mailer"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/markbates/goth"
+)
+
+// EmailProvider is the identity provider name of users who sign in with a
+// magic link. Receiving the link proves they own the address.
+const EmailProvider = "email"
+
+const magicLinkTTL = 15 * time.Minute
+
+// Only the hash of a token is stored so tokens can't be lifted from Redis.
+func magicLinkKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "magiclink:" + hex.EncodeToString(sum[:])
+}
+
+func generateMagicLinkToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (ah *AuthHandler) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+	signinPath := "/" + config.AppData.AppPathPrefix + "/signin"
+
+	if ah.mailer == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	redirectWithMessage := func(message string) {
+		session.AddFlash(message)
+		session.Save(r, w)
+		http.Redirect(w, r, signinPath, http.StatusSeeOther)
+	}
+
+	r.ParseForm()
+	address, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("email")))
+	if err != nil {
+		redirectWithMessage("Enter a valid email address")
+		return
+	}
+	email := strings.ToLower(address.Address)
+
+	token := generateMagicLinkToken()
+	ctx := context.Background()
+	if err := ah.redisClient.Set(ctx, magicLinkKey(token), email, magicLinkTTL).Err(); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to store magic link token", logging.Err(err))
+		http.Error(w, "Failed to send sign in link", http.StatusInternalServerError)
+		return
+	}
+
+	link := fmt.Sprintf("%s/%s/signin/email/%s", config.AppData.RedirectorBaseURL, config.AppData.AppPathPrefix, token)
+	err = ah.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Your Short sign in link",
+		Body:    fmt.Sprintf("Use this link to sign in to Short:\n\n%s\n\nIt expires in %d minutes and can only be used once. If you didn't ask for it you can ignore this email.", link, int(magicLinkTTL.Minutes())),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send magic link", logging.Err(err))
+		http.Error(w, "Failed to send sign in link", http.StatusInternalServerError)
+		return
+	}
+
+	redirectWithMessage(fmt.Sprintf("We've emailed a sign in link to %s", email))
+}
+
+// ShowMagicLink asks for confirmation rather than signing in straight away
+// because mail scanners follow links and would use up the token.
+func (ah *AuthHandler) ShowMagicLink(w http.ResponseWriter, r *http.Request) {
+	if ah.mailer == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	exists, err := ah.redisClient.Exists(context.Background(), magicLinkKey(mux.Vars(r)["token"])).Result()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up magic link token", logging.Err(err))
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"isValid": exists == 1,
+	}
+
+	if err := ah.template.ExecuteTemplate(w, r, "magic_link.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (ah *AuthHandler) CompleteMagicLink(w http.ResponseWriter, r *http.Request) {
+	session, _ := ah.sessionStore.Get(r, "session")
+
+	if ah.mailer == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if session.Values["user"] != nil {
+		http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/links", http.StatusSeeOther)
+		return
+	}
+
+	// GETDEL makes the token single use even if it's submitted twice at once
+	email, err := ah.redisClient.GetDel(context.Background(), magicLinkKey(mux.Vars(r)["token"])).Result()
+	if err == redis.Nil {
+		session.AddFlash("That sign in link is invalid or has expired")
+		session.Save(r, w)
+		http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/signin", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up magic link token", logging.Err(err))
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	ah.signIn(w, r, session, goth.User{
+		Provider: EmailProvider,
+		UserID:   email,
+		Email:    email,
+	})
+}
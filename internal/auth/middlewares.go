@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/didoarellano/short/internal/session"
+	"github.com/markbates/goth/gothic"
 )
 
 func PrivateRoute(sessionStore session.SessionStore) func(next http.Handler) http.Handler {
@@ -19,3 +20,18 @@ func PrivateRoute(sessionStore session.SessionStore) func(next http.Handler) htt
 		})
 	}
 }
+
+// KnownProvider hands requests for providers that aren't configured to
+// notFound instead of letting gothic fail on them.
+func KnownProvider(notFound http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, err := gothic.GetProviderName(r)
+			if err != nil || !IsProviderEnabled(name) {
+				notFound.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestKnownProvider(t *testing.T) {
+	providers = []Provider{{Name: "github", Label: "GitHub"}}
+	defer func() { providers = nil }()
+
+	notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler := KnownProvider(notFound)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		provider string
+		want     int
+	}{
+		{"github", http.StatusOK},
+		{"google", http.StatusNotFound},
+		{"unknown", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/app/auth/"+tt.provider, nil)
+			r = mux.SetURLVars(r, map[string]string{"provider": tt.provider})
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/didoarellano/short/internal/clientip"
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/csrf"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/session"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/sessions"
+)
+
+// Last seen times are only written this often so browsing doesn't save the
+// session on every request.
+const lastSeenInterval = time.Minute
+
+// SessionManager tracks each user's signed in sessions in Redis so they can
+// be listed and revoked, and enforces the idle and absolute timeouts.
+type SessionManager struct {
+	sessionStore session.SessionStore
+	redisClient  *redis.Client
+	config       session.Config
+}
+
+func NewSessionManager(s session.SessionStore, r *redis.Client, cfg session.Config) *SessionManager {
+	return &SessionManager{
+		sessionStore: s,
+		redisClient:  r,
+		config:       cfg,
+	}
+}
+
+type sessionRecord struct {
+	SessionID  string
+	UserAgent  string
+	IPAddress  string
+	SignedInAt time.Time
+	LastSeenAt time.Time
+}
+
+// ActiveSession is a signed in session as shown to its user. Sessions are
+// referred to by Handle so session IDs never end up in pages.
+type ActiveSession struct {
+	Handle     string
+	Device     string
+	IPAddress  string
+	SignedInAt time.Time
+	LastSeenAt time.Time
+	Current    bool
+}
+
+func userSessionsKey(userID int32) string {
+	return fmt.Sprintf("user:%d:sessions", userID)
+}
+
+func sessionHandle(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (sm *SessionManager) expired(signedInAt, lastSeenAt, now time.Time) bool {
+	return now.Sub(signedInAt) > sm.config.AbsoluteTimeout || now.Sub(lastSeenAt) > sm.config.IdleTimeout
+}
+
+// Start signs user in on s. The session gets a new ID and csrf token so
+// anything learned about it before sign in is useless afterwards.
+func (sm *SessionManager) Start(w http.ResponseWriter, r *http.Request, s *sessions.Session, user UserSession) error {
+	ctx := r.Context()
+	if s.ID != "" {
+		if err := sm.redisClient.Del(ctx, session.KeyPrefix+s.ID).Err(); err != nil {
+			return err
+		}
+		s.ID = ""
+	}
+	csrf.Reset(s)
+
+	now := time.Now()
+	user.SignedInAt = now
+	user.LastSeenAt = now
+	s.Values["user"] = user
+	if err := sm.sessionStore.Save(r, w, s); err != nil {
+		return err
+	}
+
+	return sm.saveRecord(ctx, user.UserID, sessionRecord{
+		SessionID:  s.ID,
+		UserAgent:  r.UserAgent(),
+		IPAddress:  clientip.FromRequest(r),
+		SignedInAt: now,
+		LastSeenAt: now,
+	})
+}
+
+func (sm *SessionManager) saveRecord(ctx context.Context, userID int32, record sessionRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key := userSessionsKey(userID)
+	pipe := sm.redisClient.TxPipeline()
+	pipe.HSet(ctx, key, sessionHandle(record.SessionID), b)
+	pipe.Expire(ctx, key, sm.config.AbsoluteTimeout)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// End signs out of s and forgets it.
+func (sm *SessionManager) End(w http.ResponseWriter, r *http.Request, s *sessions.Session) error {
+	if user, ok := s.Values["user"].(UserSession); ok && s.ID != "" {
+		if err := sm.redisClient.HDel(r.Context(), userSessionsKey(user.UserID), sessionHandle(s.ID)).Err(); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to forget session", logging.Err(err))
+		}
+	}
+	s.Options.MaxAge = -1
+	return sm.sessionStore.Save(r, w, s)
+}
+
+// Middleware signs out sessions past their idle or absolute timeout and
+// keeps the last seen time of the rest up to date. It must run after
+// PrivateRoute.
+func (sm *SessionManager) Middleware() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s, _ := sm.sessionStore.Get(r, "session")
+			user := s.Values["user"].(UserSession)
+			now := time.Now()
+
+			if sm.expired(user.SignedInAt, user.LastSeenAt, now) {
+				sm.redisClient.HDel(r.Context(), userSessionsKey(user.UserID), sessionHandle(s.ID))
+				sm.redisClient.Del(r.Context(), session.KeyPrefix+s.ID)
+				s.ID = ""
+				s.Values = make(map[interface{}]interface{})
+				s.AddFlash("Your session has expired. Please sign in again.")
+				s.Save(r, w)
+				http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/signin", http.StatusFound)
+				return
+			}
+
+			if now.Sub(user.LastSeenAt) >= lastSeenInterval {
+				user.LastSeenAt = now
+				s.Values["user"] = user
+				if err := s.Save(r, w); err != nil {
+					slog.ErrorContext(r.Context(), "Failed to save session", logging.Err(err))
+				} else if err := sm.saveRecord(r.Context(), user.UserID, sessionRecord{
+					SessionID:  s.ID,
+					UserAgent:  r.UserAgent(),
+					IPAddress:  clientip.FromRequest(r),
+					SignedInAt: user.SignedInAt,
+					LastSeenAt: now,
+				}); err != nil {
+					slog.ErrorContext(r.Context(), "Failed to record session", logging.Err(err))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// List returns the user's live sessions, most recently used first. Records
+// of sessions that have expired or been deleted are cleaned up on the way.
+func (sm *SessionManager) List(ctx context.Context, userID int32, currentSessionID string) ([]ActiveSession, error) {
+	key := userSessionsKey(userID)
+	records, err := sm.redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var active []ActiveSession
+	for handle, raw := range records {
+		var record sessionRecord
+		if err := json.Unmarshal([]byte(raw), &record); err != nil {
+			slog.ErrorContext(ctx, "Failed to decode session record", logging.Err(err))
+			sm.redisClient.HDel(ctx, key, handle)
+			continue
+		}
+
+		exists, err := sm.redisClient.Exists(ctx, session.KeyPrefix+record.SessionID).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists == 0 || sm.expired(record.SignedInAt, record.LastSeenAt, now) {
+			sm.redisClient.Del(ctx, session.KeyPrefix+record.SessionID)
+			sm.redisClient.HDel(ctx, key, handle)
+			continue
+		}
+
+		active = append(active, ActiveSession{
+			Handle:     handle,
+			Device:     describeUserAgent(record.UserAgent),
+			IPAddress:  record.IPAddress,
+			SignedInAt: record.SignedInAt,
+			LastSeenAt: record.LastSeenAt,
+			Current:    record.SessionID == currentSessionID,
+		})
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].LastSeenAt.After(active[j].LastSeenAt)
+	})
+	return active, nil
+}
+
+// Revoke deletes one of the user's sessions. It reports false if the user
+// has no session with that handle.
+func (sm *SessionManager) Revoke(ctx context.Context, userID int32, handle string) (bool, error) {
+	key := userSessionsKey(userID)
+	raw, err := sm.redisClient.HGet(ctx, key, handle).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var record sessionRecord
+	if err := json.Unmarshal([]byte(raw), &record); err != nil {
+		return false, err
+	}
+
+	pipe := sm.redisClient.TxPipeline()
+	pipe.Del(ctx, session.KeyPrefix+record.SessionID)
+	pipe.HDel(ctx, key, handle)
+	_, err = pipe.Exec(ctx)
+	return err == nil, err
+}
+
+// RevokeAll deletes every one of the user's sessions.
+func (sm *SessionManager) RevokeAll(ctx context.Context, userID int32) error {
+	key := userSessionsKey(userID)
+	records, err := sm.redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{key}
+	for _, raw := range records {
+		var record sessionRecord
+		if err := json.Unmarshal([]byte(raw), &record); err == nil {
+			keys = append(keys, session.KeyPrefix+record.SessionID)
+		}
+	}
+	return sm.redisClient.Del(ctx, keys...).Err()
+}
+
+// describeUserAgent turns a User-Agent header into something like "Firefox
+// on Windows". It only needs to be good enough for people to recognise their
+// own devices.
+func describeUserAgent(ua string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	}
+
+	os := ""
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		os = "iOS"
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	}
+
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/didoarellano/short/internal/session"
+)
+
+func TestSessionExpired(t *testing.T) {
+	sm := NewSessionManager(nil, nil, session.Config{
+		IdleTimeout:     time.Hour,
+		AbsoluteTimeout: 24 * time.Hour,
+	})
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		signedInAt time.Time
+		lastSeenAt time.Time
+		want       bool
+	}{
+		{"fresh", now.Add(-time.Minute), now.Add(-time.Minute), false},
+		{"idle", now.Add(-2 * time.Hour), now.Add(-2 * time.Hour), true},
+		{"past absolute timeout", now.Add(-25 * time.Hour), now.Add(-time.Minute), true},
+		{"never stamped", time.Time{}, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sm.expired(tt.signedInAt, tt.lastSeenAt, now); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescribeUserAgent(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:131.0) Gecko/20100101 Firefox/131.0", "Firefox on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36", "Chrome on macOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Mobile/15E148 Safari/604.1", "Safari on iOS"},
+		{"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Mobile Safari/537.36 Edg/130.0.0.0", "Edge on Android"},
+		{"curl/8.5.0", "Unknown browser"},
+	}
+
+	for _, tt := range tests {
+		if got := describeUserAgent(tt.ua); got != tt.want {
+			t.Errorf("describeUserAgent(%q) = %q, want %q", tt.ua, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// PaymentProvider takes payments for plans. Checkouts are started in the
+// app, everything after that is reported back through webhooks.
+type PaymentProvider interface {
+	// Name identifies the provider in stored events.
+	Name() string
+	// Sells reports whether plan can be bought through the provider.
+	Sells(plan string) bool
+	CreateCheckoutSession(ctx context.Context, params CheckoutParams) (CheckoutSession, error)
+	// SetCancelAtPeriodEnd stops, or resumes, a subscription renewing.
+	SetCancelAtPeriodEnd(ctx context.Context, providerSubscriptionID string, cancel bool) error
+	// ChangePlan switches the plan a subscription renews onto. The current
+	// period isn't prorated, the new price is charged from the next renewal.
+	ChangePlan(ctx context.Context, providerSubscriptionID string, plan string) error
+	// ParseWebhook verifies a webhook request's signature and returns the
+	// event it carries. Events the app doesn't act on have an empty Type.
+	ParseWebhook(r *http.Request) (Event, error)
+}
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrUnknownPlan      = errors.New("plan can't be bought")
+)
+
+type CheckoutParams struct {
+	WorkspaceID int32
+	Plan        string
+	SuccessURL  string
+	CancelURL   string
+}
+
+type CheckoutSession struct {
+	ID  string
+	URL string
+}
+
+type EventType string
+
+const (
+	EventSubscriptionCreated   EventType = "subscription_created"
+	EventSubscriptionRenewed   EventType = "subscription_renewed"
+	EventSubscriptionCancelled EventType = "subscription_cancelled"
+	EventPaymentFailed         EventType = "payment_failed"
+)
+
+// Event is a provider's webhook event in the app's terms. WorkspaceID and
+// Plan are only set on EventSubscriptionCreated, later events refer to the
+// subscription by ProviderSubscriptionID.
+type Event struct {
+	ID                     string
+	Type                   EventType
+	WorkspaceID            int32
+	Plan                   string
+	ProviderSubscriptionID string
+	PeriodEnd              time.Time
+}
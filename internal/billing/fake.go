@@ -0,0 +1,103 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+const fakeSignatureHeader = "Fake-Signature"
+
+// FakeProvider is an in-memory PaymentProvider for tests. Its webhooks are
+// Events encoded as JSON and signed with Secret.
+type FakeProvider struct {
+	Secret string
+	Plans  []string
+
+	mu                sync.Mutex
+	CheckoutSessions  []CheckoutParams
+	CancelAtPeriodEnd map[string]bool
+	RenewalPlans      map[string]string
+}
+
+func NewFakeProvider(secret string, plans ...string) *FakeProvider {
+	return &FakeProvider{
+		Secret:            secret,
+		Plans:             plans,
+		CancelAtPeriodEnd: make(map[string]bool),
+		RenewalPlans:      make(map[string]string),
+	}
+}
+
+func (fp *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (fp *FakeProvider) Sells(plan string) bool {
+	return slices.Contains(fp.Plans, plan)
+}
+
+func (fp *FakeProvider) CreateCheckoutSession(ctx context.Context, params CheckoutParams) (CheckoutSession, error) {
+	if !fp.Sells(params.Plan) {
+		return CheckoutSession{}, ErrUnknownPlan
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.CheckoutSessions = append(fp.CheckoutSessions, params)
+	id := fmt.Sprintf("cs_fake_%d", len(fp.CheckoutSessions))
+	return CheckoutSession{ID: id, URL: params.SuccessURL}, nil
+}
+
+func (fp *FakeProvider) SetCancelAtPeriodEnd(ctx context.Context, providerSubscriptionID string, cancel bool) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.CancelAtPeriodEnd[providerSubscriptionID] = cancel
+	return nil
+}
+
+func (fp *FakeProvider) ChangePlan(ctx context.Context, providerSubscriptionID string, plan string) error {
+	if !fp.Sells(plan) {
+		return ErrUnknownPlan
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	fp.RenewalPlans[providerSubscriptionID] = plan
+	fp.CancelAtPeriodEnd[providerSubscriptionID] = false
+	return nil
+}
+
+func (fp *FakeProvider) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(fp.Secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (fp *FakeProvider) ParseWebhook(r *http.Request) (Event, error) {
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		return Event{}, err
+	}
+	if !hmac.Equal([]byte(r.Header.Get(fakeSignatureHeader)), []byte(fp.sign(payload))) {
+		return Event{}, ErrInvalidSignature
+	}
+
+	var event Event
+	err = json.Unmarshal(payload, &event)
+	return event, err
+}
+
+// WebhookRequest builds a signed webhook request delivering event.
+func (fp *FakeProvider) WebhookRequest(event Event) *http.Request {
+	payload, _ := json.Marshal(event)
+	r, _ := http.NewRequest("POST", "/webhooks/billing", bytes.NewReader(payload))
+	r.Header.Set(fakeSignatureHeader, fp.sign(payload))
+	return r
+}
@@ -0,0 +1,58 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/didoarellano/short/internal/logging"
+)
+
+// Stripe's events can run to a few hundred KB, e.g. invoices with a lot of
+// line items
+const maxWebhookBytes = 1 << 20
+
+type BillingHandler struct {
+	service *Service
+}
+
+func NewBillingHandlers(bs *Service) *BillingHandler {
+	return &BillingHandler{service: bs}
+}
+
+// Webhook receives the payment provider's events. Anything other than a 2xx
+// makes the provider retry, which is what we want for processing failures
+// but not for requests that fail verification.
+func (bh *BillingHandler) Webhook(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxWebhookBytes)
+	event, err := bh.service.provider.ParseWebhook(r)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		slog.ErrorContext(r.Context(), "Billing webhook too large", slog.Int64("limit", tooLarge.Limit))
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, ErrInvalidSignature) {
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to parse billing webhook", logging.Err(err))
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+
+	if event.Type == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := bh.service.HandleEvent(context.WithoutCancel(r.Context()), event); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to handle billing event", slog.String("event_id", event.ID), logging.Err(err))
+		http.Error(w, "Failed to handle event", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,207 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/didoarellano/short/internal/audit"
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/subscriptions"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Service applies a PaymentProvider's events to workspaces' subscriptions.
+type Service struct {
+	pool                *pgxpool.Pool
+	queries             *db.Queries
+	provider            PaymentProvider
+	subscriptionService *subscriptions.UserSubscriptionService
+	auditLogger         *audit.Logger
+}
+
+func NewService(pool *pgxpool.Pool, q *db.Queries, p PaymentProvider, us *subscriptions.UserSubscriptionService, a *audit.Logger) *Service {
+	return &Service{
+		pool:                pool,
+		queries:             q,
+		provider:            p,
+		subscriptionService: us,
+		auditLogger:         a,
+	}
+}
+
+func (bs *Service) Sells(plan string) bool {
+	return bs.provider.Sells(plan)
+}
+
+// Checkout starts buying plan for a workspace and returns the provider's
+// checkout URL. The plan only changes once the provider reports payment.
+func (bs *Service) Checkout(r *http.Request, workspaceID int32, plan string) (string, error) {
+	billingURL := baseURL(r) + "/" + config.AppData.AppPathPrefix + "/billing"
+
+	session, err := bs.provider.CreateCheckoutSession(r.Context(), CheckoutParams{
+		WorkspaceID: workspaceID,
+		Plan:        plan,
+		SuccessURL:  billingURL + "?checkout=success",
+		CancelURL:   billingURL,
+	})
+	if err != nil {
+		return "", err
+	}
+	return session.URL, nil
+}
+
+// SetRenewalPlan sets the plan a workspace's paid subscription renews onto
+// at the end of its period. A plan the provider doesn't sell, like basic,
+// stops it renewing. Workspaces not paying through the provider are left
+// alone.
+func (bs *Service) SetRenewalPlan(ctx context.Context, workspaceID int32, plan string) error {
+	providerSubscriptionID, err := bs.queries.GetActiveProviderSubscriptionID(ctx, workspaceID)
+	if err == pgx.ErrNoRows || (err == nil && !providerSubscriptionID.Valid) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bs.provider.Sells(plan) {
+		return bs.provider.SetCancelAtPeriodEnd(ctx, providerSubscriptionID.String, true)
+	}
+	return bs.provider.ChangePlan(ctx, providerSubscriptionID.String, plan)
+}
+
+// HandleEvent applies event at most once. Providers retry deliveries so the
+// event's ID is recorded in the same transaction as the change it makes, and
+// events that have been seen before are skipped.
+func (bs *Service) HandleEvent(ctx context.Context, event Event) error {
+	tx, err := bs.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	qtx := bs.queries.WithTx(tx)
+
+	recorded, err := qtx.RecordBillingEvent(ctx, db.RecordBillingEventParams{
+		ID:       event.ID,
+		Provider: bs.provider.Name(),
+		Type:     string(event.Type),
+	})
+	if err != nil {
+		return err
+	}
+	if recorded == 0 {
+		return nil
+	}
+
+	workspaceID, replaced, err := applyEvent(ctx, qtx, event)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// Events for subscriptions the app no longer tracks change nothing
+	if workspaceID == 0 {
+		return nil
+	}
+	bs.subscriptionService.InvalidateSubscription(ctx, workspaceID)
+
+	// A workspace moving between paid plans has bought a new subscription,
+	// the one it replaced runs out its paid period and then stops
+	if replaced.Valid && replaced.String != event.ProviderSubscriptionID {
+		if err := bs.provider.SetCancelAtPeriodEnd(ctx, replaced.String, true); err != nil {
+			slog.ErrorContext(ctx, "Failed to cancel replaced subscription", slog.String("provider_subscription_id", replaced.String), logging.Err(err))
+		}
+	}
+
+	after, err := bs.queries.GetWorkspaceSubscription(ctx, workspaceID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retrieve workspace subscription", slog.Int("workspace_id", int(workspaceID)), logging.Err(err))
+	}
+	bs.auditLogger.Record(audit.Entry{
+		WorkspaceID: workspaceID,
+		Action:      audit.ActionSubscriptionChange,
+		TargetType:  audit.TargetWorkspace,
+		TargetID:    strconv.Itoa(int(workspaceID)),
+		After: map[string]string{
+			"billing_event": string(event.Type),
+			"plan":          after.Name,
+		},
+	})
+
+	return nil
+}
+
+// applyEvent returns the workspace the event changed, zero if none, and for
+// new subscriptions the provider subscription the workspace was paying with
+// before.
+func applyEvent(ctx context.Context, q *db.Queries, event Event) (int32, pgtype.Text, error) {
+	var replaced pgtype.Text
+	providerSubscriptionID := pgtype.Text{String: event.ProviderSubscriptionID, Valid: true}
+
+	var workspaceID int32
+	var err error
+	switch event.Type {
+	case EventSubscriptionCreated:
+		replaced, err = q.GetActiveProviderSubscriptionID(ctx, event.WorkspaceID)
+		if err != nil && err != pgx.ErrNoRows {
+			return 0, replaced, err
+		}
+
+		started, err := q.StartProviderSubscription(ctx, db.StartProviderSubscriptionParams{
+			EndDate:                periodEnd(event),
+			ProviderSubscriptionID: providerSubscriptionID,
+			Plan:                   event.Plan,
+			WorkspaceID:            event.WorkspaceID,
+		})
+		if err != nil {
+			return 0, replaced, err
+		}
+		if started == 0 {
+			return 0, replaced, fmt.Errorf("can't start %q subscription for workspace %d", event.Plan, event.WorkspaceID)
+		}
+		return event.WorkspaceID, replaced, nil
+	case EventSubscriptionRenewed:
+		workspaceID, err = q.RenewProviderSubscription(ctx, db.RenewProviderSubscriptionParams{
+			ProviderSubscriptionID: providerSubscriptionID,
+			EndDate:                periodEnd(event),
+		})
+	case EventPaymentFailed:
+		workspaceID, err = q.MarkProviderSubscriptionPaymentFailed(ctx, providerSubscriptionID)
+	case EventSubscriptionCancelled:
+		workspaceID, err = q.EndProviderSubscription(ctx, providerSubscriptionID)
+	default:
+		return 0, replaced, nil
+	}
+
+	if err == pgx.ErrNoRows {
+		return 0, replaced, nil
+	}
+	return workspaceID, replaced, err
+}
+
+// Providers that don't say when a period ends bill monthly
+func periodEnd(event Event) pgtype.Timestamp {
+	end := event.PeriodEnd
+	if end.IsZero() {
+		end = time.Now().AddDate(0, 1, 0)
+	}
+	return pgtype.Timestamp{Time: end.UTC(), Valid: true}
+}
+
+func baseURL(r *http.Request) string {
+	scheme := "https"
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	} else if r.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host
+}
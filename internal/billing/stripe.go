@@ -0,0 +1,286 @@
+package billing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stripeAPIURL = "https://api.stripe.com/v1"
+	// Webhooks older than this are rejected so captured requests can't be
+	// replayed
+	stripeSignatureTolerance = 5 * time.Minute
+)
+
+// StripeProvider talks to Stripe's API directly. Plans are sold using the
+// Stripe price IDs in Prices, keyed by plan name.
+type StripeProvider struct {
+	SecretKey     string
+	WebhookSecret string
+	Prices        map[string]string
+	Client        *http.Client
+	now           func() time.Time
+}
+
+func NewStripeProvider(secretKey, webhookSecret string, prices map[string]string) *StripeProvider {
+	return &StripeProvider{
+		SecretKey:     secretKey,
+		WebhookSecret: webhookSecret,
+		Prices:        prices,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		now:           time.Now,
+	}
+}
+
+func (sp *StripeProvider) Name() string {
+	return "stripe"
+}
+
+func (sp *StripeProvider) Sells(plan string) bool {
+	_, ok := sp.Prices[plan]
+	return ok
+}
+
+func (sp *StripeProvider) post(ctx context.Context, path string, form url.Values, v any) error {
+	return sp.do(ctx, "POST", path, form, v)
+}
+
+func (sp *StripeProvider) get(ctx context.Context, path string, v any) error {
+	return sp.do(ctx, "GET", path, url.Values{}, v)
+}
+
+func (sp *StripeProvider) do(ctx context.Context, method, path string, form url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, stripeAPIURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sp.SecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := sp.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("stripe: %s %s: %s", path, res.Status, body)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+func (sp *StripeProvider) CreateCheckoutSession(ctx context.Context, params CheckoutParams) (CheckoutSession, error) {
+	price, ok := sp.Prices[params.Plan]
+	if !ok {
+		return CheckoutSession{}, ErrUnknownPlan
+	}
+
+	workspaceID := strconv.Itoa(int(params.WorkspaceID))
+	form := url.Values{
+		"mode":                    {"subscription"},
+		"line_items[0][price]":    {price},
+		"line_items[0][quantity]": {"1"},
+		"success_url":             {params.SuccessURL},
+		"cancel_url":              {params.CancelURL},
+		"client_reference_id":     {workspaceID},
+		"subscription_data[metadata][workspace_id]": {workspaceID},
+		"subscription_data[metadata][plan]":         {params.Plan},
+	}
+
+	var session struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := sp.post(ctx, "/checkout/sessions", form, &session); err != nil {
+		return CheckoutSession{}, err
+	}
+	return CheckoutSession{ID: session.ID, URL: session.URL}, nil
+}
+
+func (sp *StripeProvider) SetCancelAtPeriodEnd(ctx context.Context, providerSubscriptionID string, cancel bool) error {
+	form := url.Values{"cancel_at_period_end": {strconv.FormatBool(cancel)}}
+	return sp.post(ctx, "/subscriptions/"+url.PathEscape(providerSubscriptionID), form, nil)
+}
+
+// ChangePlan swaps the price on the subscription's only item. Checkouts
+// sell one plan per subscription so there's always exactly one.
+func (sp *StripeProvider) ChangePlan(ctx context.Context, providerSubscriptionID string, plan string) error {
+	price, ok := sp.Prices[plan]
+	if !ok {
+		return ErrUnknownPlan
+	}
+
+	path := "/subscriptions/" + url.PathEscape(providerSubscriptionID)
+	var subscription struct {
+		Items struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		} `json:"items"`
+	}
+	if err := sp.get(ctx, path, &subscription); err != nil {
+		return err
+	}
+	if len(subscription.Items.Data) == 0 {
+		return fmt.Errorf("stripe: subscription %s has no items", providerSubscriptionID)
+	}
+
+	form := url.Values{
+		"items[0][id]":         {subscription.Items.Data[0].ID},
+		"items[0][price]":      {price},
+		"proration_behavior":   {"none"},
+		"metadata[plan]":       {plan},
+		"cancel_at_period_end": {"false"},
+	}
+	return sp.post(ctx, path, form, nil)
+}
+
+func (sp *StripeProvider) ParseWebhook(r *http.Request) (Event, error) {
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		return Event{}, err
+	}
+	if err := sp.verifySignature(payload, r.Header.Get("Stripe-Signature")); err != nil {
+		return Event{}, err
+	}
+	return parseStripeEvent(payload)
+}
+
+// verifySignature checks a Stripe-Signature header, which looks like
+// "t=<unix time>,v1=<hex hmac>", against the payload.
+func (sp *StripeProvider) verifySignature(payload []byte, header string) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	if sp.now().Sub(time.Unix(t, 0)).Abs() > stripeSignatureTolerance {
+		return ErrInvalidSignature
+	}
+
+	expected := stripeSignature(sp.WebhookSecret, timestamp, payload)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func stripeSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type stripeSubscriptionDetails struct {
+	Subscription string            `json:"subscription"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+// Only the fields the app uses. Newer API versions moved an invoice's
+// subscription under parent so both places are read.
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			ID                  string                     `json:"id"`
+			BillingReason       string                     `json:"billing_reason"`
+			Subscription        string                     `json:"subscription"`
+			SubscriptionDetails *stripeSubscriptionDetails `json:"subscription_details"`
+			Parent              struct {
+				SubscriptionDetails *stripeSubscriptionDetails `json:"subscription_details"`
+			} `json:"parent"`
+			Lines struct {
+				Data []struct {
+					Period struct {
+						End int64 `json:"end"`
+					} `json:"period"`
+				} `json:"data"`
+			} `json:"lines"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+// parseStripeEvent maps the Stripe events the app acts on. Paid invoices
+// start and renew subscriptions so plans only change once money has arrived.
+func parseStripeEvent(payload []byte) (Event, error) {
+	var se stripeEvent
+	if err := json.Unmarshal(payload, &se); err != nil {
+		return Event{}, err
+	}
+
+	object := se.Data.Object
+	event := Event{ID: se.ID}
+
+	details := object.SubscriptionDetails
+	if details == nil {
+		details = object.Parent.SubscriptionDetails
+	}
+	subscriptionID := object.Subscription
+	if subscriptionID == "" && details != nil {
+		subscriptionID = details.Subscription
+	}
+
+	switch se.Type {
+	case "invoice.paid":
+		if len(object.Lines.Data) > 0 {
+			event.PeriodEnd = time.Unix(object.Lines.Data[0].Period.End, 0)
+		}
+		event.ProviderSubscriptionID = subscriptionID
+
+		switch object.BillingReason {
+		case "subscription_create":
+			if details == nil {
+				return Event{}, fmt.Errorf("stripe: invoice %s has no subscription metadata", object.ID)
+			}
+			workspaceID, err := strconv.ParseInt(details.Metadata["workspace_id"], 10, 32)
+			if err != nil {
+				return Event{}, fmt.Errorf("stripe: invoice %s has no workspace: %w", object.ID, err)
+			}
+			event.Type = EventSubscriptionCreated
+			event.WorkspaceID = int32(workspaceID)
+			event.Plan = details.Metadata["plan"]
+		case "subscription_cycle":
+			event.Type = EventSubscriptionRenewed
+		}
+	case "invoice.payment_failed":
+		event.Type = EventPaymentFailed
+		event.ProviderSubscriptionID = subscriptionID
+	case "customer.subscription.deleted":
+		event.Type = EventSubscriptionCancelled
+		event.ProviderSubscriptionID = object.ID
+	}
+
+	return event, nil
+}
@@ -0,0 +1,195 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const invoicePaid = `{
+  "id": "evt_1",
+  "type": "invoice.paid",
+  "data": {"object": {
+    "id": "in_1",
+    "billing_reason": "subscription_create",
+    "parent": {"subscription_details": {
+      "subscription": "sub_1",
+      "metadata": {"workspace_id": "42", "plan": "pro1"}
+    }},
+    "lines": {"data": [{"period": {"end": 1767225600}}]}
+  }}
+}`
+
+func signedStripeRequest(secret, payload string, signedAt time.Time) *http.Request {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	r := httptest.NewRequest("POST", "/webhooks/billing", bytes.NewReader([]byte(payload)))
+	r.Header.Set("Stripe-Signature", fmt.Sprintf("t=%s,v1=%s", timestamp, stripeSignature(secret, timestamp, []byte(payload))))
+	return r
+}
+
+func TestStripeParseWebhook(t *testing.T) {
+	now := time.Unix(1767000000, 0)
+	sp := NewStripeProvider("sk_test", "whsec_test", nil)
+	sp.now = func() time.Time { return now }
+
+	event, err := sp.ParseWebhook(signedStripeRequest("whsec_test", invoicePaid, now))
+	if err != nil {
+		t.Fatalf("ParseWebhook() error = %v", err)
+	}
+	want := Event{
+		ID:                     "evt_1",
+		Type:                   EventSubscriptionCreated,
+		WorkspaceID:            42,
+		Plan:                   "pro1",
+		ProviderSubscriptionID: "sub_1",
+		PeriodEnd:              time.Unix(1767225600, 0),
+	}
+	if event != want {
+		t.Errorf("ParseWebhook() = %+v, want %+v", event, want)
+	}
+}
+
+func TestStripeParseWebhookRejectsBadSignatures(t *testing.T) {
+	now := time.Unix(1767000000, 0)
+	sp := NewStripeProvider("sk_test", "whsec_test", nil)
+	sp.now = func() time.Time { return now }
+
+	tampered := signedStripeRequest("whsec_test", invoicePaid, now)
+	tampered.Body = httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"id":"evt_2"}`))).Body
+
+	tests := map[string]*http.Request{
+		"wrong secret": signedStripeRequest("whsec_other", invoicePaid, now),
+		"stale":        signedStripeRequest("whsec_test", invoicePaid, now.Add(-10*time.Minute)),
+		"tampered":     tampered,
+		"unsigned":     httptest.NewRequest("POST", "/webhooks/billing", bytes.NewReader([]byte(invoicePaid))),
+	}
+	for name, r := range tests {
+		if _, err := sp.ParseWebhook(r); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: ParseWebhook() error = %v, want %v", name, err, ErrInvalidSignature)
+		}
+	}
+}
+
+func TestParseStripeEvent(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    Event
+	}{
+		{
+			`{"id":"evt_1","type":"invoice.paid","data":{"object":{"billing_reason":"subscription_cycle","subscription":"sub_1","lines":{"data":[{"period":{"end":1767225600}}]}}}}`,
+			Event{ID: "evt_1", Type: EventSubscriptionRenewed, ProviderSubscriptionID: "sub_1", PeriodEnd: time.Unix(1767225600, 0)},
+		},
+		{
+			`{"id":"evt_2","type":"invoice.payment_failed","data":{"object":{"subscription":"sub_1"}}}`,
+			Event{ID: "evt_2", Type: EventPaymentFailed, ProviderSubscriptionID: "sub_1"},
+		},
+		{
+			`{"id":"evt_3","type":"customer.subscription.deleted","data":{"object":{"id":"sub_1"}}}`,
+			Event{ID: "evt_3", Type: EventSubscriptionCancelled, ProviderSubscriptionID: "sub_1"},
+		},
+		{
+			`{"id":"evt_4","type":"customer.created","data":{"object":{"id":"cus_1"}}}`,
+			Event{ID: "evt_4"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := parseStripeEvent([]byte(tt.payload))
+		if err != nil {
+			t.Errorf("parseStripeEvent(%s) error = %v", tt.payload, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseStripeEvent(%s) = %+v, want %+v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestStripeChangePlan(t *testing.T) {
+	sp := NewStripeProvider("sk_test", "whsec", map[string]string{"pro1": "price_pro1"})
+	var updated url.Values
+	sp.Client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		switch r.Method {
+		case "GET":
+			rec.WriteString(`{"items": {"data": [{"id": "si_1"}]}}`)
+		case "POST":
+			r.ParseForm()
+			updated = r.PostForm
+			rec.WriteString(`{}`)
+		}
+		return rec.Result(), nil
+	})}
+
+	if err := sp.ChangePlan(context.Background(), "sub_1", "pro1"); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Get("items[0][id]") != "si_1" || updated.Get("items[0][price]") != "price_pro1" {
+		t.Errorf("Expected si_1 to be moved onto price_pro1, got %v", updated)
+	}
+	if updated.Get("proration_behavior") != "none" {
+		t.Errorf("Expected the change not to be prorated, got %q", updated.Get("proration_behavior"))
+	}
+
+	if err := sp.ChangePlan(context.Background(), "sub_1", "pro2"); !errors.Is(err, ErrUnknownPlan) {
+		t.Errorf("Expected ErrUnknownPlan for a plan that isn't sold, got %v", err)
+	}
+}
+
+func TestFakeProviderWebhookRoundTrip(t *testing.T) {
+	fp := NewFakeProvider("secret", "pro1")
+	sent := Event{ID: "evt_1", Type: EventSubscriptionCreated, WorkspaceID: 7, Plan: "pro1", ProviderSubscriptionID: "sub_1"}
+
+	got, err := fp.ParseWebhook(fp.WebhookRequest(sent))
+	if err != nil {
+		t.Fatalf("ParseWebhook() error = %v", err)
+	}
+	if !got.PeriodEnd.Equal(sent.PeriodEnd) || got.ID != sent.ID || got.WorkspaceID != sent.WorkspaceID {
+		t.Errorf("ParseWebhook() = %+v, want %+v", got, sent)
+	}
+
+	forged := NewFakeProvider("other").WebhookRequest(sent)
+	if _, err := fp.ParseWebhook(forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("ParseWebhook(forged) error = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	if _, err := fp.CreateCheckoutSession(context.Background(), CheckoutParams{Plan: "basic"}); !errors.Is(err, ErrUnknownPlan) {
+		t.Errorf("CreateCheckoutSession(basic) error = %v, want %v", err, ErrUnknownPlan)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	fp := NewFakeProvider("secret")
+	bh := NewBillingHandlers(&Service{provider: fp})
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"forged", NewFakeProvider("other").WebhookRequest(Event{ID: "evt_1", Type: EventPaymentFailed}), http.StatusBadRequest},
+		{"ignored", fp.WebhookRequest(Event{ID: "evt_2"}), http.StatusOK},
+		{"too large", fp.WebhookRequest(Event{ID: strings.Repeat("x", maxWebhookBytes)}), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		bh.Webhook(w, tt.r)
+		if w.Code != tt.want {
+			t.Errorf("%s: Webhook() status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
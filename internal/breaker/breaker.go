@@ -0,0 +1,71 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned instead of calling a backend that's been failing.
+var ErrOpen = errors.New("circuit breaker open")
+
+// Breaker stops calls to a backend after it fails Threshold times in a row,
+// giving it Cooldown to recover. After that one call is let through to
+// try it: success closes the breaker, failure opens it again.
+type Breaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trying    bool
+	now       func() time.Time
+}
+
+func New(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Do calls fn unless the breaker is open. isFailure decides which of fn's
+// errors count against the backend, nil counts every error.
+func (b *Breaker) Do(fn func() error, isFailure func(error) bool) error {
+	if !b.allow() {
+		return ErrOpen
+	}
+	err := fn()
+	b.record(err != nil && (isFailure == nil || isFailure(err)))
+	return err
+}
+
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.Threshold {
+		return true
+	}
+	// Open, until the cooldown's over and nobody else is trying it
+	if b.now().Before(b.openUntil) || b.trying {
+		return false
+	}
+	b.trying = true
+	return true
+}
+
+func (b *Breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trying = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.Threshold {
+		b.openUntil = b.now().Add(b.Cooldown)
+	}
+}
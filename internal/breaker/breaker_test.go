@@ -0,0 +1,57 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := New(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	down := errors.New("connection refused")
+	notFound := errors.New("not found")
+	isFailure := func(err error) bool { return err != notFound }
+	calls := 0
+	call := func(err error) error {
+		return b.Do(func() error {
+			calls++
+			return err
+		}, isFailure)
+	}
+
+	for range 10 {
+		call(notFound)
+	}
+	for range 3 {
+		call(down)
+	}
+	if calls != 13 {
+		t.Fatalf("Expected 13 calls before opening, got %d", calls)
+	}
+	if err := call(nil); err != ErrOpen {
+		t.Errorf("Expected %v while open, got %v", ErrOpen, err)
+	}
+
+	// One trial after the cooldown, which fails and opens it again
+	now = now.Add(time.Minute)
+	if err := call(down); err != down {
+		t.Errorf("Expected the trial call to go through, got %v", err)
+	}
+	if err := call(nil); err != ErrOpen {
+		t.Errorf("Expected %v after a failed trial, got %v", ErrOpen, err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := call(nil); err != nil {
+		t.Errorf("Expected the trial call to succeed, got %v", err)
+	}
+	if err := call(nil); err != nil {
+		t.Errorf("Expected the breaker to be closed, got %v", err)
+	}
+	if calls != 16 {
+		t.Errorf("Expected 16 calls, got %d", calls)
+	}
+}
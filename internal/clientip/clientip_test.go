@@ -0,0 +1,47 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"direct", "", "203.0.113.7:1234", "", "", "203.0.113.7"},
+		{"untrusted proxy", "", "203.0.113.7:1234", "198.51.100.1", "", "203.0.113.7"},
+		{"private proxy", "", "10.0.0.2:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed first hop", "", "10.0.0.2:1234", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"proxy chain", "", "10.0.0.2:1234", "198.51.100.1, 10.0.0.9", "", "198.51.100.1"},
+		{"real ip", "", "127.0.0.1:1234", "", "198.51.100.1", "198.51.100.1"},
+		{"configured proxy", "203.0.113.0/24", "203.0.113.7:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"private not configured", "203.0.113.7", "10.0.0.2:1234", "198.51.100.1", "", "10.0.0.2"},
+		{"garbage", "", "10.0.0.2:1234", "nonsense", "", "10.0.0.2"},
+	}
+
+	defer SetTrustedProxies("")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetTrustedProxies(tt.trusted); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := FromRequest(r); got != tt.want {
+				t.Errorf("FromRequest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,8 +3,13 @@ package config
 import (
 	_ "embed"
 	"encoding/json"
+	"fmt"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"unicode"
 )
 
 type GlobalAppData struct {
@@ -19,26 +24,218 @@ var AppData = &GlobalAppData{
 
 type CustomSlugConfig struct {
 	ReservedWords []string `json:"reserved_words"`
-	MinLength     int      `json:"min_length"`
-	MaxLength     int      `json:"max_length"`
+	// Slugs can't start with any of these, e.g. api-docs or apikeys for api
+	ReservedPrefixes []string `json:"reserved_prefixes"`
+	// Slugs can't contain any of these, even inside another word, however
+	// they're disguised with leetspeak, repeated letters or separators
+	BlockedWords []string `json:"blocked_words"`
+	// Words that contain a blocked word but are fine, like scunthorpe
+	AllowedWords []string `json:"allowed_words"`
+	// A regular expression every slug has to match
+	AllowedPattern string `json:"allowed_pattern"`
+	MinLength      int    `json:"min_length"`
+	MaxLength      int    `json:"max_length"`
+
+	allowed      *regexp.Regexp
+	blockedWords []string
+	allowedWords []string
+}
+
+// IsReserved reports whether slug is a reserved word, starts with a reserved
+// prefix or clashes with one of the app's routes.
+func (c *CustomSlugConfig) IsReserved(slug string) bool {
+	for _, words := range [][]string{c.ReservedWords, reservedRoutes()} {
+		for _, word := range words {
+			if strings.EqualFold(slug, word) {
+				return true
+			}
+		}
+	}
+	for _, prefix := range c.ReservedPrefixes {
+		if strings.HasPrefix(strings.ToLower(slug), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsCharacters reports whether slug matches AllowedPattern.
+func (c *CustomSlugConfig) AllowsCharacters(slug string) bool {
+	return c.allowed == nil || c.allowed.MatchString(slug)
+}
+
+// ContainsBlockedWord reports whether one of slug's words contains a blocked
+// word, so run together ones like freeporn are caught too. Allowed words are
+// taken out first so shiitake and the like are fine.
+func (c *CustomSlugConfig) ContainsBlockedWord(slug string) bool {
+	for _, segment := range slugSegments(slug) {
+		for _, normalised := range normaliseSlug(segment) {
+			for _, word := range c.allowedWords {
+				normalised = strings.ReplaceAll(normalised, word, "-")
+			}
+			for _, word := range c.blockedWords {
+				if strings.Contains(normalised, word) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Symbols that stand in for letters rather than separate words
+const leetSymbols = "@$!|+"
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(leetSymbols, r)
+}
+
+// slugSegments splits slug into words at separators and camelCase humps.
+// Runs of single characters, as in p-o-r-n, are joined back into a word.
+func slugSegments(slug string) []string {
+	var segments []string
+	var segment []rune
+	var letters strings.Builder
+	flush := func() {
+		switch {
+		case len(segment) == 1:
+			letters.WriteRune(segment[0])
+		case len(segment) > 1:
+			if letters.Len() > 0 {
+				segments = append(segments, letters.String())
+				letters.Reset()
+			}
+			segments = append(segments, string(segment))
+		}
+		segment = segment[:0]
+	}
+
+	var prev rune
+	for _, r := range slug {
+		switch {
+		case isSeparator(r):
+			flush()
+		case len(segment) > 0 && unicode.IsLower(prev) && unicode.IsUpper(r):
+			flush()
+		}
+		if !isSeparator(r) {
+			segment = append(segment, r)
+		}
+		prev = r
+	}
+	flush()
+	if letters.Len() > 0 {
+		segments = append(segments, letters.String())
+	}
+	return segments
+}
+
+// Characters standing in for letters. 1 is tried as both i and l.
+var leetspeak = strings.NewReplacer(
+	"0", "o", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b", "9", "g",
+	"@", "a", "$", "s", "!", "i", "|", "l", "+", "t",
+)
+
+// normaliseSlug undoes the ways a word can be disguised, leaving only
+// lowercase letters with runs of the same one squashed.
+func normaliseSlug(slug string) []string {
+	s := leetspeak.Replace(strings.ToLower(slug))
+	return []string{
+		squashLetters(strings.ReplaceAll(s, "1", "i")),
+		squashLetters(strings.ReplaceAll(s, "1", "l")),
+	}
+}
+
+func squashLetters(s string) string {
+	var b strings.Builder
+	var prev rune
+	for _, r := range s {
+		if r < 'a' || r > 'z' || r == prev {
+			continue
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+	return b.String()
+}
+
+func parseCustomSlugConfig(b []byte) (*CustomSlugConfig, error) {
+	c := &CustomSlugConfig{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if c.AllowedPattern != "" {
+		allowed, err := regexp.Compile(c.AllowedPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed_pattern: %w", err)
+		}
+		c.allowed = allowed
+	}
+	for _, word := range c.BlockedWords {
+		if normalised := normaliseSlug(word)[0]; normalised != "" {
+			c.blockedWords = append(c.blockedWords, normalised)
+		}
+	}
+	for _, word := range c.AllowedWords {
+		if normalised := normaliseSlug(word)[0]; normalised != "" {
+			c.allowedWords = append(c.allowedWords, normalised)
+		}
+	}
+	return c, nil
 }
 
 var (
-	customSlugConfig *CustomSlugConfig
+	customSlugConfig atomic.Pointer[CustomSlugConfig]
 	once             sync.Once
+	routes           struct {
+		sync.RWMutex
+		words []string
+	}
 )
 
 //go:embed custom-paths.json
 var customPathsJSON []byte
 
+// LoadCustomSlugConfig returns the custom slug rules, read from the file at
+// CUSTOM_SLUG_CONFIG or the built in custom-paths.json without it.
 func LoadCustomSlugConfig() (*CustomSlugConfig, error) {
 	var loadErr error
 	once.Do(func() {
-		customSlugConfig = &CustomSlugConfig{}
-		err := json.Unmarshal(customPathsJSON, &customSlugConfig)
-		if err != nil {
-			loadErr = err
-		}
+		loadErr = ReloadCustomSlugConfig()
 	})
-	return customSlugConfig, loadErr
+	if c := customSlugConfig.Load(); c != nil {
+		return c, loadErr
+	}
+	return &CustomSlugConfig{}, loadErr
+}
+
+// ReloadCustomSlugConfig rereads the custom slug rules. The ones in use are
+// kept if they can't be read.
+func ReloadCustomSlugConfig() error {
+	b := customPathsJSON
+	if path := os.Getenv("CUSTOM_SLUG_CONFIG"); path != "" {
+		var err error
+		if b, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	c, err := parseCustomSlugConfig(b)
+	if err != nil {
+		return err
+	}
+	customSlugConfig.Store(c)
+	return nil
+}
+
+// ReserveRoutes stops slugs taking the first part of the app's own paths.
+func ReserveRoutes(words ...string) {
+	routes.Lock()
+	defer routes.Unlock()
+	routes.words = append(routes.words, words...)
+}
+
+func reservedRoutes() []string {
+	routes.RLock()
+	defer routes.RUnlock()
+	return routes.words
 }
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCustomSlugRules(t *testing.T) {
+	c, err := parseCustomSlugConfig(customPathsJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := reservedRoutes()
+	ReserveRoutes("webhooks")
+	t.Cleanup(func() {
+		routes.Lock()
+		routes.words = saved
+		routes.Unlock()
+	})
+
+	tests := []struct {
+		slug                                   string
+		wantReserved, wantAllowed, wantBlocked bool
+	}{
+		{slug: "summer-sale", wantAllowed: true},
+		{slug: "APP", wantReserved: true, wantAllowed: true},
+		{slug: "Webhooks", wantReserved: true, wantAllowed: true},
+		{slug: "api-docs", wantReserved: true, wantAllowed: true},
+		{slug: "apiary", wantReserved: true, wantAllowed: true},
+		{slug: "adminpanel", wantReserved: true, wantAllowed: true},
+		{slug: "apikeys", wantReserved: true, wantAllowed: true},
+		{slug: "rapid", wantAllowed: true},
+		{slug: "has space"},
+		{slug: "a/b"},
+		{slug: "café"},
+		{slug: "-leading"},
+		{slug: "5h1t-sale", wantAllowed: true, wantBlocked: true},
+		{slug: "SHIIIT", wantAllowed: true, wantBlocked: true},
+		{slug: "b1tch", wantAllowed: true, wantBlocked: true},
+		{slug: "p_o_r_n", wantAllowed: true, wantBlocked: true},
+		{slug: "ShitList", wantAllowed: true, wantBlocked: true},
+		{slug: "shiitake", wantAllowed: true},
+		{slug: "scunthorpe", wantAllowed: true},
+		{slug: "a-b-shit", wantAllowed: true, wantBlocked: true},
+		{slug: "freeporn", wantAllowed: true, wantBlocked: true},
+		{slug: "fuckyou", wantAllowed: true, wantBlocked: true},
+		{slug: "shithead", wantAllowed: true, wantBlocked: true},
+		{slug: "pornhub", wantAllowed: true, wantBlocked: true},
+		{slug: "shiitake-shit", wantAllowed: true, wantBlocked: true},
+		{slug: "push-it", wantAllowed: true},
+	}
+	for _, tt := range tests {
+		if got := c.IsReserved(tt.slug); got != tt.wantReserved {
+			t.Errorf("IsReserved(%q) = %v, want %v", tt.slug, got, tt.wantReserved)
+		}
+		if got := c.AllowsCharacters(tt.slug); got != tt.wantAllowed {
+			t.Errorf("AllowsCharacters(%q) = %v, want %v", tt.slug, got, tt.wantAllowed)
+		}
+		if got := c.ContainsBlockedWord(tt.slug); got != tt.wantBlocked {
+			t.Errorf("ContainsBlockedWord(%q) = %v, want %v", tt.slug, got, tt.wantBlocked)
+		}
+	}
+}
+
+func TestReloadCustomSlugConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slugs.json")
+	t.Setenv("CUSTOM_SLUG_CONFIG", path)
+
+	os.WriteFile(path, []byte(`{"min_length": 3, "max_length": 10, "reserved_words": ["promo"]}`), 0o644)
+	if err := ReloadCustomSlugConfig(); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := LoadCustomSlugConfig()
+	if c.MinLength != 3 || !c.IsReserved("promo") {
+		t.Errorf("Expected the config from %s, got %+v", path, c)
+	}
+
+	os.WriteFile(path, []byte(`{"allowed_pattern": "["}`), 0o644)
+	if err := ReloadCustomSlugConfig(); err == nil {
+		t.Error("Expected an error for an invalid pattern, got nil")
+	}
+	if c, _ := LoadCustomSlugConfig(); c.MinLength != 3 {
+		t.Errorf("Expected the previous config to be kept, got %+v", c)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	c, err := parseRateLimitConfig(rateLimitsJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"redirect", "signin", "create_link"} {
+		if c[name].Requests == 0 || c[name].Per() == 0 {
+			t.Errorf("Expected a %s rate limit", name)
+		}
+	}
+	createLink := c["create_link"]
+	if createLink.For("pro2") != 120 || createLink.For("basic") != createLink.Requests {
+		t.Errorf("Expected per plan limits, got %v", createLink.Plans)
+	}
+
+	if _, err := parseRateLimitConfig([]byte(`{"api": {"requests": 1, "window": "soon"}}`)); err == nil {
+		t.Error("Expected an invalid window to be rejected")
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// RateLimit is how many requests a client can make in a sliding window.
+type RateLimit struct {
+	Requests int    `json:"requests"`
+	Window   string `json:"window"`
+	// Requests allowed on each plan, Requests on any other
+	Plans map[string]int `json:"plans"`
+
+	window time.Duration
+}
+
+// For is the number of requests allowed on plan, which is empty when the
+// client's plan isn't known.
+func (l RateLimit) For(plan string) int {
+	if n, ok := l.Plans[plan]; ok {
+		return n
+	}
+	return l.Requests
+}
+
+func (l RateLimit) Per() time.Duration {
+	return l.window
+}
+
+// RateLimitConfig holds the rate limits by the name routes use them under.
+type RateLimitConfig map[string]RateLimit
+
+func parseRateLimitConfig(b []byte) (RateLimitConfig, error) {
+	c := RateLimitConfig{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	for name, limit := range c {
+		window, err := time.ParseDuration(limit.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid window for %s rate limit: %q", name, limit.Window)
+		}
+		limit.window = window
+		c[name] = limit
+	}
+	return c, nil
+}
+
+//go:embed rate-limits.json
+var rateLimitsJSON []byte
+
+// LoadRateLimitConfig returns the rate limits, read from the file at
+// RATE_LIMIT_CONFIG or the built in rate-limits.json without it.
+func LoadRateLimitConfig() (RateLimitConfig, error) {
+	b := rateLimitsJSON
+	if path := os.Getenv("RATE_LIMIT_CONFIG"); path != "" {
+		var err error
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return parseRateLimitConfig(b)
+}
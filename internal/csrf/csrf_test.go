@@ -0,0 +1,66 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestMiddleware(t *testing.T) {
+	store := sessions.NewCookieStore([]byte("test-secret"))
+
+	var issued string
+	handler := Middleware(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			issued = Token(r)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Fetch a page to get a session cookie holding a token
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/app/links/new", nil))
+	if issued == "" {
+		t.Fatal("expected a token to be issued")
+	}
+	cookies := w.Result().Cookies()
+
+	post := func(form url.Values, header http.Header) *http.Request {
+		r := httptest.NewRequest("POST", "/app/links/new", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range header {
+			r.Header.Set(k, v[0])
+		}
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"form token", post(url.Values{FieldName: {issued}}, nil), http.StatusOK},
+		{"header token", post(nil, http.Header{HeaderName: {issued}}), http.StatusOK},
+		{"missing token", post(nil, nil), http.StatusForbidden},
+		{"wrong token", post(url.Values{FieldName: {"nope"}}, nil), http.StatusForbidden},
+		{"no session", httptest.NewRequest("POST", "/app/signout", nil), http.StatusForbidden},
+		{"token authenticated", post(nil, http.Header{"Authorization": {"Bearer abc"}}), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, tt.r)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -10,7 +10,8 @@ import (
 
 type Analytic struct {
 	ID            int32
-	ShortCode     string
+	LinkID        int32
+	LinkVersionID pgtype.Int4
 	GeoData       []byte
 	UserAgentData []byte
 	ReferrerUrl   pgtype.Text
@@ -19,40 +20,101 @@ type Analytic struct {
 	UpdatedAt     pgtype.Timestamp
 }
 
+type AuditLog struct {
+	ID          int64
+	WorkspaceID pgtype.Int4
+	ActorUserID pgtype.Int4
+	Action      string
+	TargetType  string
+	TargetID    string
+	Before      []byte
+	After       []byte
+	IpAddress   pgtype.Text
+	UserAgent   pgtype.Text
+	CreatedAt   pgtype.Timestamp
+}
+
+type BillingEvent struct {
+	ID          string
+	Provider    string
+	Type        string
+	ProcessedAt pgtype.Timestamp
+}
+
+type Domain struct {
+	ID                int32
+	WorkspaceID       int32
+	Hostname          string
+	VerificationToken string
+	VerifiedAt        pgtype.Timestamp
+	CreatedAt         pgtype.Timestamp
+	UpdatedAt         pgtype.Timestamp
+}
+
 type Link struct {
 	ID             int32
+	WorkspaceID    int32
 	UserID         int32
+	DomainID       pgtype.Int4
 	ShortCode      string
 	DestinationUrl string
 	Title          pgtype.Text
 	Notes          pgtype.Text
+	RedirectStatus int32
+	DisabledAt     pgtype.Timestamp
 	CreatedAt      pgtype.Timestamp
 	UpdatedAt      pgtype.Timestamp
 }
 
+type LinkVersion struct {
+	ID             int32
+	LinkID         int32
+	Version        int32
+	DestinationUrl string
+	Title          pgtype.Text
+	Notes          pgtype.Text
+	RedirectStatus int32
+	CreatedBy      pgtype.Int4
+	CreatedAt      pgtype.Timestamp
+}
+
+type PlanEntitlement struct {
+	SubscriptionID int32
+	Key            string
+	Value          int32
+}
+
 type Subscription struct {
-	ID                  int32
-	Name                string
-	MaxLinksPerMonth    int32
-	CanCustomiseSlug    bool
-	CanCreateDuplicates bool
-	CanViewAnalytics    bool
-	CreatedAt           pgtype.Timestamp
-	UpdatedAt           pgtype.Timestamp
+	ID               int32
+	Name             string
+	MaxLinksPerMonth int32
+	CreatedAt        pgtype.Timestamp
+	UpdatedAt        pgtype.Timestamp
 }
 
 type User struct {
 	ID            int32
 	Name          pgtype.Text
 	Email         string
-	OauthProvider pgtype.Text
+	EmailVerified bool
+	Role          string
+	DisabledAt    pgtype.Timestamp
 	CreatedAt     pgtype.Timestamp
 	UpdatedAt     pgtype.Timestamp
 }
 
-type UserMonthlyUsage struct {
+type UserIdentity struct {
 	ID             int32
 	UserID         int32
+	Provider       string
+	ProviderUserID string
+	Email          pgtype.Text
+	CreatedAt      pgtype.Timestamp
+}
+
+type UserMonthlyUsage struct {
+	ID             int32
+	WorkspaceID    int32
 	LinksCreated   int32
 	CycleStartDate pgtype.Date
 	CycleEndDate   pgtype.Date
@@ -61,10 +123,41 @@ type UserMonthlyUsage struct {
 }
 
 type UserSubscription struct {
-	UserID         int32
-	SubscriptionID int32
-	Status         string
-	StartDate      pgtype.Timestamp
-	EndDate        pgtype.Timestamp
-	CreatedAt      pgtype.Timestamp
+	ID                     int32
+	WorkspaceID            int32
+	SubscriptionID         int32
+	Status                 string
+	StartDate              pgtype.Timestamp
+	EndDate                pgtype.Timestamp
+	PendingSubscriptionID  pgtype.Int4
+	ProviderSubscriptionID pgtype.Text
+	PaymentFailedAt        pgtype.Timestamp
+	CreatedAt              pgtype.Timestamp
+}
+
+type Workspace struct {
+	ID        int32
+	Name      string
+	CreatedAt pgtype.Timestamp
+	UpdatedAt pgtype.Timestamp
+}
+
+type WorkspaceInvitation struct {
+	ID          int32
+	WorkspaceID int32
+	Email       string
+	Role        string
+	TokenHash   string
+	InvitedBy   pgtype.Int4
+	ExpiresAt   pgtype.Timestamp
+	AcceptedAt  pgtype.Timestamp
+	CreatedAt   pgtype.Timestamp
+}
+
+type WorkspaceMember struct {
+	WorkspaceID int32
+	UserID      int32
+	Role        string
+	CreatedAt   pgtype.Timestamp
+	UpdatedAt   pgtype.Timestamp
 }
@@ -11,85 +11,281 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const acceptWorkspaceInvitation = `-- name: AcceptWorkspaceInvitation :exec
+WITH invitation AS (
+  UPDATE workspace_invitations
+  SET accepted_at = CURRENT_TIMESTAMP
+  WHERE id = $2
+  RETURNING workspace_id, role
+)
+INSERT INTO workspace_members (workspace_id, user_id, role)
+SELECT workspace_id, $1, role
+FROM invitation
+ON CONFLICT (workspace_id, user_id) DO NOTHING
+`
+
+type AcceptWorkspaceInvitationParams struct {
+	UserID       int32
+	InvitationID int32
+}
+
+func (q *Queries) AcceptWorkspaceInvitation(ctx context.Context, arg AcceptWorkspaceInvitationParams) error {
+	_, err := q.db.Exec(ctx, acceptWorkspaceInvitation, arg.UserID, arg.InvitationID)
+	return err
+}
+
 const addBasicSubscription = `-- name: AddBasicSubscription :one
 WITH user_sub AS (
-  INSERT INTO user_subscriptions (user_id, subscription_id, end_date)
+  INSERT INTO user_subscriptions (workspace_id, subscription_id, end_date)
   VALUES ($1, (SELECT id FROM subscriptions WHERE name = 'basic'), 'infinity')
   RETURNING status, subscription_id
 ),
 user_usage AS (
-  INSERT INTO user_monthly_usage (user_id, cycle_start_date, cycle_end_date)
+  INSERT INTO user_monthly_usage (workspace_id, cycle_start_date, cycle_end_date)
   VALUES (
     $1, CURRENT_DATE, CURRENT_DATE + INTERVAL '1 month'
   )
 )
-SELECT us.status, s.name, s.max_links_per_month, s.can_customise_slug, s.can_create_duplicates, s.can_view_analytics
+SELECT us.status, s.name, s.max_links_per_month, (
+    SELECT COALESCE(jsonb_object_agg(e.key, e.value), '{}')
+    FROM plan_entitlements e
+    WHERE e.subscription_id = s.id
+  )::jsonb AS entitlements
 FROM user_sub us
 JOIN subscriptions s
 ON us.subscription_id = s.id
 `
 
 type AddBasicSubscriptionRow struct {
-	Status              string
-	Name                string
-	MaxLinksPerMonth    int32
-	CanCustomiseSlug    bool
-	CanCreateDuplicates bool
-	CanViewAnalytics    bool
+	Status           string
+	Name             string
+	MaxLinksPerMonth int32
+	Entitlements     []byte
 }
 
-func (q *Queries) AddBasicSubscription(ctx context.Context, userID int32) (AddBasicSubscriptionRow, error) {
-	row := q.db.QueryRow(ctx, addBasicSubscription, userID)
+func (q *Queries) AddBasicSubscription(ctx context.Context, workspaceID int32) (AddBasicSubscriptionRow, error) {
+	row := q.db.QueryRow(ctx, addBasicSubscription, workspaceID)
 	var i AddBasicSubscriptionRow
 	err := row.Scan(
 		&i.Status,
 		&i.Name,
 		&i.MaxLinksPerMonth,
-		&i.CanCustomiseSlug,
-		&i.CanCreateDuplicates,
-		&i.CanViewAnalytics,
+		&i.Entitlements,
+	)
+	return i, err
+}
+
+const changeWorkspaceSubscription = `-- name: ChangeWorkspaceSubscription :execrows
+WITH expired AS (
+  UPDATE user_subscriptions
+  SET status = 'expired',
+      end_date = LEAST(user_subscriptions.end_date, CURRENT_TIMESTAMP)
+  WHERE user_subscriptions.workspace_id = $2
+    AND user_subscriptions.status = 'active'
+  RETURNING user_subscriptions.workspace_id
+)
+INSERT INTO user_subscriptions (workspace_id, subscription_id, start_date, end_date)
+SELECT e.workspace_id, s.id, CURRENT_TIMESTAMP,
+  CASE WHEN s.name = 'basic' THEN 'infinity'::timestamp ELSE CURRENT_TIMESTAMP + INTERVAL '1 month' END
+FROM expired e, subscriptions s
+WHERE s.id = $1
+`
+
+type ChangeWorkspaceSubscriptionParams struct {
+	SubscriptionID int32
+	WorkspaceID    int32
+}
+
+// Expires the active subscription and starts a new period on another plan
+// straight away. Nothing is prorated, paid periods last a month from now.
+func (q *Queries) ChangeWorkspaceSubscription(ctx context.Context, arg ChangeWorkspaceSubscriptionParams) (int64, error) {
+	result, err := q.db.Exec(ctx, changeWorkspaceSubscription, arg.SubscriptionID, arg.WorkspaceID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const consumeLinkQuota = `-- name: ConsumeLinkQuota :one
+UPDATE user_monthly_usage
+SET links_created = user_monthly_usage.links_created + 1,
+    updated_at = CURRENT_TIMESTAMP
+FROM user_subscriptions us
+JOIN subscriptions s
+ON us.subscription_id = s.id
+WHERE user_monthly_usage.workspace_id = $1
+  AND user_monthly_usage.cycle_start_date <= CURRENT_DATE
+  AND user_monthly_usage.cycle_end_date > CURRENT_DATE
+  AND us.workspace_id = user_monthly_usage.workspace_id
+  AND us.status = 'active'
+  AND user_monthly_usage.links_created < s.max_links_per_month
+RETURNING user_monthly_usage.links_created, user_monthly_usage.cycle_end_date
+`
+
+type ConsumeLinkQuotaRow struct {
+	LinksCreated int32
+	CycleEndDate pgtype.Date
+}
+
+// Counts one more link against the workspace's current cycle, returning the
+// new count and when the cycle ends, or no rows if the plan's limit has been
+// reached. The row lock makes concurrent calls take turns so the limit can't
+// be overshot. Call it after EnsureCurrentUsageCycle in the same transaction
+// as CreateLink.
+func (q *Queries) ConsumeLinkQuota(ctx context.Context, workspaceID int32) (ConsumeLinkQuotaRow, error) {
+	row := q.db.QueryRow(ctx, consumeLinkQuota, workspaceID)
+	var i ConsumeLinkQuotaRow
+	err := row.Scan(&i.LinksCreated, &i.CycleEndDate)
+	return i, err
+}
+
+const countDomainsForWorkspace = `-- name: CountDomainsForWorkspace :one
+SELECT COUNT(*)
+FROM domains
+WHERE workspace_id = $1
+`
+
+func (q *Queries) CountDomainsForWorkspace(ctx context.Context, workspaceID int32) (int64, error) {
+	row := q.db.QueryRow(ctx, countDomainsForWorkspace, workspaceID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countWorkspaceOwners = `-- name: CountWorkspaceOwners :one
+SELECT COUNT(*)
+FROM workspace_members
+WHERE workspace_id = $1
+  AND role = 'owner'
+`
+
+func (q *Queries) CountWorkspaceOwners(ctx context.Context, workspaceID int32) (int64, error) {
+	row := q.db.QueryRow(ctx, countWorkspaceOwners, workspaceID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const createAuditLogEntry = `-- name: CreateAuditLogEntry :exec
+INSERT INTO audit_log (workspace_id, actor_user_id, action, target_type, target_id, before, after, ip_address, user_agent)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+`
+
+type CreateAuditLogEntryParams struct {
+	WorkspaceID pgtype.Int4
+	ActorUserID pgtype.Int4
+	Action      string
+	TargetType  string
+	TargetID    string
+	Before      []byte
+	After       []byte
+	IpAddress   pgtype.Text
+	UserAgent   pgtype.Text
+}
+
+func (q *Queries) CreateAuditLogEntry(ctx context.Context, arg CreateAuditLogEntryParams) error {
+	_, err := q.db.Exec(ctx, createAuditLogEntry,
+		arg.WorkspaceID,
+		arg.ActorUserID,
+		arg.Action,
+		arg.TargetType,
+		arg.TargetID,
+		arg.Before,
+		arg.After,
+		arg.IpAddress,
+		arg.UserAgent,
+	)
+	return err
+}
+
+const createDomain = `-- name: CreateDomain :one
+INSERT INTO domains (workspace_id, hostname, verification_token)
+VALUES ($1, $2, $3)
+RETURNING id, workspace_id, hostname, verification_token, verified_at, created_at, updated_at
+`
+
+type CreateDomainParams struct {
+	WorkspaceID       int32
+	Hostname          string
+	VerificationToken string
+}
+
+func (q *Queries) CreateDomain(ctx context.Context, arg CreateDomainParams) (Domain, error) {
+	row := q.db.QueryRow(ctx, createDomain, arg.WorkspaceID, arg.Hostname, arg.VerificationToken)
+	var i Domain
+	err := row.Scan(
+		&i.ID,
+		&i.WorkspaceID,
+		&i.Hostname,
+		&i.VerificationToken,
+		&i.VerifiedAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
 	)
 	return i, err
 }
 
 const createLink = `-- name: CreateLink :one
-WITH updated_usage AS (
-  UPDATE user_monthly_usage
-  SET links_created = links_created + 1,
-      updated_at = CURRENT_TIMESTAMP
-  WHERE user_id = $1
-    AND cycle_start_date <= CURRENT_DATE
-    AND cycle_end_date > CURRENT_DATE
+WITH new_link AS (
+  INSERT INTO links (workspace_id, user_id, domain_id, short_code, destination_url, title, notes)
+  VALUES ($1, $2, $3, $4, $5, $6, $7)
+  RETURNING id, workspace_id, user_id, domain_id, short_code, destination_url, title, notes, redirect_status, disabled_at, created_at, updated_at
+),
+first_version AS (
+  INSERT INTO link_versions (link_id, version, destination_url, title, notes, redirect_status, created_by)
+  SELECT id, 1, destination_url, title, notes, redirect_status, user_id
+  FROM new_link
 )
-INSERT INTO links (user_id, short_code, destination_url, title, notes)
-VALUES ($1, $2, $3, $4, $5)
-RETURNING id, user_id, short_code, destination_url, title, notes, created_at, updated_at
+SELECT id, workspace_id, user_id, domain_id, short_code, destination_url, title, notes, redirect_status, disabled_at, created_at, updated_at FROM new_link
 `
 
 type CreateLinkParams struct {
+	WorkspaceID    int32
+	UserID         int32
+	DomainID       pgtype.Int4
+	ShortCode      string
+	DestinationUrl string
+	Title          pgtype.Text
+	Notes          pgtype.Text
+}
+
+type CreateLinkRow struct {
+	ID             int32
+	WorkspaceID    int32
 	UserID         int32
+	DomainID       pgtype.Int4
 	ShortCode      string
 	DestinationUrl string
 	Title          pgtype.Text
 	Notes          pgtype.Text
+	RedirectStatus int32
+	DisabledAt     pgtype.Timestamp
+	CreatedAt      pgtype.Timestamp
+	UpdatedAt      pgtype.Timestamp
 }
 
-func (q *Queries) CreateLink(ctx context.Context, arg CreateLinkParams) (Link, error) {
+func (q *Queries) CreateLink(ctx context.Context, arg CreateLinkParams) (CreateLinkRow, error) {
 	row := q.db.QueryRow(ctx, createLink,
+		arg.WorkspaceID,
 		arg.UserID,
+		arg.DomainID,
 		arg.ShortCode,
 		arg.DestinationUrl,
 		arg.Title,
 		arg.Notes,
 	)
-	var i Link
+	var i CreateLinkRow
 	err := row.Scan(
 		&i.ID,
+		&i.WorkspaceID,
 		&i.UserID,
+		&i.DomainID,
 		&i.ShortCode,
 		&i.DestinationUrl,
 		&i.Title,
 		&i.Notes,
+		&i.RedirectStatus,
+		&i.DisabledAt,
 		&i.CreatedAt,
 		&i.UpdatedAt,
 	)
@@ -97,289 +293,1599 @@ func (q *Queries) CreateLink(ctx context.Context, arg CreateLinkParams) (Link, e
 }
 
 const createUser = `-- name: CreateUser :one
-INSERT INTO users (name, email, oauth_provider)
+INSERT INTO users (name, email, email_verified)
 VALUES ($1, $2, $3)
-RETURNING id, name, email
+RETURNING id, name, email, role, disabled_at
 `
 
 type CreateUserParams struct {
 	Name          pgtype.Text
 	Email         string
-	OauthProvider pgtype.Text
+	EmailVerified bool
 }
 
 type CreateUserRow struct {
-	ID    int32
-	Name  pgtype.Text
-	Email string
+	ID         int32
+	Name       pgtype.Text
+	Email      string
+	Role       string
+	DisabledAt pgtype.Timestamp
 }
 
 func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (CreateUserRow, error) {
-	row := q.db.QueryRow(ctx, createUser, arg.Name, arg.Email, arg.OauthProvider)
+	row := q.db.QueryRow(ctx, createUser, arg.Name, arg.Email, arg.EmailVerified)
 	var i CreateUserRow
-	err := row.Scan(&i.ID, &i.Name, &i.Email)
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Email,
+		&i.Role,
+		&i.DisabledAt,
+	)
+	return i, err
+}
+
+const createUserIdentity = `-- name: CreateUserIdentity :one
+INSERT INTO user_identities (user_id, provider, provider_user_id, email)
+VALUES ($1, $2, $3, $4)
+RETURNING id, user_id, provider, provider_user_id, email, created_at
+`
+
+type CreateUserIdentityParams struct {
+	UserID         int32
+	Provider       string
+	ProviderUserID string
+	Email          pgtype.Text
+}
+
+func (q *Queries) CreateUserIdentity(ctx context.Context, arg CreateUserIdentityParams) (UserIdentity, error) {
+	row := q.db.QueryRow(ctx, createUserIdentity,
+		arg.UserID,
+		arg.Provider,
+		arg.ProviderUserID,
+		arg.Email,
+	)
+	var i UserIdentity
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Provider,
+		&i.ProviderUserID,
+		&i.Email,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createWorkspace = `-- name: CreateWorkspace :one
+WITH workspace AS (
+  INSERT INTO workspaces (name)
+  VALUES ($1)
+  RETURNING id
+),
+owner AS (
+  INSERT INTO workspace_members (workspace_id, user_id, role)
+  SELECT id, $2, 'owner'
+  FROM workspace
+)
+SELECT id FROM workspace
+`
+
+type CreateWorkspaceParams struct {
+	Name   string
+	UserID int32
+}
+
+func (q *Queries) CreateWorkspace(ctx context.Context, arg CreateWorkspaceParams) (int32, error) {
+	row := q.db.QueryRow(ctx, createWorkspace, arg.Name, arg.UserID)
+	var id int32
+	err := row.Scan(&id)
+	return id, err
+}
+
+const createWorkspaceInvitation = `-- name: CreateWorkspaceInvitation :one
+INSERT INTO workspace_invitations (workspace_id, email, role, token_hash, invited_by, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, workspace_id, email, role, token_hash, invited_by, expires_at, accepted_at, created_at
+`
+
+type CreateWorkspaceInvitationParams struct {
+	WorkspaceID int32
+	Email       string
+	Role        string
+	TokenHash   string
+	InvitedBy   pgtype.Int4
+	ExpiresAt   pgtype.Timestamp
+}
+
+func (q *Queries) CreateWorkspaceInvitation(ctx context.Context, arg CreateWorkspaceInvitationParams) (WorkspaceInvitation, error) {
+	row := q.db.QueryRow(ctx, createWorkspaceInvitation,
+		arg.WorkspaceID,
+		arg.Email,
+		arg.Role,
+		arg.TokenHash,
+		arg.InvitedBy,
+		arg.ExpiresAt,
+	)
+	var i WorkspaceInvitation
+	err := row.Scan(
+		&i.ID,
+		&i.WorkspaceID,
+		&i.Email,
+		&i.Role,
+		&i.TokenHash,
+		&i.InvitedBy,
+		&i.ExpiresAt,
+		&i.AcceptedAt,
+		&i.CreatedAt,
+	)
 	return i, err
 }
 
+const deleteDomainForWorkspace = `-- name: DeleteDomainForWorkspace :exec
+DELETE FROM domains
+WHERE id = $1
+  AND workspace_id = $2
+`
+
+type DeleteDomainForWorkspaceParams struct {
+	ID          int32
+	WorkspaceID int32
+}
+
+func (q *Queries) DeleteDomainForWorkspace(ctx context.Context, arg DeleteDomainForWorkspaceParams) error {
+	_, err := q.db.Exec(ctx, deleteDomainForWorkspace, arg.ID, arg.WorkspaceID)
+	return err
+}
+
+const deleteLinkForWorkspace = `-- name: DeleteLinkForWorkspace :exec
+DELETE FROM links
+WHERE id = $1
+  AND workspace_id = $2
+`
+
+type DeleteLinkForWorkspaceParams struct {
+	ID          int32
+	WorkspaceID int32
+}
+
+func (q *Queries) DeleteLinkForWorkspace(ctx context.Context, arg DeleteLinkForWorkspaceParams) error {
+	_, err := q.db.Exec(ctx, deleteLinkForWorkspace, arg.ID, arg.WorkspaceID)
+	return err
+}
+
+const deleteUserIdentity = `-- name: DeleteUserIdentity :execrows
+DELETE FROM user_identities
+WHERE user_identities.id = $1
+  AND user_identities.user_id = $2
+  AND (SELECT COUNT(*) FROM user_identities i WHERE i.user_id = $2) > 1
+`
+
+type DeleteUserIdentityParams struct {
+	ID     int32
+	UserID int32
+}
+
+// Users can't remove their last way of signing in
+func (q *Queries) DeleteUserIdentity(ctx context.Context, arg DeleteUserIdentityParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteUserIdentity, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteWorkspaceInvitation = `-- name: DeleteWorkspaceInvitation :exec
+DELETE FROM workspace_invitations
+WHERE id = $1
+  AND workspace_id = $2
+`
+
+type DeleteWorkspaceInvitationParams struct {
+	ID          int32
+	WorkspaceID int32
+}
+
+func (q *Queries) DeleteWorkspaceInvitation(ctx context.Context, arg DeleteWorkspaceInvitationParams) error {
+	_, err := q.db.Exec(ctx, deleteWorkspaceInvitation, arg.ID, arg.WorkspaceID)
+	return err
+}
+
+const endProviderSubscription = `-- name: EndProviderSubscription :one
+WITH expired AS (
+  UPDATE user_subscriptions
+  SET status = 'expired',
+      end_date = LEAST(user_subscriptions.end_date, CURRENT_TIMESTAMP)
+  WHERE user_subscriptions.provider_subscription_id = $1
+    AND user_subscriptions.status = 'active'
+  RETURNING user_subscriptions.workspace_id
+)
+INSERT INTO user_subscriptions (workspace_id, subscription_id, start_date, end_date)
+SELECT e.workspace_id, s.id, CURRENT_TIMESTAMP, 'infinity'::timestamp
+FROM expired e
+JOIN subscriptions s
+ON s.name = 'basic'
+RETURNING workspace_id
+`
+
+// Moves a workspace whose paid subscription was cancelled onto basic. A
+// pending paid plan would have been applied when the subscription renewed,
+// ending means it was never paid for.
+func (q *Queries) EndProviderSubscription(ctx context.Context, providerSubscriptionID pgtype.Text) (int32, error) {
+	row := q.db.QueryRow(ctx, endProviderSubscription, providerSubscriptionID)
+	var workspace_id int32
+	err := row.Scan(&workspace_id)
+	return workspace_id, err
+}
+
+const ensureCurrentUsageCycle = `-- name: EnsureCurrentUsageCycle :exec
+WITH existing AS (
+  SELECT COALESCE(user_monthly_usage.created_at::date, user_monthly_usage.cycle_start_date) AS anniversary
+  FROM user_monthly_usage
+  WHERE user_monthly_usage.workspace_id = $1
+),
+elapsed AS (
+  SELECT a.anniversary,
+    (EXTRACT(YEAR FROM age(CURRENT_DATE, a.anniversary)) * 12 + EXTRACT(MONTH FROM age(CURRENT_DATE, a.anniversary)))::int AS months
+  FROM (SELECT COALESCE((SELECT anniversary FROM existing), CURRENT_DATE) AS anniversary) a
+),
+cycle AS (
+  SELECT elapsed.anniversary,
+    CASE WHEN elapsed.anniversary + (elapsed.months + 1) * INTERVAL '1 month' <= CURRENT_DATE
+      THEN elapsed.months + 1
+      ELSE elapsed.months
+    END AS months
+  FROM elapsed
+)
+INSERT INTO user_monthly_usage (workspace_id, cycle_start_date, cycle_end_date)
+SELECT $1,
+  cycle.anniversary + cycle.months * INTERVAL '1 month',
+  cycle.anniversary + (cycle.months + 1) * INTERVAL '1 month'
+FROM cycle
+ON CONFLICT (workspace_id) DO UPDATE
+SET links_created = 0,
+    cycle_start_date = EXCLUDED.cycle_start_date,
+    cycle_end_date = EXCLUDED.cycle_end_date,
+    updated_at = CURRENT_TIMESTAMP
+WHERE user_monthly_usage.cycle_end_date <= CURRENT_DATE
+`
+
+// Rolls the workspace's usage over to the cycle covering today, or starts
+// its first one, the same way RollUsageCycles does. Creating links mustn't
+// wait on the job to reset a cycle that's ended. Whichever concurrent call
+// conflicts second finds the cycle already current and leaves it.
+func (q *Queries) EnsureCurrentUsageCycle(ctx context.Context, workspaceID int32) error {
+	_, err := q.db.Exec(ctx, ensureCurrentUsageCycle, workspaceID)
+	return err
+}
+
+const expireDueSubscription = `-- name: ExpireDueSubscription :execrows
+WITH expired AS (
+  UPDATE user_subscriptions
+  SET status = 'expired'
+  WHERE user_subscriptions.workspace_id = $1
+    AND user_subscriptions.status = 'active'
+    AND user_subscriptions.end_date <= CURRENT_TIMESTAMP
+    AND (user_subscriptions.provider_subscription_id IS NULL OR user_subscriptions.end_date <= CURRENT_TIMESTAMP - INTERVAL '3 days')
+  RETURNING user_subscriptions.workspace_id
+)
+INSERT INTO user_subscriptions (workspace_id, subscription_id, start_date, end_date)
+SELECT e.workspace_id, s.id, CURRENT_TIMESTAMP, 'infinity'::timestamp
+FROM expired e
+JOIN subscriptions s
+ON s.name = 'basic'
+`
+
+// Moves a workspace whose period has ended onto basic, the one plan that
+// needs no payment. Paid plans, pending ones included, only start when the
+// provider reports payment. Does nothing if another run got there first.
+func (q *Queries) ExpireDueSubscription(ctx context.Context, workspaceID int32) (int64, error) {
+	result, err := q.db.Exec(ctx, expireDueSubscription, workspaceID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const findDuplicatesForUrl = `-- name: FindDuplicatesForUrl :one
 WITH limited_links AS (
-  SELECT short_code
-  FROM links
-  WHERE user_id = $1
-    AND destination_url = $2
-  ORDER BY created_at DESC
+  SELECT l.short_code, COALESCE(d.hostname, '') AS hostname
+  FROM links l
+  LEFT JOIN domains d
+  ON l.domain_id = d.id
+  WHERE l.workspace_id = $1
+    AND l.destination_url = $2
+  ORDER BY l.created_at DESC
   LIMIT $3
 )
 SELECT
   ARRAY_AGG(short_code)::text[] AS short_codes,
+  ARRAY_AGG(hostname)::text[] AS hostnames,
   GREATEST((SELECT COUNT(*)
               FROM links  As l
-              WHERE l.user_id = $1
+              WHERE l.workspace_id = $1
                 AND l.destination_url = $2) - $3, 0)::int AS remaining_count
 FROM limited_links
 `
 
 type FindDuplicatesForUrlParams struct {
-	UserID         int32
+	WorkspaceID    int32
 	DestinationUrl string
 	Limit          int32
 }
 
 type FindDuplicatesForUrlRow struct {
 	ShortCodes     []string
+	Hostnames      []string
 	RemainingCount int32
 }
 
 func (q *Queries) FindDuplicatesForUrl(ctx context.Context, arg FindDuplicatesForUrlParams) (FindDuplicatesForUrlRow, error) {
-	row := q.db.QueryRow(ctx, findDuplicatesForUrl, arg.UserID, arg.DestinationUrl, arg.Limit)
+	row := q.db.QueryRow(ctx, findDuplicatesForUrl, arg.WorkspaceID, arg.DestinationUrl, arg.Limit)
 	var i FindDuplicatesForUrlRow
-	err := row.Scan(&i.ShortCodes, &i.RemainingCount)
+	err := row.Scan(&i.ShortCodes, &i.Hostnames, &i.RemainingCount)
 	return i, err
 }
 
-const getDestinationUrl = `-- name: GetDestinationUrl :one
-SELECT destination_url
-FROM links
-WHERE short_code = $1
+const getActiveProviderSubscriptionID = `-- name: GetActiveProviderSubscriptionID :one
+SELECT provider_subscription_id
+FROM user_subscriptions
+WHERE workspace_id = $1
+  AND status = 'active'
+ORDER BY start_date DESC
 LIMIT 1
 `
 
-func (q *Queries) GetDestinationUrl(ctx context.Context, shortCode string) (string, error) {
-	row := q.db.QueryRow(ctx, getDestinationUrl, shortCode)
-	var destination_url string
-	err := row.Scan(&destination_url)
-	return destination_url, err
+func (q *Queries) GetActiveProviderSubscriptionID(ctx context.Context, workspaceID int32) (pgtype.Text, error) {
+	row := q.db.QueryRow(ctx, getActiveProviderSubscriptionID, workspaceID)
+	var provider_subscription_id pgtype.Text
+	err := row.Scan(&provider_subscription_id)
+	return provider_subscription_id, err
 }
 
-const getLinkByShortCode = `-- name: GetLinkByShortCode :one
-SELECT user_id, short_code from links
-WHERE short_code = $1
-LIMIT 1
+const getAuditLogForWorkspace = `-- name: GetAuditLogForWorkspace :many
+SELECT a.id, a.actor_user_id, u.email AS actor_email, a.action, a.target_type, a.target_id, a.before, a.after, a.ip_address, a.user_agent, a.created_at
+FROM audit_log a
+LEFT JOIN users u
+ON a.actor_user_id = u.id
+WHERE a.workspace_id = $1
+  AND ($2::text IS NULL OR a.action = $2)
+  AND ($3::text IS NULL OR a.target_type = $3)
+  AND ($4::text IS NULL OR a.target_id = $4)
+  AND ($5::int IS NULL OR a.actor_user_id = $5)
+ORDER BY a.id DESC
+LIMIT $7
+OFFSET $6
 `
 
-type GetLinkByShortCodeRow struct {
-	UserID    int32
-	ShortCode string
+type GetAuditLogForWorkspaceParams struct {
+	WorkspaceID pgtype.Int4
+	Action      pgtype.Text
+	TargetType  pgtype.Text
+	TargetID    pgtype.Text
+	ActorUserID pgtype.Int4
+	Offset      int32
+	Limit       int32
 }
 
-func (q *Queries) GetLinkByShortCode(ctx context.Context, shortCode string) (GetLinkByShortCodeRow, error) {
-	row := q.db.QueryRow(ctx, getLinkByShortCode, shortCode)
-	var i GetLinkByShortCodeRow
-	err := row.Scan(&i.UserID, &i.ShortCode)
-	return i, err
+type GetAuditLogForWorkspaceRow struct {
+	ID          int64
+	ActorUserID pgtype.Int4
+	ActorEmail  pgtype.Text
+	Action      string
+	TargetType  string
+	TargetID    string
+	Before      []byte
+	After       []byte
+	IpAddress   pgtype.Text
+	UserAgent   pgtype.Text
+	CreatedAt   pgtype.Timestamp
 }
 
-const getLinkForUser = `-- name: GetLinkForUser :one
-SELECT short_code, destination_url, title, notes, created_at, updated_at
-FROM links
+func (q *Queries) GetAuditLogForWorkspace(ctx context.Context, arg GetAuditLogForWorkspaceParams) ([]GetAuditLogForWorkspaceRow, error) {
+	rows, err := q.db.Query(ctx, getAuditLogForWorkspace,
+		arg.WorkspaceID,
+		arg.Action,
+		arg.TargetType,
+		arg.TargetID,
+		arg.ActorUserID,
+		arg.Offset,
+		arg.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetAuditLogForWorkspaceRow
+	for rows.Next() {
+		var i GetAuditLogForWorkspaceRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.ActorUserID,
+			&i.ActorEmail,
+			&i.Action,
+			&i.TargetType,
+			&i.TargetID,
+			&i.Before,
+			&i.After,
+			&i.IpAddress,
+			&i.UserAgent,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDefaultWorkspaceForUser = `-- name: GetDefaultWorkspaceForUser :one
+SELECT workspace_id
+FROM workspace_members
 WHERE user_id = $1
-AND short_code = $2
+ORDER BY role = 'owner' DESC, created_at
+LIMIT 1
+`
+
+func (q *Queries) GetDefaultWorkspaceForUser(ctx context.Context, userID int32) (int32, error) {
+	row := q.db.QueryRow(ctx, getDefaultWorkspaceForUser, userID)
+	var workspace_id int32
+	err := row.Scan(&workspace_id)
+	return workspace_id, err
+}
+
+const getDestinationUrl = `-- name: GetDestinationUrl :one
+SELECT l.id, l.destination_url, l.redirect_status, COALESCE((
+  SELECT v.id
+  FROM link_versions v
+  WHERE v.link_id = l.id
+  ORDER BY v.version DESC
+  LIMIT 1
+), 0)::int AS version_id
+FROM links l
+JOIN users u
+ON l.user_id = u.id
+WHERE l.domain_id IS NOT DISTINCT FROM $1
+AND lower(l.short_code) = lower($2)
+AND l.disabled_at IS NULL
+AND u.disabled_at IS NULL
 LIMIT 1
 `
 
-type GetLinkForUserParams struct {
-	UserID    int32
+type GetDestinationUrlParams struct {
+	DomainID  pgtype.Int4
 	ShortCode string
 }
 
-type GetLinkForUserRow struct {
-	ShortCode      string
+type GetDestinationUrlRow struct {
+	ID             int32
 	DestinationUrl string
-	Title          pgtype.Text
-	Notes          pgtype.Text
-	CreatedAt      pgtype.Timestamp
-	UpdatedAt      pgtype.Timestamp
+	RedirectStatus int32
+	VersionID      int32
 }
 
-func (q *Queries) GetLinkForUser(ctx context.Context, arg GetLinkForUserParams) (GetLinkForUserRow, error) {
-	row := q.db.QueryRow(ctx, getLinkForUser, arg.UserID, arg.ShortCode)
-	var i GetLinkForUserRow
+// A disabled creator takes the link down in every workspace, not just the
+// ones they own.
+func (q *Queries) GetDestinationUrl(ctx context.Context, arg GetDestinationUrlParams) (GetDestinationUrlRow, error) {
+	row := q.db.QueryRow(ctx, getDestinationUrl, arg.DomainID, arg.ShortCode)
+	var i GetDestinationUrlRow
 	err := row.Scan(
-		&i.ShortCode,
+		&i.ID,
 		&i.DestinationUrl,
-		&i.Title,
-		&i.Notes,
-		&i.CreatedAt,
-		&i.UpdatedAt,
+		&i.RedirectStatus,
+		&i.VersionID,
 	)
 	return i, err
 }
 
-const getPaginatedLinksForUser = `-- name: GetPaginatedLinksForUser :one
-WITH paginated_links AS (
-  SELECT short_code, destination_url, title, notes
-  FROM links
-  WHERE user_id = $1
-  ORDER BY created_at DESC
-  LIMIT $2
-  OFFSET $3
-)
-SELECT
-  (SELECT COUNT(*)
-    FROM links l
-    WHERE l.user_id = $1
-  ) as total_count,
-  ARRAY_AGG(
-    jsonb_build_object(
-      'short_code', short_code,
-      'destination_url', destination_url,
-      'title', title,
-      'notes', notes
-    )
-  ) as links
-FROM paginated_links
+const getDomainForWorkspace = `-- name: GetDomainForWorkspace :one
+SELECT id, workspace_id, hostname, verification_token, verified_at, created_at, updated_at
+FROM domains
+WHERE id = $1
+  AND workspace_id = $2
 `
 
-type GetPaginatedLinksForUserParams struct {
-	UserID int32
-	Limit  int32
-	Offset int32
-}
-
-type GetPaginatedLinksForUserRow struct {
-	TotalCount int64
-	Links      interface{}
-}
-
-func (q *Queries) GetPaginatedLinksForUser(ctx context.Context, arg GetPaginatedLinksForUserParams) (GetPaginatedLinksForUserRow, error) {
-	row := q.db.QueryRow(ctx, getPaginatedLinksForUser, arg.UserID, arg.Limit, arg.Offset)
-	var i GetPaginatedLinksForUserRow
-	err := row.Scan(&i.TotalCount, &i.Links)
-	return i, err
+type GetDomainForWorkspaceParams struct {
+	ID          int32
+	WorkspaceID int32
 }
 
-const getUser = `-- name: GetUser :one
-SELECT id, name, email, oauth_provider, created_at, updated_at FROM users
-WHERE id = $1 LIMIT 1
-`
-
-func (q *Queries) GetUser(ctx context.Context, id int32) (User, error) {
-	row := q.db.QueryRow(ctx, getUser, id)
-	var i User
+func (q *Queries) GetDomainForWorkspace(ctx context.Context, arg GetDomainForWorkspaceParams) (Domain, error) {
+	row := q.db.QueryRow(ctx, getDomainForWorkspace, arg.ID, arg.WorkspaceID)
+	var i Domain
 	err := row.Scan(
 		&i.ID,
-		&i.Name,
-		&i.Email,
-		&i.OauthProvider,
+		&i.WorkspaceID,
+		&i.Hostname,
+		&i.VerificationToken,
+		&i.VerifiedAt,
 		&i.CreatedAt,
 		&i.UpdatedAt,
 	)
 	return i, err
 }
 
-const getUserByEmail = `-- name: GetUserByEmail :one
-SELECT id, name, email
-FROM users
-WHERE email = $1
+const getDomainForWorkspaceByHostname = `-- name: GetDomainForWorkspaceByHostname :one
+SELECT id, workspace_id, hostname
+FROM domains
+WHERE workspace_id = $1
+  AND hostname = $2
 `
 
-type GetUserByEmailRow struct {
-	ID    int32
-	Name  pgtype.Text
-	Email string
+type GetDomainForWorkspaceByHostnameParams struct {
+	WorkspaceID int32
+	Hostname    string
+}
+
+type GetDomainForWorkspaceByHostnameRow struct {
+	ID          int32
+	WorkspaceID int32
+	Hostname    string
+}
+
+func (q *Queries) GetDomainForWorkspaceByHostname(ctx context.Context, arg GetDomainForWorkspaceByHostnameParams) (GetDomainForWorkspaceByHostnameRow, error) {
+	row := q.db.QueryRow(ctx, getDomainForWorkspaceByHostname, arg.WorkspaceID, arg.Hostname)
+	var i GetDomainForWorkspaceByHostnameRow
+	err := row.Scan(&i.ID, &i.WorkspaceID, &i.Hostname)
+	return i, err
+}
+
+const getDomainsForWorkspace = `-- name: GetDomainsForWorkspace :many
+SELECT id, workspace_id, hostname, verification_token, verified_at, created_at, updated_at
+FROM domains
+WHERE workspace_id = $1
+ORDER BY created_at
+`
+
+func (q *Queries) GetDomainsForWorkspace(ctx context.Context, workspaceID int32) ([]Domain, error) {
+	rows, err := q.db.Query(ctx, getDomainsForWorkspace, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Domain
+	for rows.Next() {
+		var i Domain
+		if err := rows.Scan(
+			&i.ID,
+			&i.WorkspaceID,
+			&i.Hostname,
+			&i.VerificationToken,
+			&i.VerifiedAt,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDueSubscriptions = `-- name: GetDueSubscriptions :many
+SELECT workspace_id
+FROM user_subscriptions
+WHERE status = 'active'
+  AND end_date <= CURRENT_TIMESTAMP
+  AND (provider_subscription_id IS NULL OR end_date <= CURRENT_TIMESTAMP - INTERVAL '3 days')
+`
+
+// Subscriptions paid through the payment provider are ended by its webhooks,
+// they're only expired here if those stop arriving.
+func (q *Queries) GetDueSubscriptions(ctx context.Context) ([]int32, error) {
+	rows, err := q.db.Query(ctx, getDueSubscriptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int32
+	for rows.Next() {
+		var workspace_id int32
+		if err := rows.Scan(&workspace_id); err != nil {
+			return nil, err
+		}
+		items = append(items, workspace_id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getIdentitiesForUser = `-- name: GetIdentitiesForUser :many
+SELECT id, user_id, provider, provider_user_id, email, created_at
+FROM user_identities
+WHERE user_id = $1
+ORDER BY created_at
+`
+
+func (q *Queries) GetIdentitiesForUser(ctx context.Context, userID int32) ([]UserIdentity, error) {
+	rows, err := q.db.Query(ctx, getIdentitiesForUser, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []UserIdentity
+	for rows.Next() {
+		var i UserIdentity
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Provider,
+			&i.ProviderUserID,
+			&i.Email,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getIdentity = `-- name: GetIdentity :one
+SELECT id, user_id, provider, provider_user_id, email, created_at
+FROM user_identities
+WHERE provider = $1
+  AND provider_user_id = $2
+`
+
+type GetIdentityParams struct {
+	Provider       string
+	ProviderUserID string
+}
+
+func (q *Queries) GetIdentity(ctx context.Context, arg GetIdentityParams) (UserIdentity, error) {
+	row := q.db.QueryRow(ctx, getIdentity, arg.Provider, arg.ProviderUserID)
+	var i UserIdentity
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Provider,
+		&i.ProviderUserID,
+		&i.Email,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getLinkByShortCode = `-- name: GetLinkByShortCode :one
+SELECT l.workspace_id, l.short_code, d.hostname
+FROM links l
+LEFT JOIN domains d
+ON l.domain_id = d.id
+WHERE l.domain_id IS NOT DISTINCT FROM $1
+AND lower(l.short_code) = lower($2)
+LIMIT 1
+`
+
+type GetLinkByShortCodeParams struct {
+	DomainID  pgtype.Int4
+	ShortCode string
+}
+
+type GetLinkByShortCodeRow struct {
+	WorkspaceID int32
+	ShortCode   string
+	Hostname    pgtype.Text
+}
+
+func (q *Queries) GetLinkByShortCode(ctx context.Context, arg GetLinkByShortCodeParams) (GetLinkByShortCodeRow, error) {
+	row := q.db.QueryRow(ctx, getLinkByShortCode, arg.DomainID, arg.ShortCode)
+	var i GetLinkByShortCodeRow
+	err := row.Scan(&i.WorkspaceID, &i.ShortCode, &i.Hostname)
+	return i, err
+}
+
+const getLinkCacheKeysForUser = `-- name: GetLinkCacheKeysForUser :many
+SELECT domain_id, short_code
+FROM links
+WHERE user_id = $1
+`
+
+type GetLinkCacheKeysForUserRow struct {
+	DomainID  pgtype.Int4
+	ShortCode string
+}
+
+func (q *Queries) GetLinkCacheKeysForUser(ctx context.Context, userID int32) ([]GetLinkCacheKeysForUserRow, error) {
+	rows, err := q.db.Query(ctx, getLinkCacheKeysForUser, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetLinkCacheKeysForUserRow
+	for rows.Next() {
+		var i GetLinkCacheKeysForUserRow
+		if err := rows.Scan(&i.DomainID, &i.ShortCode); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getLinkForWorkspace = `-- name: GetLinkForWorkspace :one
+SELECT l.id, l.domain_id, l.short_code, d.hostname, l.destination_url, l.title, l.notes, l.redirect_status, l.disabled_at, l.created_at, l.updated_at
+FROM links l
+LEFT JOIN domains d
+ON l.domain_id = d.id
+WHERE l.workspace_id = $1
+AND lower(l.short_code) = lower($2)
+AND d.hostname IS NOT DISTINCT FROM $3
+LIMIT 1
+`
+
+type GetLinkForWorkspaceParams struct {
+	WorkspaceID int32
+	ShortCode   string
+	Hostname    pgtype.Text
+}
+
+type GetLinkForWorkspaceRow struct {
+	ID             int32
+	DomainID       pgtype.Int4
+	ShortCode      string
+	Hostname       pgtype.Text
+	DestinationUrl string
+	Title          pgtype.Text
+	Notes          pgtype.Text
+	RedirectStatus int32
+	DisabledAt     pgtype.Timestamp
+	CreatedAt      pgtype.Timestamp
+	UpdatedAt      pgtype.Timestamp
+}
+
+func (q *Queries) GetLinkForWorkspace(ctx context.Context, arg GetLinkForWorkspaceParams) (GetLinkForWorkspaceRow, error) {
+	row := q.db.QueryRow(ctx, getLinkForWorkspace, arg.WorkspaceID, arg.ShortCode, arg.Hostname)
+	var i GetLinkForWorkspaceRow
+	err := row.Scan(
+		&i.ID,
+		&i.DomainID,
+		&i.ShortCode,
+		&i.Hostname,
+		&i.DestinationUrl,
+		&i.Title,
+		&i.Notes,
+		&i.RedirectStatus,
+		&i.DisabledAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getLinkVersion = `-- name: GetLinkVersion :one
+SELECT id, link_id, version, destination_url, title, notes, redirect_status, created_by, created_at
+FROM link_versions
+WHERE link_id = $1
+  AND version = $2
+`
+
+type GetLinkVersionParams struct {
+	LinkID  int32
+	Version int32
+}
+
+func (q *Queries) GetLinkVersion(ctx context.Context, arg GetLinkVersionParams) (LinkVersion, error) {
+	row := q.db.QueryRow(ctx, getLinkVersion, arg.LinkID, arg.Version)
+	var i LinkVersion
+	err := row.Scan(
+		&i.ID,
+		&i.LinkID,
+		&i.Version,
+		&i.DestinationUrl,
+		&i.Title,
+		&i.Notes,
+		&i.RedirectStatus,
+		&i.CreatedBy,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getLinkVersions = `-- name: GetLinkVersions :many
+SELECT v.version, v.destination_url, v.title, v.notes, v.redirect_status, u.email AS created_by_email, v.created_at, (
+  SELECT COUNT(*)
+  FROM analytics a
+  WHERE a.link_version_id = v.id
+) AS visits
+FROM link_versions v
+LEFT JOIN users u
+ON v.created_by = u.id
+WHERE v.link_id = $1
+ORDER BY v.version DESC
+`
+
+type GetLinkVersionsRow struct {
+	Version        int32
+	DestinationUrl string
+	Title          pgtype.Text
+	Notes          pgtype.Text
+	RedirectStatus int32
+	CreatedByEmail pgtype.Text
+	CreatedAt      pgtype.Timestamp
+	Visits         int64
+}
+
+func (q *Queries) GetLinkVersions(ctx context.Context, linkID int32) ([]GetLinkVersionsRow, error) {
+	rows, err := q.db.Query(ctx, getLinkVersions, linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetLinkVersionsRow
+	for rows.Next() {
+		var i GetLinkVersionsRow
+		if err := rows.Scan(
+			&i.Version,
+			&i.DestinationUrl,
+			&i.Title,
+			&i.Notes,
+			&i.RedirectStatus,
+			&i.CreatedByEmail,
+			&i.CreatedAt,
+			&i.Visits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMostVisitedLinks = `-- name: GetMostVisitedLinks :many
+SELECT l.id, l.domain_id, l.short_code, l.destination_url, l.redirect_status, COALESCE((
+  SELECT v.id
+  FROM link_versions v
+  WHERE v.link_id = l.id
+  ORDER BY v.version DESC
+  LIMIT 1
+), 0)::int AS version_id
+FROM links l
+JOIN users u
+ON l.user_id = u.id
+JOIN (
+  SELECT link_id, COUNT(*) AS visits
+  FROM analytics
+  WHERE recorded_at >= $1
+  GROUP BY link_id
+) a
+ON a.link_id = l.id
+WHERE l.disabled_at IS NULL
+AND u.disabled_at IS NULL
+ORDER BY a.visits DESC
+LIMIT $2
+`
+
+type GetMostVisitedLinksParams struct {
+	Since pgtype.Timestamptz
+	Limit int32
+}
+
+type GetMostVisitedLinksRow struct {
+	ID             int32
+	DomainID       pgtype.Int4
+	ShortCode      string
+	DestinationUrl string
+	RedirectStatus int32
+	VersionID      int32
+}
+
+func (q *Queries) GetMostVisitedLinks(ctx context.Context, arg GetMostVisitedLinksParams) ([]GetMostVisitedLinksRow, error) {
+	rows, err := q.db.Query(ctx, getMostVisitedLinks, arg.Since, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetMostVisitedLinksRow
+	for rows.Next() {
+		var i GetMostVisitedLinksRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.DomainID,
+			&i.ShortCode,
+			&i.DestinationUrl,
+			&i.RedirectStatus,
+			&i.VersionID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPaginatedLinksForWorkspace = `-- name: GetPaginatedLinksForWorkspace :one
+WITH paginated_links AS (
+  SELECT l.short_code, d.hostname, l.destination_url, l.title, l.notes
+  FROM links l
+  LEFT JOIN domains d
+  ON l.domain_id = d.id
+  WHERE l.workspace_id = $1
+  ORDER BY l.created_at DESC
+  LIMIT $2
+  OFFSET $3
+)
+SELECT
+  (SELECT COUNT(*)
+    FROM links l
+    WHERE l.workspace_id = $1
+  ) as total_count,
+  ARRAY_AGG(
+    jsonb_build_object(
+      'short_code', short_code,
+      'hostname', hostname,
+      'destination_url', destination_url,
+      'title', title,
+      'notes', notes
+    )
+  ) as links
+FROM paginated_links
+`
+
+type GetPaginatedLinksForWorkspaceParams struct {
+	WorkspaceID int32
+	Limit       int32
+	Offset      int32
+}
+
+type GetPaginatedLinksForWorkspaceRow struct {
+	TotalCount int64
+	Links      interface{}
+}
+
+func (q *Queries) GetPaginatedLinksForWorkspace(ctx context.Context, arg GetPaginatedLinksForWorkspaceParams) (GetPaginatedLinksForWorkspaceRow, error) {
+	row := q.db.QueryRow(ctx, getPaginatedLinksForWorkspace, arg.WorkspaceID, arg.Limit, arg.Offset)
+	var i GetPaginatedLinksForWorkspaceRow
+	err := row.Scan(&i.TotalCount, &i.Links)
+	return i, err
+}
+
+const getPendingInvitationByTokenHash = `-- name: GetPendingInvitationByTokenHash :one
+SELECT wi.id, wi.workspace_id, w.name AS workspace_name, wi.email, wi.role
+FROM workspace_invitations wi
+JOIN workspaces w
+ON wi.workspace_id = w.id
+WHERE wi.token_hash = $1
+  AND wi.accepted_at IS NULL
+  AND wi.expires_at > CURRENT_TIMESTAMP
+`
+
+type GetPendingInvitationByTokenHashRow struct {
+	ID            int32
+	WorkspaceID   int32
+	WorkspaceName string
+	Email         string
+	Role          string
+}
+
+func (q *Queries) GetPendingInvitationByTokenHash(ctx context.Context, tokenHash string) (GetPendingInvitationByTokenHashRow, error) {
+	row := q.db.QueryRow(ctx, getPendingInvitationByTokenHash, tokenHash)
+	var i GetPendingInvitationByTokenHashRow
+	err := row.Scan(
+		&i.ID,
+		&i.WorkspaceID,
+		&i.WorkspaceName,
+		&i.Email,
+		&i.Role,
+	)
+	return i, err
+}
+
+const getPendingInvitationsForWorkspace = `-- name: GetPendingInvitationsForWorkspace :many
+SELECT id, email, role, expires_at
+FROM workspace_invitations
+WHERE workspace_id = $1
+  AND accepted_at IS NULL
+  AND expires_at > CURRENT_TIMESTAMP
+ORDER BY created_at
+`
+
+type GetPendingInvitationsForWorkspaceRow struct {
+	ID        int32
+	Email     string
+	Role      string
+	ExpiresAt pgtype.Timestamp
+}
+
+func (q *Queries) GetPendingInvitationsForWorkspace(ctx context.Context, workspaceID int32) ([]GetPendingInvitationsForWorkspaceRow, error) {
+	rows, err := q.db.Query(ctx, getPendingInvitationsForWorkspace, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetPendingInvitationsForWorkspaceRow
+	for rows.Next() {
+		var i GetPendingInvitationsForWorkspaceRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Email,
+			&i.Role,
+			&i.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSubscriptions = `-- name: GetSubscriptions :many
+SELECT s.id, s.name, s.max_links_per_month, (
+    SELECT COALESCE(jsonb_object_agg(e.key, e.value), '{}')
+    FROM plan_entitlements e
+    WHERE e.subscription_id = s.id
+  )::jsonb AS entitlements
+FROM subscriptions s
+ORDER BY s.max_links_per_month
+`
+
+type GetSubscriptionsRow struct {
+	ID               int32
+	Name             string
+	MaxLinksPerMonth int32
+	Entitlements     []byte
+}
+
+// Plans are ranked by how many links they allow
+func (q *Queries) GetSubscriptions(ctx context.Context) ([]GetSubscriptionsRow, error) {
+	rows, err := q.db.Query(ctx, getSubscriptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetSubscriptionsRow
+	for rows.Next() {
+		var i GetSubscriptionsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.MaxLinksPerMonth,
+			&i.Entitlements,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTakenSlugs = `-- name: GetTakenSlugs :many
+SELECT lower(short_code)::text AS slug
+FROM links
+WHERE domain_id IS NOT DISTINCT FROM $1
+AND lower(short_code) = ANY($2::text[])
+`
+
+type GetTakenSlugsParams struct {
+	DomainID pgtype.Int4
+	Slugs    []string
+}
+
+// Which of slugs, all lowercase, are used on the domain
+func (q *Queries) GetTakenSlugs(ctx context.Context, arg GetTakenSlugsParams) ([]string, error) {
+	rows, err := q.db.Query(ctx, getTakenSlugs, arg.DomainID, arg.Slugs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, err
+		}
+		items = append(items, slug)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUser = `-- name: GetUser :one
+SELECT id, name, email, email_verified, role, disabled_at, created_at, updated_at FROM users
+WHERE id = $1 LIMIT 1
+`
+
+func (q *Queries) GetUser(ctx context.Context, id int32) (User, error) {
+	row := q.db.QueryRow(ctx, getUser, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Email,
+		&i.EmailVerified,
+		&i.Role,
+		&i.DisabledAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getUserAccess = `-- name: GetUserAccess :one
+SELECT role, disabled_at
+FROM users
+WHERE id = $1
+`
+
+type GetUserAccessRow struct {
+	Role       string
+	DisabledAt pgtype.Timestamp
+}
+
+func (q *Queries) GetUserAccess(ctx context.Context, id int32) (GetUserAccessRow, error) {
+	row := q.db.QueryRow(ctx, getUserAccess, id)
+	var i GetUserAccessRow
+	err := row.Scan(&i.Role, &i.DisabledAt)
+	return i, err
+}
+
+const getUserByEmail = `-- name: GetUserByEmail :one
+SELECT id, name, email, role, disabled_at
+FROM users
+WHERE email = $1
+  AND email_verified
+`
+
+type GetUserByEmailRow struct {
+	ID         int32
+	Name       pgtype.Text
+	Email      string
+	Role       string
+	DisabledAt pgtype.Timestamp
 }
 
 func (q *Queries) GetUserByEmail(ctx context.Context, email string) (GetUserByEmailRow, error) {
 	row := q.db.QueryRow(ctx, getUserByEmail, email)
 	var i GetUserByEmailRow
-	err := row.Scan(&i.ID, &i.Name, &i.Email)
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Email,
+		&i.Role,
+		&i.DisabledAt,
+	)
+	return i, err
+}
+
+const getUserByIdentity = `-- name: GetUserByIdentity :one
+SELECT u.id, u.name, u.email, u.role, u.disabled_at
+FROM user_identities i
+JOIN users u
+ON i.user_id = u.id
+WHERE i.provider = $1
+  AND i.provider_user_id = $2
+`
+
+type GetUserByIdentityParams struct {
+	Provider       string
+	ProviderUserID string
+}
+
+type GetUserByIdentityRow struct {
+	ID         int32
+	Name       pgtype.Text
+	Email      string
+	Role       string
+	DisabledAt pgtype.Timestamp
+}
+
+func (q *Queries) GetUserByIdentity(ctx context.Context, arg GetUserByIdentityParams) (GetUserByIdentityRow, error) {
+	row := q.db.QueryRow(ctx, getUserByIdentity, arg.Provider, arg.ProviderUserID)
+	var i GetUserByIdentityRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Email,
+		&i.Role,
+		&i.DisabledAt,
+	)
+	return i, err
+}
+
+const getUserForAdmin = `-- name: GetUserForAdmin :one
+SELECT id, name, email, role, disabled_at, created_at
+FROM users
+WHERE id = $1
+`
+
+type GetUserForAdminRow struct {
+	ID         int32
+	Name       pgtype.Text
+	Email      string
+	Role       string
+	DisabledAt pgtype.Timestamp
+	CreatedAt  pgtype.Timestamp
+}
+
+func (q *Queries) GetUserForAdmin(ctx context.Context, id int32) (GetUserForAdminRow, error) {
+	row := q.db.QueryRow(ctx, getUserForAdmin, id)
+	var i GetUserForAdminRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Email,
+		&i.Role,
+		&i.DisabledAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getVerifiedDomainByHostname = `-- name: GetVerifiedDomainByHostname :one
+SELECT id, hostname
+FROM domains
+WHERE hostname = $1
+  AND verified_at IS NOT NULL
+`
+
+type GetVerifiedDomainByHostnameRow struct {
+	ID       int32
+	Hostname string
+}
+
+func (q *Queries) GetVerifiedDomainByHostname(ctx context.Context, hostname string) (GetVerifiedDomainByHostnameRow, error) {
+	row := q.db.QueryRow(ctx, getVerifiedDomainByHostname, hostname)
+	var i GetVerifiedDomainByHostnameRow
+	err := row.Scan(&i.ID, &i.Hostname)
+	return i, err
+}
+
+const getVerifiedDomainsForWorkspace = `-- name: GetVerifiedDomainsForWorkspace :many
+SELECT id, hostname
+FROM domains
+WHERE workspace_id = $1
+  AND verified_at IS NOT NULL
+ORDER BY hostname
+`
+
+type GetVerifiedDomainsForWorkspaceRow struct {
+	ID       int32
+	Hostname string
+}
+
+func (q *Queries) GetVerifiedDomainsForWorkspace(ctx context.Context, workspaceID int32) ([]GetVerifiedDomainsForWorkspaceRow, error) {
+	rows, err := q.db.Query(ctx, getVerifiedDomainsForWorkspace, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetVerifiedDomainsForWorkspaceRow
+	for rows.Next() {
+		var i GetVerifiedDomainsForWorkspaceRow
+		if err := rows.Scan(&i.ID, &i.Hostname); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getVisitDataForLink = `-- name: GetVisitDataForLink :many
+SELECT a.user_agent_data, a.geo_data, a.referrer_url, a.recorded_at, v.version
+FROM analytics a
+LEFT JOIN link_versions v
+ON a.link_version_id = v.id
+WHERE a.link_id = $1
+  AND a.recorded_at > CURRENT_TIMESTAMP - make_interval(days => $2::int)
+ORDER BY a.created_at DESC
+`
+
+type GetVisitDataForLinkParams struct {
+	LinkID        int32
+	RetentionDays int32
+}
+
+type GetVisitDataForLinkRow struct {
+	UserAgentData []byte
+	GeoData       []byte
+	ReferrerUrl   pgtype.Text
+	RecordedAt    pgtype.Timestamptz
+	Version       pgtype.Int4
+}
+
+// Only visits within the plan's analytics retention period are shown
+func (q *Queries) GetVisitDataForLink(ctx context.Context, arg GetVisitDataForLinkParams) ([]GetVisitDataForLinkRow, error) {
+	rows, err := q.db.Query(ctx, getVisitDataForLink, arg.LinkID, arg.RetentionDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetVisitDataForLinkRow
+	for rows.Next() {
+		var i GetVisitDataForLinkRow
+		if err := rows.Scan(
+			&i.UserAgentData,
+			&i.GeoData,
+			&i.ReferrerUrl,
+			&i.RecordedAt,
+			&i.Version,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getWorkspaceCurrentUsage = `-- name: GetWorkspaceCurrentUsage :one
+SELECT links_created, cycle_end_date
+FROM user_monthly_usage
+WHERE workspace_id = $1
+  AND cycle_start_date <= CURRENT_DATE
+  AND cycle_end_date > CURRENT_DATE
+`
+
+type GetWorkspaceCurrentUsageRow struct {
+	LinksCreated int32
+	CycleEndDate pgtype.Date
+}
+
+func (q *Queries) GetWorkspaceCurrentUsage(ctx context.Context, workspaceID int32) (GetWorkspaceCurrentUsageRow, error) {
+	row := q.db.QueryRow(ctx, getWorkspaceCurrentUsage, workspaceID)
+	var i GetWorkspaceCurrentUsageRow
+	err := row.Scan(&i.LinksCreated, &i.CycleEndDate)
+	return i, err
+}
+
+const getWorkspaceMembers = `-- name: GetWorkspaceMembers :many
+SELECT u.id, u.name, u.email, wm.role
+FROM workspace_members wm
+JOIN users u
+ON wm.user_id = u.id
+WHERE wm.workspace_id = $1
+ORDER BY wm.created_at
+`
+
+type GetWorkspaceMembersRow struct {
+	ID    int32
+	Name  pgtype.Text
+	Email string
+	Role  string
+}
+
+func (q *Queries) GetWorkspaceMembers(ctx context.Context, workspaceID int32) ([]GetWorkspaceMembersRow, error) {
+	rows, err := q.db.Query(ctx, getWorkspaceMembers, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetWorkspaceMembersRow
+	for rows.Next() {
+		var i GetWorkspaceMembersRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Email,
+			&i.Role,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getWorkspaceMembership = `-- name: GetWorkspaceMembership :one
+SELECT w.id, w.name, wm.role
+FROM workspace_members wm
+JOIN workspaces w
+ON wm.workspace_id = w.id
+WHERE wm.workspace_id = $1
+  AND wm.user_id = $2
+`
+
+type GetWorkspaceMembershipParams struct {
+	WorkspaceID int32
+	UserID      int32
+}
+
+type GetWorkspaceMembershipRow struct {
+	ID   int32
+	Name string
+	Role string
+}
+
+func (q *Queries) GetWorkspaceMembership(ctx context.Context, arg GetWorkspaceMembershipParams) (GetWorkspaceMembershipRow, error) {
+	row := q.db.QueryRow(ctx, getWorkspaceMembership, arg.WorkspaceID, arg.UserID)
+	var i GetWorkspaceMembershipRow
+	err := row.Scan(&i.ID, &i.Name, &i.Role)
 	return i, err
 }
 
-const getUserCurrentUsage = `-- name: GetUserCurrentUsage :one
-SELECT links_created
-FROM user_monthly_usage
-WHERE user_id = $1
-  AND cycle_start_date <= CURRENT_DATE
-  AND cycle_end_date > CURRENT_DATE
+const getWorkspacePlan = `-- name: GetWorkspacePlan :one
+SELECT us.start_date, us.end_date, s.id AS subscription_id, s.name,
+  us.pending_subscription_id, p.name AS pending_subscription_name,
+  us.provider_subscription_id, us.payment_failed_at
+FROM user_subscriptions us
+JOIN subscriptions s
+ON us.subscription_id = s.id
+LEFT JOIN subscriptions p
+ON us.pending_subscription_id = p.id
+WHERE us.workspace_id = $1
+  AND us.status = 'active'
+ORDER BY us.start_date DESC
+LIMIT 1
 `
 
-func (q *Queries) GetUserCurrentUsage(ctx context.Context, userID int32) (int32, error) {
-	row := q.db.QueryRow(ctx, getUserCurrentUsage, userID)
-	var links_created int32
-	err := row.Scan(&links_created)
-	return links_created, err
+type GetWorkspacePlanRow struct {
+	StartDate               pgtype.Timestamp
+	EndDate                 pgtype.Timestamp
+	SubscriptionID          int32
+	Name                    string
+	PendingSubscriptionID   pgtype.Int4
+	PendingSubscriptionName pgtype.Text
+	ProviderSubscriptionID  pgtype.Text
+	PaymentFailedAt         pgtype.Timestamp
+}
+
+func (q *Queries) GetWorkspacePlan(ctx context.Context, workspaceID int32) (GetWorkspacePlanRow, error) {
+	row := q.db.QueryRow(ctx, getWorkspacePlan, workspaceID)
+	var i GetWorkspacePlanRow
+	err := row.Scan(
+		&i.StartDate,
+		&i.EndDate,
+		&i.SubscriptionID,
+		&i.Name,
+		&i.PendingSubscriptionID,
+		&i.PendingSubscriptionName,
+		&i.ProviderSubscriptionID,
+		&i.PaymentFailedAt,
+	)
+	return i, err
 }
 
-const getUserSubscription = `-- name: GetUserSubscription :one
-SELECT us.status, s.name, s.max_links_per_month, s.can_customise_slug, s.can_create_duplicates, s.can_view_analytics
+const getWorkspaceSubscription = `-- name: GetWorkspaceSubscription :one
+SELECT us.status, s.name, s.max_links_per_month, (
+    SELECT COALESCE(jsonb_object_agg(e.key, e.value), '{}')
+    FROM plan_entitlements e
+    WHERE e.subscription_id = s.id
+  )::jsonb AS entitlements
 FROM user_subscriptions us
 JOIN subscriptions s
 ON us.subscription_id=s.id
-WHERE us.user_id=$1
+WHERE us.workspace_id=$1
+  AND us.status = 'active'
+ORDER BY us.start_date DESC
+LIMIT 1
 `
 
-type GetUserSubscriptionRow struct {
-	Status              string
-	Name                string
-	MaxLinksPerMonth    int32
-	CanCustomiseSlug    bool
-	CanCreateDuplicates bool
-	CanViewAnalytics    bool
+type GetWorkspaceSubscriptionRow struct {
+	Status           string
+	Name             string
+	MaxLinksPerMonth int32
+	Entitlements     []byte
 }
 
-func (q *Queries) GetUserSubscription(ctx context.Context, userID int32) (GetUserSubscriptionRow, error) {
-	row := q.db.QueryRow(ctx, getUserSubscription, userID)
-	var i GetUserSubscriptionRow
+func (q *Queries) GetWorkspaceSubscription(ctx context.Context, workspaceID int32) (GetWorkspaceSubscriptionRow, error) {
+	row := q.db.QueryRow(ctx, getWorkspaceSubscription, workspaceID)
+	var i GetWorkspaceSubscriptionRow
 	err := row.Scan(
 		&i.Status,
 		&i.Name,
 		&i.MaxLinksPerMonth,
-		&i.CanCustomiseSlug,
-		&i.CanCreateDuplicates,
-		&i.CanViewAnalytics,
+		&i.Entitlements,
 	)
 	return i, err
 }
 
-const getVisitDataForShortcode = `-- name: GetVisitDataForShortcode :many
-SELECT user_agent_data, geo_data, referrer_url, recorded_at
-FROM analytics
-WHERE short_code = $1
-ORDER BY created_at DESC
+const getWorkspacesForUser = `-- name: GetWorkspacesForUser :many
+SELECT w.id, w.name, wm.role
+FROM workspace_members wm
+JOIN workspaces w
+ON wm.workspace_id = w.id
+WHERE wm.user_id = $1
+ORDER BY w.created_at
 `
 
-type GetVisitDataForShortcodeRow struct {
-	UserAgentData []byte
-	GeoData       []byte
-	ReferrerUrl   pgtype.Text
-	RecordedAt    pgtype.Timestamptz
+type GetWorkspacesForUserRow struct {
+	ID   int32
+	Name string
+	Role string
+}
+
+func (q *Queries) GetWorkspacesForUser(ctx context.Context, userID int32) ([]GetWorkspacesForUserRow, error) {
+	rows, err := q.db.Query(ctx, getWorkspacesForUser, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetWorkspacesForUserRow
+	for rows.Next() {
+		var i GetWorkspacesForUserRow
+		if err := rows.Scan(&i.ID, &i.Name, &i.Role); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getWorkspacesForUserAdmin = `-- name: GetWorkspacesForUserAdmin :many
+SELECT w.id, w.name, wm.role, s.name AS subscription_name, us.status AS subscription_status,
+  COALESCE(u.links_created, 0)::int AS links_created, u.cycle_start_date, u.cycle_end_date
+FROM workspace_members wm
+JOIN workspaces w
+ON wm.workspace_id = w.id
+LEFT JOIN user_subscriptions us
+ON us.workspace_id = w.id
+AND us.status = 'active'
+LEFT JOIN subscriptions s
+ON us.subscription_id = s.id
+LEFT JOIN user_monthly_usage u
+ON u.workspace_id = w.id
+WHERE wm.user_id = $1
+ORDER BY w.created_at
+`
+
+type GetWorkspacesForUserAdminRow struct {
+	ID                 int32
+	Name               string
+	Role               string
+	SubscriptionName   pgtype.Text
+	SubscriptionStatus pgtype.Text
+	LinksCreated       int32
+	CycleStartDate     pgtype.Date
+	CycleEndDate       pgtype.Date
 }
 
-func (q *Queries) GetVisitDataForShortcode(ctx context.Context, shortCode string) ([]GetVisitDataForShortcodeRow, error) {
-	rows, err := q.db.Query(ctx, getVisitDataForShortcode, shortCode)
+func (q *Queries) GetWorkspacesForUserAdmin(ctx context.Context, userID int32) ([]GetWorkspacesForUserAdminRow, error) {
+	rows, err := q.db.Query(ctx, getWorkspacesForUserAdmin, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []GetVisitDataForShortcodeRow
+	var items []GetWorkspacesForUserAdminRow
 	for rows.Next() {
-		var i GetVisitDataForShortcodeRow
+		var i GetWorkspacesForUserAdminRow
 		if err := rows.Scan(
-			&i.UserAgentData,
-			&i.GeoData,
-			&i.ReferrerUrl,
-			&i.RecordedAt,
+			&i.ID,
+			&i.Name,
+			&i.Role,
+			&i.SubscriptionName,
+			&i.SubscriptionStatus,
+			&i.LinksCreated,
+			&i.CycleStartDate,
+			&i.CycleEndDate,
 		); err != nil {
 			return nil, err
 		}
@@ -391,13 +1897,60 @@ func (q *Queries) GetVisitDataForShortcode(ctx context.Context, shortCode string
 	return items, nil
 }
 
+const markProviderSubscriptionPaymentFailed = `-- name: MarkProviderSubscriptionPaymentFailed :one
+UPDATE user_subscriptions
+SET payment_failed_at = CURRENT_TIMESTAMP
+WHERE provider_subscription_id = $1
+  AND status = 'active'
+RETURNING workspace_id
+`
+
+func (q *Queries) MarkProviderSubscriptionPaymentFailed(ctx context.Context, providerSubscriptionID pgtype.Text) (int32, error) {
+	row := q.db.QueryRow(ctx, markProviderSubscriptionPaymentFailed, providerSubscriptionID)
+	var workspace_id int32
+	err := row.Scan(&workspace_id)
+	return workspace_id, err
+}
+
+const nextShortCodeNumber = `-- name: NextShortCodeNumber :one
+SELECT nextval('short_code_seq')::bigint
+`
+
+func (q *Queries) NextShortCodeNumber(ctx context.Context) (int64, error) {
+	row := q.db.QueryRow(ctx, nextShortCodeNumber)
+	var column_1 int64
+	err := row.Scan(&column_1)
+	return column_1, err
+}
+
+const recordBillingEvent = `-- name: RecordBillingEvent :execrows
+INSERT INTO billing_events (id, provider, type)
+VALUES ($1, $2, $3)
+ON CONFLICT (id) DO NOTHING
+`
+
+type RecordBillingEventParams struct {
+	ID       string
+	Provider string
+	Type     string
+}
+
+func (q *Queries) RecordBillingEvent(ctx context.Context, arg RecordBillingEventParams) (int64, error) {
+	result, err := q.db.Exec(ctx, recordBillingEvent, arg.ID, arg.Provider, arg.Type)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const recordVisit = `-- name: RecordVisit :exec
-INSERT INTO analytics (short_code, user_agent_data, geo_data, referrer_url)
-VALUES ($1, $2, $3, $4)
+INSERT INTO analytics (link_id, link_version_id, user_agent_data, geo_data, referrer_url)
+VALUES ($1, $2, $3, $4, $5)
 `
 
 type RecordVisitParams struct {
-	ShortCode     string
+	LinkID        int32
+	LinkVersionID pgtype.Int4
 	UserAgentData []byte
 	GeoData       []byte
 	ReferrerUrl   pgtype.Text
@@ -405,10 +1958,459 @@ type RecordVisitParams struct {
 
 func (q *Queries) RecordVisit(ctx context.Context, arg RecordVisitParams) error {
 	_, err := q.db.Exec(ctx, recordVisit,
-		arg.ShortCode,
+		arg.LinkID,
+		arg.LinkVersionID,
 		arg.UserAgentData,
 		arg.GeoData,
 		arg.ReferrerUrl,
 	)
 	return err
 }
+
+const removeWorkspaceMember = `-- name: RemoveWorkspaceMember :exec
+DELETE FROM workspace_members
+WHERE workspace_id = $1
+  AND user_id = $2
+`
+
+type RemoveWorkspaceMemberParams struct {
+	WorkspaceID int32
+	UserID      int32
+}
+
+func (q *Queries) RemoveWorkspaceMember(ctx context.Context, arg RemoveWorkspaceMemberParams) error {
+	_, err := q.db.Exec(ctx, removeWorkspaceMember, arg.WorkspaceID, arg.UserID)
+	return err
+}
+
+const renewProviderSubscription = `-- name: RenewProviderSubscription :one
+UPDATE user_subscriptions
+SET end_date = $2,
+    payment_failed_at = NULL,
+    subscription_id = COALESCE((
+      SELECT p.id FROM subscriptions p
+      WHERE p.id = user_subscriptions.pending_subscription_id
+        AND p.name <> 'basic'
+    ), user_subscriptions.subscription_id),
+    pending_subscription_id = (
+      SELECT p.id FROM subscriptions p
+      WHERE p.id = user_subscriptions.pending_subscription_id
+        AND p.name = 'basic'
+    )
+WHERE provider_subscription_id = $1
+  AND status = 'active'
+RETURNING workspace_id
+`
+
+type RenewProviderSubscriptionParams struct {
+	ProviderSubscriptionID pgtype.Text
+	EndDate                pgtype.Timestamp
+}
+
+// A paid pending plan is what the renewal was charged for, so it takes over
+// from here. Basic is left pending for when the subscription ends.
+func (q *Queries) RenewProviderSubscription(ctx context.Context, arg RenewProviderSubscriptionParams) (int32, error) {
+	row := q.db.QueryRow(ctx, renewProviderSubscription, arg.ProviderSubscriptionID, arg.EndDate)
+	var workspace_id int32
+	err := row.Scan(&workspace_id)
+	return workspace_id, err
+}
+
+const rollUsageCycles = `-- name: RollUsageCycles :many
+WITH due AS (
+  SELECT user_monthly_usage.id, user_monthly_usage.links_created,
+    COALESCE(user_monthly_usage.created_at::date, user_monthly_usage.cycle_start_date) AS anniversary
+  FROM user_monthly_usage
+  WHERE user_monthly_usage.cycle_end_date <= CURRENT_DATE
+  FOR UPDATE
+),
+elapsed AS (
+  SELECT due.id, due.links_created, due.anniversary,
+    (EXTRACT(YEAR FROM age(CURRENT_DATE, due.anniversary)) * 12 + EXTRACT(MONTH FROM age(CURRENT_DATE, due.anniversary)))::int AS months
+  FROM due
+),
+cycles AS (
+  -- Anniversaries late in the month fall on the last day of shorter months
+  -- which age() doesn't count as a whole month
+  SELECT elapsed.id, elapsed.links_created, elapsed.anniversary,
+    CASE WHEN elapsed.anniversary + (elapsed.months + 1) * INTERVAL '1 month' <= CURRENT_DATE
+      THEN elapsed.months + 1
+      ELSE elapsed.months
+    END AS months
+  FROM elapsed
+)
+UPDATE user_monthly_usage
+SET links_created = 0,
+    cycle_start_date = cycles.anniversary + cycles.months * INTERVAL '1 month',
+    cycle_end_date = cycles.anniversary + (cycles.months + 1) * INTERVAL '1 month',
+    updated_at = CURRENT_TIMESTAMP
+FROM cycles
+WHERE user_monthly_usage.id = cycles.id
+RETURNING user_monthly_usage.workspace_id, cycles.links_created AS previous_links_created,
+  user_monthly_usage.cycle_start_date, user_monthly_usage.cycle_end_date
+`
+
+type RollUsageCyclesRow struct {
+	WorkspaceID          int32
+	PreviousLinksCreated int32
+	CycleStartDate       pgtype.Date
+	CycleEndDate         pgtype.Date
+}
+
+// Starts a new usage cycle for every workspace whose cycle has ended. Cycles
+// run monthly from the day the workspace's usage started counting, skipping
+// any months that were missed, so each workspace keeps its anniversary.
+func (q *Queries) RollUsageCycles(ctx context.Context) ([]RollUsageCyclesRow, error) {
+	rows, err := q.db.Query(ctx, rollUsageCycles)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RollUsageCyclesRow
+	for rows.Next() {
+		var i RollUsageCyclesRow
+		if err := rows.Scan(
+			&i.WorkspaceID,
+			&i.PreviousLinksCreated,
+			&i.CycleStartDate,
+			&i.CycleEndDate,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const searchLinks = `-- name: SearchLinks :many
+SELECT l.id, l.short_code, d.hostname, l.destination_url, l.disabled_at, l.created_at,
+  w.name AS workspace_name, u.email AS user_email
+FROM links l
+JOIN workspaces w
+ON l.workspace_id = w.id
+JOIN users u
+ON l.user_id = u.id
+LEFT JOIN domains d
+ON l.domain_id = d.id
+WHERE lower(l.short_code) = lower($1::text)
+  OR l.destination_url ILIKE '%' || $1::text || '%'
+ORDER BY l.created_at DESC
+LIMIT 50
+`
+
+type SearchLinksRow struct {
+	ID             int32
+	ShortCode      string
+	Hostname       pgtype.Text
+	DestinationUrl string
+	DisabledAt     pgtype.Timestamp
+	CreatedAt      pgtype.Timestamp
+	WorkspaceName  string
+	UserEmail      string
+}
+
+func (q *Queries) SearchLinks(ctx context.Context, query string) ([]SearchLinksRow, error) {
+	rows, err := q.db.Query(ctx, searchLinks, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SearchLinksRow
+	for rows.Next() {
+		var i SearchLinksRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.ShortCode,
+			&i.Hostname,
+			&i.DestinationUrl,
+			&i.DisabledAt,
+			&i.CreatedAt,
+			&i.WorkspaceName,
+			&i.UserEmail,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const searchUsers = `-- name: SearchUsers :many
+SELECT id, name, email, role, disabled_at, created_at
+FROM users
+WHERE $3::text = ''
+  OR email ILIKE '%' || $3::text || '%'
+  OR name ILIKE '%' || $3::text || '%'
+ORDER BY created_at DESC
+LIMIT $1 OFFSET $2
+`
+
+type SearchUsersParams struct {
+	Limit  int32
+	Offset int32
+	Query  string
+}
+
+type SearchUsersRow struct {
+	ID         int32
+	Name       pgtype.Text
+	Email      string
+	Role       string
+	DisabledAt pgtype.Timestamp
+	CreatedAt  pgtype.Timestamp
+}
+
+func (q *Queries) SearchUsers(ctx context.Context, arg SearchUsersParams) ([]SearchUsersRow, error) {
+	rows, err := q.db.Query(ctx, searchUsers, arg.Limit, arg.Offset, arg.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SearchUsersRow
+	for rows.Next() {
+		var i SearchUsersRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Email,
+			&i.Role,
+			&i.DisabledAt,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const setLinkDisabled = `-- name: SetLinkDisabled :one
+UPDATE links
+SET disabled_at = CASE WHEN $2::bool THEN CURRENT_TIMESTAMP END
+WHERE id = $1
+RETURNING id, workspace_id, domain_id, short_code
+`
+
+type SetLinkDisabledParams struct {
+	ID       int32
+	Disabled bool
+}
+
+type SetLinkDisabledRow struct {
+	ID          int32
+	WorkspaceID int32
+	DomainID    pgtype.Int4
+	ShortCode   string
+}
+
+func (q *Queries) SetLinkDisabled(ctx context.Context, arg SetLinkDisabledParams) (SetLinkDisabledRow, error) {
+	row := q.db.QueryRow(ctx, setLinkDisabled, arg.ID, arg.Disabled)
+	var i SetLinkDisabledRow
+	err := row.Scan(
+		&i.ID,
+		&i.WorkspaceID,
+		&i.DomainID,
+		&i.ShortCode,
+	)
+	return i, err
+}
+
+const setPendingSubscription = `-- name: SetPendingSubscription :execrows
+UPDATE user_subscriptions
+SET pending_subscription_id = $1
+WHERE workspace_id = $2
+  AND status = 'active'
+`
+
+type SetPendingSubscriptionParams struct {
+	PendingSubscriptionID pgtype.Int4
+	WorkspaceID           int32
+}
+
+func (q *Queries) SetPendingSubscription(ctx context.Context, arg SetPendingSubscriptionParams) (int64, error) {
+	result, err := q.db.Exec(ctx, setPendingSubscription, arg.PendingSubscriptionID, arg.WorkspaceID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const setUserDisabled = `-- name: SetUserDisabled :exec
+UPDATE users
+SET disabled_at = CASE WHEN $2::bool THEN CURRENT_TIMESTAMP END,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = $1
+`
+
+type SetUserDisabledParams struct {
+	ID       int32
+	Disabled bool
+}
+
+func (q *Queries) SetUserDisabled(ctx context.Context, arg SetUserDisabledParams) error {
+	_, err := q.db.Exec(ctx, setUserDisabled, arg.ID, arg.Disabled)
+	return err
+}
+
+const startProviderSubscription = `-- name: StartProviderSubscription :execrows
+WITH expired AS (
+  UPDATE user_subscriptions
+  SET status = 'expired',
+      end_date = LEAST(user_subscriptions.end_date, CURRENT_TIMESTAMP)
+  WHERE user_subscriptions.workspace_id = $4
+    AND user_subscriptions.status = 'active'
+  RETURNING user_subscriptions.workspace_id
+)
+INSERT INTO user_subscriptions (workspace_id, subscription_id, start_date, end_date, provider_subscription_id)
+SELECT e.workspace_id, s.id, CURRENT_TIMESTAMP, $1, $2
+FROM expired e, subscriptions s
+WHERE s.name = $3
+`
+
+type StartProviderSubscriptionParams struct {
+	EndDate                pgtype.Timestamp
+	ProviderSubscriptionID pgtype.Text
+	Plan                   string
+	WorkspaceID            int32
+}
+
+// Starts a paid period on a plan, replacing whatever the workspace was on.
+func (q *Queries) StartProviderSubscription(ctx context.Context, arg StartProviderSubscriptionParams) (int64, error) {
+	result, err := q.db.Exec(ctx, startProviderSubscription,
+		arg.EndDate,
+		arg.ProviderSubscriptionID,
+		arg.Plan,
+		arg.WorkspaceID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const updateLinkForWorkspace = `-- name: UpdateLinkForWorkspace :one
+WITH updated_link AS (
+  UPDATE links
+  SET destination_url = $1,
+      title = $2,
+      notes = $3,
+      redirect_status = $4,
+      updated_at = CURRENT_TIMESTAMP
+  WHERE links.id = $5
+    AND links.workspace_id = $6
+  RETURNING id, workspace_id, user_id, domain_id, short_code, destination_url, title, notes, redirect_status, disabled_at, created_at, updated_at
+),
+new_version AS (
+  INSERT INTO link_versions (link_id, version, destination_url, title, notes, redirect_status, created_by)
+  SELECT id, (
+    SELECT COALESCE(MAX(version), 0) + 1
+    FROM link_versions
+    WHERE link_versions.link_id = $5
+  ), destination_url, title, notes, redirect_status, $7::int
+  FROM updated_link
+)
+SELECT id, workspace_id, user_id, domain_id, short_code, destination_url, title, notes, redirect_status, disabled_at, created_at, updated_at FROM updated_link
+`
+
+type UpdateLinkForWorkspaceParams struct {
+	DestinationUrl string
+	Title          pgtype.Text
+	Notes          pgtype.Text
+	RedirectStatus int32
+	ID             int32
+	WorkspaceID    int32
+	UpdatedBy      int32
+}
+
+type UpdateLinkForWorkspaceRow struct {
+	ID             int32
+	WorkspaceID    int32
+	UserID         int32
+	DomainID       pgtype.Int4
+	ShortCode      string
+	DestinationUrl string
+	Title          pgtype.Text
+	Notes          pgtype.Text
+	RedirectStatus int32
+	DisabledAt     pgtype.Timestamp
+	CreatedAt      pgtype.Timestamp
+	UpdatedAt      pgtype.Timestamp
+}
+
+func (q *Queries) UpdateLinkForWorkspace(ctx context.Context, arg UpdateLinkForWorkspaceParams) (UpdateLinkForWorkspaceRow, error) {
+	row := q.db.QueryRow(ctx, updateLinkForWorkspace,
+		arg.DestinationUrl,
+		arg.Title,
+		arg.Notes,
+		arg.RedirectStatus,
+		arg.ID,
+		arg.WorkspaceID,
+		arg.UpdatedBy,
+	)
+	var i UpdateLinkForWorkspaceRow
+	err := row.Scan(
+		&i.ID,
+		&i.WorkspaceID,
+		&i.UserID,
+		&i.DomainID,
+		&i.ShortCode,
+		&i.DestinationUrl,
+		&i.Title,
+		&i.Notes,
+		&i.RedirectStatus,
+		&i.DisabledAt,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const updateWorkspaceMemberRole = `-- name: UpdateWorkspaceMemberRole :exec
+UPDATE workspace_members
+SET role = $3,
+    updated_at = CURRENT_TIMESTAMP
+WHERE workspace_id = $1
+  AND user_id = $2
+`
+
+type UpdateWorkspaceMemberRoleParams struct {
+	WorkspaceID int32
+	UserID      int32
+	Role        string
+}
+
+func (q *Queries) UpdateWorkspaceMemberRole(ctx context.Context, arg UpdateWorkspaceMemberRoleParams) error {
+	_, err := q.db.Exec(ctx, updateWorkspaceMemberRole, arg.WorkspaceID, arg.UserID, arg.Role)
+	return err
+}
+
+const verifyDomain = `-- name: VerifyDomain :exec
+WITH verified AS (
+  UPDATE domains
+  SET verified_at = CURRENT_TIMESTAMP,
+      updated_at = CURRENT_TIMESTAMP
+  WHERE domains.id = $1
+  RETURNING domains.id, domains.hostname
+)
+DELETE FROM domains d
+USING verified v
+WHERE d.hostname = v.hostname
+  AND d.id <> v.id
+  AND d.verified_at IS NULL
+`
+
+// Other workspaces' pending claims on the hostname are dropped once one
+// workspace proves it owns it.
+func (q *Queries) VerifyDomain(ctx context.Context, id int32) error {
+	_, err := q.db.Exec(ctx, verifyDomain, id)
+	return err
+}
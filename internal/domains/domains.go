@@ -0,0 +1,152 @@
+package domains
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/didoarellano/short/internal/config"
+)
+
+// Resolver is the subset of net.Resolver used for ownership verification.
+// It's an interface so verification can be tested without DNS.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+const (
+	verificationRecordPrefix = "_short-verification."
+	verificationValuePrefix  = "short-verification="
+)
+
+var ErrVerificationRecordNotFound = errors.New("verification record not found")
+
+// VerificationRecordName is the name of the TXT record a user has to create
+// to prove they own hostname.
+func VerificationRecordName(hostname string) string {
+	return verificationRecordPrefix + hostname
+}
+
+// VerificationRecordValue is the expected contents of the TXT record.
+func VerificationRecordValue(token string) string {
+	return verificationValuePrefix + token
+}
+
+// Verify looks up the verification TXT record for hostname and checks that
+// one of its values matches token.
+func Verify(ctx context.Context, resolver Resolver, hostname, token string) error {
+	records, err := resolver.LookupTXT(ctx, VerificationRecordName(hostname))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return ErrVerificationRecordNotFound
+		}
+		return fmt.Errorf("failed to look up TXT records: %w", err)
+	}
+
+	want := VerificationRecordValue(token)
+	for _, record := range records {
+		if strings.TrimSpace(record) == want {
+			return nil
+		}
+	}
+
+	return ErrVerificationRecordNotFound
+}
+
+func GenerateVerificationToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NormaliseHostname accepts a bare hostname or a URL and returns the
+// lowercased hostname without port or trailing dot.
+func NormaliseHostname(raw string) (string, error) {
+	raw = strings.TrimSpace(strings.ToLower(raw))
+	if strings.Contains(raw, "://") {
+		parsedURL, err := url.Parse(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid domain: %w", err)
+		}
+		raw = parsedURL.Host
+	}
+
+	hostname := strings.TrimSuffix(stripPort(raw), ".")
+
+	if hostname == "" || len(hostname) > 253 {
+		return "", errors.New("invalid domain")
+	}
+	if net.ParseIP(hostname) != nil {
+		return "", errors.New("IP addresses can't be used as a custom domain")
+	}
+
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return "", errors.New("domain must include a top-level domain, e.g. go.example.com")
+	}
+	for _, label := range labels {
+		if !isValidLabel(label) {
+			return "", fmt.Errorf("invalid domain: %s", hostname)
+		}
+	}
+
+	return hostname, nil
+}
+
+func isValidLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 {
+		return false
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		isAlphaNum := (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+		if !isAlphaNum && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// PrimaryHostname is the hostname of REDIRECTOR_BASE_URL.
+func PrimaryHostname() string {
+	parsedURL, err := url.Parse(config.AppData.RedirectorBaseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsedURL.Hostname())
+}
+
+// IsCustomDomainHost reports whether host (as found in a request's Host
+// header) could be a user's custom domain rather than the app's own host.
+func IsCustomDomainHost(host string) bool {
+	hostname := strings.TrimSuffix(strings.ToLower(stripPort(host)), ".")
+	primary := PrimaryHostname()
+	if primary == "" || hostname == "" || hostname == primary || hostname == "localhost" {
+		return false
+	}
+	return net.ParseIP(hostname) == nil
+}
+
+// ShortURL builds the public short URL for a link. An empty hostname means
+// the link lives under REDIRECTOR_BASE_URL.
+func ShortURL(hostname, shortCode string) string {
+	if hostname == "" {
+		return fmt.Sprintf("%s/%s", config.AppData.RedirectorBaseURL, shortCode)
+	}
+	return fmt.Sprintf("https://%s/%s", hostname, shortCode)
+}
@@ -0,0 +1,126 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/didoarellano/short/internal/config"
+)
+
+type fakeResolver struct {
+	records map[string][]string
+	err     error
+}
+
+func (f *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	records, ok := f.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestVerify(t *testing.T) {
+	token := "abc123"
+	tests := []struct {
+		name     string
+		resolver *fakeResolver
+		wantErr  error
+	}{
+		{
+			name: "matching record",
+			resolver: &fakeResolver{records: map[string][]string{
+				"_short-verification.go.example.com": {"v=spf1 -all", "short-verification=abc123"},
+			}},
+		},
+		{
+			name: "wrong token",
+			resolver: &fakeResolver{records: map[string][]string{
+				"_short-verification.go.example.com": {"short-verification=nope"},
+			}},
+			wantErr: ErrVerificationRecordNotFound,
+		},
+		{
+			name:     "no record",
+			resolver: &fakeResolver{records: map[string][]string{}},
+			wantErr:  ErrVerificationRecordNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(context.Background(), tt.resolver, "go.example.com", token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestVerifyResolverFailure(t *testing.T) {
+	resolver := &fakeResolver{err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}
+	err := Verify(context.Background(), resolver, "go.example.com", "abc123")
+	if err == nil || errors.Is(err, ErrVerificationRecordNotFound) {
+		t.Errorf("Expected a lookup error, got %v", err)
+	}
+}
+
+func TestNormaliseHostname(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "go.example.com", want: "go.example.com"},
+		{raw: "  Go.Example.COM. ", want: "go.example.com"},
+		{raw: "https://go.example.com/some/path", want: "go.example.com"},
+		{raw: "go.example.com:8080", want: "go.example.com"},
+		{raw: "localhost", wantErr: true},
+		{raw: "127.0.0.1", wantErr: true},
+		{raw: "-bad.example.com", wantErr: true},
+		{raw: "under_score.example.com", wantErr: true},
+		{raw: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := NormaliseHostname(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestIsCustomDomainHost(t *testing.T) {
+	original := config.AppData.RedirectorBaseURL
+	config.AppData.RedirectorBaseURL = "https://sho.rt"
+	defer func() { config.AppData.RedirectorBaseURL = original }()
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "sho.rt", want: false},
+		{host: "SHO.RT:443", want: false},
+		{host: "localhost:8080", want: false},
+		{host: "10.0.0.1:8080", want: false},
+		{host: "go.example.com", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := IsCustomDomainHost(tt.host); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/session"
+	"github.com/didoarellano/short/internal/subscriptions"
+	"github.com/didoarellano/short/internal/templ"
+	"github.com/didoarellano/short/internal/workspaces"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type DomainHandler struct {
+	template     *templ.Templ
+	queries      *db.Queries
+	sessionStore session.SessionStore
+	redisClient  *redis.Client
+	resolver     Resolver
+}
+
+func NewDomainHandlers(t *templ.Templ, q *db.Queries, s session.SessionStore, r *redis.Client, res Resolver) *DomainHandler {
+	return &DomainHandler{
+		template:     t,
+		queries:      q,
+		sessionStore: s,
+		redisClient:  r,
+		resolver:     res,
+	}
+}
+
+type DomainListItem struct {
+	ID          int32
+	Hostname    string
+	IsVerified  bool
+	RecordName  string
+	RecordValue string
+}
+
+func (dh *DomainHandler) UserDomains(w http.ResponseWriter, r *http.Request) {
+	session, _ := dh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+	userSubscriptionContext := r.Context().Value(subscriptions.SubscriptionKey).(subscriptions.UserSubscriptionContext)
+	subscription := userSubscriptionContext.Subscription
+
+	domains, err := dh.queries.GetDomainsForWorkspace(context.Background(), membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace's domains", logging.Err(err))
+		http.Error(w, "Failed to retrieve workspace's domains", http.StatusInternalServerError)
+		return
+	}
+
+	var items []DomainListItem
+	for _, d := range domains {
+		items = append(items, DomainListItem{
+			ID:          d.ID,
+			Hostname:    d.Hostname,
+			IsVerified:  d.VerifiedAt.Valid,
+			RecordName:  VerificationRecordName(d.Hostname),
+			RecordValue: VerificationRecordValue(d.VerificationToken),
+		})
+	}
+
+	var message string
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message, _ = flashes[0].(string)
+	}
+	session.Save(r, w)
+
+	data := map[string]interface{}{
+		"user":             user,
+		"userSubscription": subscription,
+		"membership":       membership,
+		"domains":          items,
+		"canManageDomains": membership.Can(workspaces.ManageDomains),
+		"canAddDomain":     int32(len(domains)) < subscription.Limit(subscriptions.MaxCustomDomains),
+		"primaryHostname":  PrimaryHostname(),
+		"message":          message,
+	}
+
+	if err := dh.template.ExecuteTemplate(w, r, "domains.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (dh *DomainHandler) AddDomain(w http.ResponseWriter, r *http.Request) {
+	session, _ := dh.sessionStore.Get(r, "session")
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+	userSubscriptionContext := r.Context().Value(subscriptions.SubscriptionKey).(subscriptions.UserSubscriptionContext)
+	subscription := userSubscriptionContext.Subscription
+	basePath := "/" + config.AppData.AppPathPrefix + "/domains"
+	ctx := context.Background()
+
+	redirectWithMessage := func(message string) {
+		session.AddFlash(message)
+		session.Save(r, w)
+		http.Redirect(w, r, basePath, http.StatusFound)
+	}
+
+	if !membership.Can(workspaces.ManageDomains) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	count, err := dh.queries.CountDomainsForWorkspace(ctx, membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count workspace's domains", logging.Err(err))
+		http.Error(w, "Failed to add domain", http.StatusInternalServerError)
+		return
+	}
+	if count >= int64(subscription.Limit(subscriptions.MaxCustomDomains)) {
+		redirectWithMessage("You can't add any more custom domains. Upgrade your plan for more.")
+		return
+	}
+
+	r.ParseForm()
+	hostname, err := NormaliseHostname(r.FormValue("hostname"))
+	if err != nil {
+		redirectWithMessage(err.Error())
+		return
+	}
+	if hostname == PrimaryHostname() {
+		redirectWithMessage(fmt.Sprintf("%s can't be used as a custom domain", hostname))
+		return
+	}
+
+	_, err = dh.queries.GetDomainForWorkspaceByHostname(ctx, db.GetDomainForWorkspaceByHostnameParams{
+		WorkspaceID: membership.WorkspaceID,
+		Hostname:    hostname,
+	})
+	if err == nil {
+		redirectWithMessage(fmt.Sprintf("You've already added %s", hostname))
+		return
+	}
+	if err != pgx.ErrNoRows {
+		slog.ErrorContext(r.Context(), "Failed to look up domain", logging.Err(err))
+		http.Error(w, "Failed to add domain", http.StatusInternalServerError)
+		return
+	}
+
+	// Unverified claims don't block anyone, otherwise whoever adds a
+	// hostname first could keep its owner from ever using it.
+	_, err = dh.queries.GetVerifiedDomainByHostname(ctx, hostname)
+	if err == nil {
+		redirectWithMessage(fmt.Sprintf("%s is already in use", hostname))
+		return
+	}
+	if err != pgx.ErrNoRows {
+		slog.ErrorContext(r.Context(), "Failed to look up domain", logging.Err(err))
+		http.Error(w, "Failed to add domain", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = dh.queries.CreateDomain(ctx, db.CreateDomainParams{
+		WorkspaceID:       membership.WorkspaceID,
+		Hostname:          hostname,
+		VerificationToken: GenerateVerificationToken(),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create domain", logging.Err(err))
+		http.Error(w, "Failed to add domain", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, basePath, http.StatusSeeOther)
+}
+
+func (dh *DomainHandler) VerifyDomain(w http.ResponseWriter, r *http.Request) {
+	session, _ := dh.sessionStore.Get(r, "session")
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+	basePath := "/" + config.AppData.AppPathPrefix + "/domains"
+	ctx := r.Context()
+
+	if !membership.Can(workspaces.ManageDomains) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	domain, ok := dh.getDomainForWorkspace(w, r, membership.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	err := Verify(ctx, dh.resolver, domain.Hostname, domain.VerificationToken)
+	if err != nil {
+		if !errors.Is(err, ErrVerificationRecordNotFound) {
+			slog.ErrorContext(r.Context(), "Failed to verify domain", slog.String("hostname", domain.Hostname), logging.Err(err))
+		}
+		session.AddFlash(fmt.Sprintf("Couldn't verify %s. DNS changes can take a while to propagate, try again later.", domain.Hostname))
+		session.Save(r, w)
+		http.Redirect(w, r, basePath, http.StatusFound)
+		return
+	}
+
+	err = dh.queries.VerifyDomain(ctx, domain.ID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		session.AddFlash(fmt.Sprintf("%s has already been verified by another workspace", domain.Hostname))
+		session.Save(r, w)
+		http.Redirect(w, r, basePath, http.StatusFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to mark domain as verified", logging.Err(err))
+		http.Error(w, "Failed to verify domain", http.StatusInternalServerError)
+		return
+	}
+	InvalidateCachedDomain(dh.redisClient, domain.Hostname)
+
+	session.AddFlash(fmt.Sprintf("%s has been verified", domain.Hostname))
+	session.Save(r, w)
+	http.Redirect(w, r, basePath, http.StatusSeeOther)
+}
+
+func (dh *DomainHandler) RemoveDomain(w http.ResponseWriter, r *http.Request) {
+	session, _ := dh.sessionStore.Get(r, "session")
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+	basePath := "/" + config.AppData.AppPathPrefix + "/domains"
+
+	if !membership.Can(workspaces.ManageDomains) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	domain, ok := dh.getDomainForWorkspace(w, r, membership.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	err := dh.queries.DeleteDomainForWorkspace(context.Background(), db.DeleteDomainForWorkspaceParams{
+		ID:          domain.ID,
+		WorkspaceID: membership.WorkspaceID,
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		session.AddFlash(fmt.Sprintf("%s still has links and can't be removed", domain.Hostname))
+		session.Save(r, w)
+		http.Redirect(w, r, basePath, http.StatusFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete domain", logging.Err(err))
+		http.Error(w, "Failed to remove domain", http.StatusInternalServerError)
+		return
+	}
+	InvalidateCachedDomain(dh.redisClient, domain.Hostname)
+
+	http.Redirect(w, r, basePath, http.StatusSeeOther)
+}
+
+func (dh *DomainHandler) getDomainForWorkspace(w http.ResponseWriter, r *http.Request, workspaceID int32) (db.Domain, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return db.Domain{}, false
+	}
+
+	domain, err := dh.queries.GetDomainForWorkspace(context.Background(), db.GetDomainForWorkspaceParams{
+		ID:          int32(id),
+		WorkspaceID: workspaceID,
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return domain, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve domain", logging.Err(err))
+		http.Error(w, "Failed to retrieve domain", http.StatusInternalServerError)
+		return domain, false
+	}
+
+	return domain, true
+}
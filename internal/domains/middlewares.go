@@ -0,0 +1,84 @@
+package domains
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+type key string
+
+const DomainKey key = "domain"
+
+type CustomDomain struct {
+	ID       int32
+	Hostname string
+}
+
+// CustomDomainMatcher matches requests that aren't addressed to the app's
+// own host so they can be routed separately from the app.
+func CustomDomainMatcher() mux.MatcherFunc {
+	return func(r *http.Request, rm *mux.RouteMatch) bool {
+		return IsCustomDomainHost(r.Host)
+	}
+}
+
+func domainCacheKey(hostname string) string {
+	return fmt.Sprintf("domain:%s", hostname)
+}
+
+// InvalidateCachedDomain removes hostname from the cache used by
+// CustomDomainMiddleware. Call it whenever a domain is verified or removed.
+func InvalidateCachedDomain(redisClient *redis.Client, hostname string) {
+	redisClient.Del(context.Background(), domainCacheKey(hostname))
+}
+
+// CustomDomainMiddleware looks up the verified domain matching the request's
+// host and makes it available to handlers under DomainKey. Requests for
+// unknown or unverified hosts are handed to notFound.
+func CustomDomainMiddleware(queries *db.Queries, redisClient *redis.Client, notFound http.Handler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hostname := strings.TrimSuffix(strings.ToLower(stripPort(r.Host)), ".")
+			ctx := context.Background()
+			key := domainCacheKey(hostname)
+
+			var domain CustomDomain
+			s, err := redisClient.Get(ctx, key).Result()
+			if err == nil {
+				err = json.Unmarshal([]byte(s), &domain)
+			}
+
+			if err != nil {
+				d, err := queries.GetVerifiedDomainByHostname(ctx, hostname)
+				if err == pgx.ErrNoRows {
+					notFound.ServeHTTP(w, r)
+					return
+				}
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to look up domain", slog.String("hostname", hostname), logging.Err(err))
+					http.Error(w, "Failed to look up domain", http.StatusInternalServerError)
+					return
+				}
+
+				domain = CustomDomain(d)
+				if b, err := json.Marshal(domain); err == nil {
+					redisClient.Set(ctx, key, string(b), time.Hour)
+				}
+			}
+
+			ctx = context.WithValue(r.Context(), DomainKey, domain)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -19,7 +19,10 @@ type MockGeoDataFetcher struct{}
 func (r *RealGeoDataFetcher) GetGeoData(ip net.IP) (GeoData, error) {
 	token := os.Getenv("IPINFO_TOKEN")
 	ipinfoClient := ipinfo.NewClient(nil, nil, token)
-	geo, _ := ipinfoClient.GetIPInfo(ip)
+	geo, err := ipinfoClient.GetIPInfo(ip)
+	if err != nil {
+		return GeoData{IP: ip}, err
+	}
 	return *geo, nil
 }
 
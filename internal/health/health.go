@@ -0,0 +1,123 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const checkTimeout = 2 * time.Second
+
+// CheckFunc reports whether a dependency can be reached.
+type CheckFunc func(ctx context.Context) error
+
+// Checker answers health checks. They're served straight off the router,
+// without sessions or templates, so they only depend on what they check.
+type Checker struct {
+	checks       map[string]CheckFunc
+	required     map[string]bool
+	shuttingDown atomic.Bool
+}
+
+// NewChecker checks Postgres, without which nothing can be served, and
+// Redis, which the app can run without.
+func NewChecker(pool *pgxpool.Pool, r *redis.Client) *Checker {
+	return newChecker(map[string]CheckFunc{
+		"postgres": pool.Ping,
+		"redis": func(ctx context.Context) error {
+			return r.Ping(ctx).Err()
+		},
+	}, "postgres")
+}
+
+func newChecker(checks map[string]CheckFunc, required ...string) *Checker {
+	c := &Checker{checks: checks, required: make(map[string]bool, len(required))}
+	for _, name := range required {
+		c.required[name] = true
+	}
+	return c
+}
+
+// ShutDown makes the app report itself not ready, so traffic moves away
+// before it stops.
+func (c *Checker) ShutDown() {
+	c.shuttingDown.Store(true)
+}
+
+// Liveness reports that the process is up and serving.
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+type checkResult struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+type readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// Readiness reports whether the app should be sent requests. It isn't once
+// it starts shutting down or a required dependency like Postgres doesn't
+// answer in time. Any other failing dependency makes it degraded but still
+// ready, as redirects keep working without Redis and every instance would
+// otherwise be taken out of routing at once.
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	result := readiness{Status: "ok", Checks: make(map[string]checkResult, len(c.checks))}
+	if c.shuttingDown.Load() {
+		result.Status = "shutting down"
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+			defer cancel()
+
+			started := time.Now()
+			err := check(ctx)
+			checked := checkResult{Status: "ok", DurationMS: time.Since(started).Milliseconds()}
+			if err != nil {
+				checked.Status = "failing"
+				checked.Error = err.Error()
+				slog.WarnContext(r.Context(), "Readiness check failed", slog.String("check", name), logging.Err(err))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			result.Checks[name] = checked
+			switch {
+			case err == nil:
+			case c.required[name] && result.Status != "shutting down":
+				result.Status = "unavailable"
+			case result.Status == "ok":
+				result.Status = "degraded"
+			}
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if result.Status == "shutting down" || result.Status == "unavailable" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
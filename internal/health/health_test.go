@@ -0,0 +1,63 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name         string
+		checks       map[string]CheckFunc
+		required     []string
+		shuttingDown bool
+		wantStatus   int
+		wantResult   string
+		wantFailing  string
+	}{
+		{name: "all up", checks: map[string]CheckFunc{"postgres": ok, "redis": ok}, wantStatus: http.StatusOK, wantResult: "ok"},
+		{name: "optional down", checks: map[string]CheckFunc{"postgres": ok, "redis": down}, required: []string{"postgres"}, wantStatus: http.StatusOK, wantResult: "degraded", wantFailing: "redis"},
+		{name: "optional timed out", checks: map[string]CheckFunc{"redis": slow}, wantStatus: http.StatusOK, wantResult: "degraded", wantFailing: "redis"},
+		{name: "required down", checks: map[string]CheckFunc{"postgres": down, "redis": ok}, required: []string{"postgres"}, wantStatus: http.StatusServiceUnavailable, wantResult: "unavailable", wantFailing: "postgres"},
+		{name: "required timed out", checks: map[string]CheckFunc{"postgres": slow}, required: []string{"postgres"}, wantStatus: http.StatusServiceUnavailable, wantResult: "unavailable", wantFailing: "postgres"},
+		{name: "shutting down", checks: map[string]CheckFunc{"postgres": ok}, shuttingDown: true, wantStatus: http.StatusServiceUnavailable, wantResult: "shutting down"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newChecker(tt.checks, tt.required...)
+			if tt.shuttingDown {
+				c.ShutDown()
+			}
+			rec := httptest.NewRecorder()
+			c.Readiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			var result readiness
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != tt.wantResult {
+				t.Errorf("Expected %q, got %q", tt.wantResult, result.Status)
+			}
+			for name, check := range result.Checks {
+				if failing := check.Status != "ok"; failing != (name == tt.wantFailing) {
+					t.Errorf("Expected %s failing to be %v, got %+v", name, name == tt.wantFailing, check)
+				}
+			}
+		})
+	}
+}
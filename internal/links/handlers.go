@@ -4,38 +4,75 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/didoarellano/short/internal/audit"
 	"github.com/didoarellano/short/internal/auth"
 	"github.com/didoarellano/short/internal/config"
 	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/domains"
 	"github.com/didoarellano/short/internal/geodata"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/metrics"
 	"github.com/didoarellano/short/internal/redirector"
 	"github.com/didoarellano/short/internal/session"
+	"github.com/didoarellano/short/internal/shortcode"
 	"github.com/didoarellano/short/internal/subscriptions"
 	"github.com/didoarellano/short/internal/templ"
+	"github.com/didoarellano/short/internal/workspaces"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type LinkHandler struct {
 	template         *templ.Templ
+	pool             *pgxpool.Pool
 	queries          *db.Queries
 	sessionStore     session.SessionStore
 	redisClient      *redis.Client
 	userSubscription subscriptions.UserSubscriptionService
+	auditLogger      *audit.Logger
+	shortCodes       shortcode.Generator
 }
 
-func NewLinkHandlers(t *templ.Templ, q *db.Queries, s session.SessionStore, r *redis.Client, us subscriptions.UserSubscriptionService) *LinkHandler {
+func NewLinkHandlers(t *templ.Templ, pool *pgxpool.Pool, q *db.Queries, s session.SessionStore, r *redis.Client, us subscriptions.UserSubscriptionService, a *audit.Logger, g shortcode.Generator) *LinkHandler {
 	return &LinkHandler{
 		template:         t,
+		pool:             pool,
 		queries:          q,
 		sessionStore:     s,
 		redisClient:      r,
 		userSubscription: us,
+		auditLogger:      a,
+		shortCodes:       g,
+	}
+}
+
+// linkAuditState is the snapshot of a link stored in the audit log
+type linkAuditState struct {
+	ShortCode      string `json:"short_code"`
+	DomainID       int32  `json:"domain_id,omitempty"`
+	DestinationUrl string `json:"destination_url"`
+	Title          string `json:"title"`
+	Notes          string `json:"notes"`
+	RedirectStatus int32  `json:"redirect_status"`
+}
+
+func newLinkAuditState(shortCode string, domainID pgtype.Int4, destinationUrl string, title, notes pgtype.Text, redirectStatus int32) linkAuditState {
+	return linkAuditState{
+		ShortCode:      shortCode,
+		DomainID:       domainID.Int32,
+		DestinationUrl: destinationUrl,
+		Title:          title.String,
+		Notes:          notes.String,
+		RedirectStatus: redirectStatus,
 	}
 }
 
@@ -52,9 +89,14 @@ type PaginationLinks []PaginationLink
 func (lh *LinkHandler) UserLinks(w http.ResponseWriter, r *http.Request) {
 	session, _ := lh.sessionStore.Get(r, "session")
 	user := session.Values["user"].(auth.UserSession)
-	userID := user.UserID
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
 	basePath := "/" + config.AppData.AppPathPrefix + "/links"
 
+	if !membership.Can(workspaces.ViewLinks) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	// No page query param defaults to page 1
 	currentPage := 1
 	if pageParam := r.URL.Query().Get("page"); pageParam != "" {
@@ -68,15 +110,15 @@ func (lh *LinkHandler) UserLinks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	links, err := lh.queries.GetPaginatedLinksForUser(context.Background(), db.GetPaginatedLinksForUserParams{
-		UserID: userID,
-		Limit:  int32(paginationLimit),
-		Offset: int32((currentPage - 1) * paginationLimit),
+	links, err := lh.queries.GetPaginatedLinksForWorkspace(context.Background(), db.GetPaginatedLinksForWorkspaceParams{
+		WorkspaceID: membership.WorkspaceID,
+		Limit:       int32(paginationLimit),
+		Offset:      int32((currentPage - 1) * paginationLimit),
 	})
 
 	if err != nil {
-		log.Printf("Failed to retrieve user's links: %v", err)
-		http.Error(w, "Failed to retrieve user's links: %v", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace's links", logging.Err(err))
+		http.Error(w, "Failed to retrieve workspace's links: %v", http.StatusInternalServerError)
 		return
 	}
 
@@ -112,11 +154,13 @@ func (lh *LinkHandler) UserLinks(w http.ResponseWriter, r *http.Request) {
 
 	data := map[string]interface{}{
 		"user":            user,
+		"membership":      membership,
+		"canEditLinks":    membership.Can(workspaces.EditLinks),
 		"links":           links.Links,
 		"paginationLinks": paginationLinks,
 	}
 
-	if err := lh.template.ExecuteTemplate(w, "links.html", data); err != nil {
+	if err := lh.template.ExecuteTemplate(w, r, "links.html", data); err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 	}
 }
@@ -126,6 +170,12 @@ func (lh *LinkHandler) CreateLink(w http.ResponseWriter, r *http.Request) {
 	basePath := "/" + config.AppData.AppPathPrefix + "/links"
 	user := session.Values["user"].(auth.UserSession)
 	userID := user.UserID
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+
+	if !membership.Can(workspaces.EditLinks) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
 	userSubscriptionContext := r.Context().Value(subscriptions.SubscriptionKey).(subscriptions.UserSubscriptionContext)
 	subscription := userSubscriptionContext.Subscription
@@ -133,6 +183,10 @@ func (lh *LinkHandler) CreateLink(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		customSlugConfig, _ := config.LoadCustomSlugConfig()
+		verifiedDomains, err := lh.queries.GetVerifiedDomainsForWorkspace(context.Background(), membership.WorkspaceID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to retrieve workspace's domains", logging.Err(err))
+		}
 		ShowCreateForm(ShowCreateFormParams{
 			w:                w,
 			r:                r,
@@ -142,26 +196,30 @@ func (lh *LinkHandler) CreateLink(w http.ResponseWriter, r *http.Request) {
 			userSubscription: subscription,
 			linksCreated:     linksCreated,
 			customSlugConfig: customSlugConfig,
+			domains:          verifiedDomains,
 		})
 		return
 	}
 
+	// Saves validating a form that can't be saved. SaveNewLink has the final
+	// say as the cached count can be behind.
 	if linksCreated >= subscription.MaxLinksPerMonth {
-		session.AddFlash(FormValidationErrors{
-			Message: "You can't create anymore links this month. Upgrade to pro for more.",
-		})
-		session.Save(r, w)
-		http.Redirect(w, r, basePath+"/new", http.StatusFound)
+		quotaExceeded(w, r, session, basePath)
 		return
 	}
 
 	formData := ParseCreateForm(r)
-	validatedForm := ValidateCreateForm(ValidateCreateFormParams{
+	validatedForm, err := ValidateCreateForm(ValidateCreateFormParams{
 		queries:          lh.queries,
-		userID:           userID,
+		workspaceID:      membership.WorkspaceID,
 		formData:         formData,
 		userSubscription: subscription,
 	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to validate new link", logging.Err(err))
+		http.Error(w, "Failed to create new link", http.StatusInternalServerError)
+		return
+	}
 
 	if !validatedForm.IsValid {
 		session.AddFlash(validatedForm.Errors)
@@ -170,45 +228,128 @@ func (lh *LinkHandler) CreateLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := SaveNewLink(lh.queries, userID, formData)
+	link, usage, err := SaveNewLink(r.Context(), lh.pool, lh.queries, lh.shortCodes, membership.WorkspaceID, userID, formData)
+	if err == ErrQuotaExceeded {
+		quotaExceeded(w, r, session, basePath)
+		return
+	}
+	// Someone else took the slug after it was validated
+	if err == ErrSlugTaken {
+		domainID := pgtype.Int4{Int32: formData.DomainID, Valid: formData.DomainID != 0}
+		suggestions, err := SuggestSlugs(context.Background(), lh.queries, domainID, formData.Slug, slugSuggestionTitle(formData))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to suggest slugs", logging.Err(err))
+		}
+		validatedForm.Errors.FormFields["Slug"] = FormFieldValidation{
+			Value:       formData.Slug,
+			Message:     fmt.Sprintf("%s is already in use", formData.Slug),
+			Suggestions: suggestions,
+		}
+		session.AddFlash(validatedForm.Errors)
+		session.Save(r, w)
+		http.Redirect(w, r, basePath+"/new", http.StatusFound)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to create new link: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to create new link", logging.Err(err))
 		http.Error(w, "Failed to create new link", http.StatusInternalServerError)
 		return
 	}
 
-	lh.userSubscription.SetCachedCurrentUsageForUser(userID, linksCreated+1)
+	// The short code may have been cached as not found before it existed
+	lh.redisClient.Del(context.Background(), redirector.CacheKey(link.DomainID, link.ShortCode))
+
+	lh.auditLogger.Record(audit.Entry{
+		WorkspaceID: membership.WorkspaceID,
+		ActorUserID: userID,
+		Action:      audit.ActionCreate,
+		TargetType:  audit.TargetLink,
+		TargetID:    strconv.Itoa(int(link.ID)),
+		After:       newLinkAuditState(link.ShortCode, link.DomainID, link.DestinationUrl, link.Title, link.Notes, link.RedirectStatus),
+	}.WithRequest(r))
+
+	lh.userSubscription.SetCachedCurrentUsageForWorkspace(membership.WorkspaceID, usage.LinksCreated, usage.CycleEndDate.Time)
+	metrics.LinksCreated.WithLabelValues(subscription.Name).Inc()
 
 	http.Redirect(w, r, basePath, http.StatusSeeOther)
 }
 
+func quotaExceeded(w http.ResponseWriter, r *http.Request, session *sessions.Session, basePath string) {
+	session.AddFlash(FormValidationErrors{
+		Message: "You can't create anymore links this month. Upgrade your plan for more.",
+	})
+	session.Save(r, w)
+	http.Redirect(w, r, basePath+"/new", http.StatusFound)
+}
+
 type AnalyticsData struct {
+	Version     int32
 	ReferrerUrl string
 	RecordedAt  time.Time
 	UserAgent   redirector.UserAgentDetails
 	GeoData     geodata.GeoData
 }
 
+type LinkVersion struct {
+	db.GetLinkVersionsRow
+	RollbackPath string
+}
+
+// SlugAvailability tells the create form as it's filled in whether the slug
+// can be used, with suggestions if it can't.
+func (lh *LinkHandler) SlugAvailability(w http.ResponseWriter, r *http.Request) {
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+	if !membership.Can(workspaces.EditLinks) || !subscriptions.HasEntitlement(r, subscriptions.CustomSlugs) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	formData := ParseCreateForm(r)
+	domainID, ok := workspaceDomain(lh.queries, membership.WorkspaceID, formData.DomainID)
+	if !ok {
+		http.Error(w, "Unknown domain", http.StatusBadRequest)
+		return
+	}
+
+	availability, err := CheckSlug(r.Context(), lh.queries, domainID, formData.Slug, slugSuggestionTitle(formData))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to check slug availability", logging.Err(err))
+		http.Error(w, "Failed to check slug", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(availability)
+}
+
 func (lh *LinkHandler) UserLink(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
 	session, _ := lh.sessionStore.Get(r, "session")
 	user := session.Values["user"].(auth.UserSession)
-	userID := user.UserID
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
 	userSubscriptionContext := r.Context().Value(subscriptions.SubscriptionKey).(subscriptions.UserSubscriptionContext)
 	subscription := userSubscriptionContext.Subscription
 
-	link, err := lh.queries.GetLinkForUser(context.Background(), db.GetLinkForUserParams{
-		UserID:    userID,
-		ShortCode: vars["shortcode"],
-	})
+	if !membership.Can(workspaces.ViewLinks) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
 
-	if err != nil {
-		log.Printf("Failed to retrieve link: %v", err)
-		http.Error(w, "Failed to retrieve link: %v", http.StatusInternalServerError)
+	link, ok := lh.getLinkForWorkspace(w, r, membership.WorkspaceID)
+	if !ok {
 		return
 	}
 
-	analyticsRows, _ := lh.queries.GetVisitDataForShortcode(context.Background(), vars["shortcode"])
+	var analyticsRows []db.GetVisitDataForLinkRow
+	if subscription.Allows(subscriptions.Analytics) {
+		var err error
+		analyticsRows, err = lh.queries.GetVisitDataForLink(context.Background(), db.GetVisitDataForLinkParams{
+			LinkID:        link.ID,
+			RetentionDays: subscription.Limit(subscriptions.AnalyticsRetentionDays),
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to retrieve link analytics", logging.Err(err))
+		}
+	}
 	var analytics []AnalyticsData
 	for _, data := range analyticsRows {
 		var uaData redirector.UserAgentDetails
@@ -216,6 +357,7 @@ func (lh *LinkHandler) UserLink(w http.ResponseWriter, r *http.Request) {
 		json.Unmarshal(data.UserAgentData, &uaData)
 		json.Unmarshal(data.GeoData, &geoData)
 		analytics = append(analytics, AnalyticsData{
+			Version:     data.Version.Int32,
 			ReferrerUrl: data.ReferrerUrl.String,
 			RecordedAt:  data.RecordedAt.Time,
 			UserAgent:   uaData,
@@ -223,15 +365,326 @@ func (lh *LinkHandler) UserLink(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	versionRows, err := lh.queries.GetLinkVersions(context.Background(), link.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve link versions", logging.Err(err))
+	}
+	var versions []LinkVersion
+	for _, v := range versionRows {
+		versions = append(versions, LinkVersion{
+			GetLinkVersionsRow: v,
+			RollbackPath:       linkActionPath(link.ShortCode, link.Hostname.String, fmt.Sprintf("versions/%d/rollback", v.Version)),
+		})
+	}
+
 	data := map[string]interface{}{
 		"user":             user,
+		"membership":       membership,
 		"userSubscription": subscription,
 		"link":             link,
+		"versions":         versions,
+		"shortUrl":         domains.ShortURL(link.Hostname.String, link.ShortCode),
+		"canEditLinks":     membership.Can(workspaces.EditLinks),
+		"editPath":         linkActionPath(link.ShortCode, link.Hostname.String, "edit"),
+		"deletePath":       linkActionPath(link.ShortCode, link.Hostname.String, "delete"),
+		"auditPath":        linkActionPath(link.ShortCode, link.Hostname.String, "audit"),
 		"analytics":        analytics,
+		"retentionDays":    subscription.Limit(subscriptions.AnalyticsRetentionDays),
 		"wasUpdated":       !link.CreatedAt.Time.Equal(link.UpdatedAt.Time),
 	}
 
-	if err := lh.template.ExecuteTemplate(w, "link.html", data); err != nil {
+	if err := lh.template.ExecuteTemplate(w, r, "link.html", data); err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 	}
 }
+
+func (lh *LinkHandler) EditLink(w http.ResponseWriter, r *http.Request) {
+	session, _ := lh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+
+	if !membership.Can(workspaces.EditLinks) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	link, ok := lh.getLinkForWorkspace(w, r, membership.WorkspaceID)
+	if !ok {
+		return
+	}
+	editPath := linkActionPath(link.ShortCode, link.Hostname.String, "edit")
+
+	if r.Method == "GET" {
+		validationErrors := FormValidationErrors{
+			FormFields: map[string]FormFieldValidation{
+				"Url":            {Value: link.DestinationUrl},
+				"Title":          {Value: link.Title.String},
+				"Notes":          {Value: link.Notes.String},
+				"RedirectStatus": {Value: strconv.Itoa(int(link.RedirectStatus))},
+			},
+		}
+		if flashes := session.Flashes(); len(flashes) > 0 {
+			if v, ok := flashes[0].(FormValidationErrors); ok {
+				validationErrors = v
+			}
+		}
+		session.Save(r, w)
+
+		data := map[string]interface{}{
+			"user":             user,
+			"membership":       membership,
+			"link":             link,
+			"shortUrl":         domains.ShortURL(link.Hostname.String, link.ShortCode),
+			"linkPath":         linkPath(link.ShortCode, link.Hostname.String),
+			"redirectStatuses": RedirectStatuses,
+			"validationErrors": validationErrors,
+		}
+
+		if err := lh.template.ExecuteTemplate(w, r, "edit_link.html", data); err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	formData := ParseCreateForm(r)
+	redirectStatus, _ := strconv.ParseInt(r.FormValue("redirect_status"), 10, 32)
+
+	if formData.DestinationUrl == "" || !isValidRedirectStatus(int32(redirectStatus)) {
+		validationErrors := FormValidationErrors{
+			FormFields: map[string]FormFieldValidation{
+				"Url":            {Value: formData.DestinationUrl},
+				"Title":          {Value: formData.Title},
+				"Notes":          {Value: formData.Notes},
+				"RedirectStatus": {Value: strconv.Itoa(int(redirectStatus))},
+			},
+		}
+		if formData.DestinationUrl == "" {
+			validationErrors.FormFields["Url"] = FormFieldValidation{Message: "Destination URL is required"}
+		}
+		if !isValidRedirectStatus(int32(redirectStatus)) {
+			validationErrors.FormFields["RedirectStatus"] = FormFieldValidation{Message: "Choose a redirect type"}
+		}
+		session.AddFlash(validationErrors)
+		session.Save(r, w)
+		http.Redirect(w, r, editPath, http.StatusFound)
+		return
+	}
+
+	err := lh.updateLink(r, user.UserID, link, db.UpdateLinkForWorkspaceParams{
+		DestinationUrl: formData.DestinationUrl,
+		Title:          pgtype.Text{String: formData.Title, Valid: true},
+		Notes:          pgtype.Text{String: formData.Notes, Valid: true},
+		RedirectStatus: int32(redirectStatus),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update link", logging.Err(err))
+		http.Error(w, "Failed to update link", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, linkPath(link.ShortCode, link.Hostname.String), http.StatusSeeOther)
+}
+
+// RollbackLink restores a previous version of a link. The restored state is
+// saved as a new version so history is never rewritten.
+func (lh *LinkHandler) RollbackLink(w http.ResponseWriter, r *http.Request) {
+	session, _ := lh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+
+	if !membership.Can(workspaces.EditLinks) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	link, ok := lh.getLinkForWorkspace(w, r, membership.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	versionNumber, err := strconv.ParseInt(mux.Vars(r)["version"], 10, 32)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	version, err := lh.queries.GetLinkVersion(context.Background(), db.GetLinkVersionParams{
+		LinkID:  link.ID,
+		Version: int32(versionNumber),
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve link version", logging.Err(err))
+		http.Error(w, "Failed to roll back link", http.StatusInternalServerError)
+		return
+	}
+
+	err = lh.updateLink(r, user.UserID, link, db.UpdateLinkForWorkspaceParams{
+		DestinationUrl: version.DestinationUrl,
+		Title:          version.Title,
+		Notes:          version.Notes,
+		RedirectStatus: version.RedirectStatus,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to roll back link", logging.Err(err))
+		http.Error(w, "Failed to roll back link", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, linkPath(link.ShortCode, link.Hostname.String), http.StatusSeeOther)
+}
+
+// updateLink saves a new version of link, clears its cached destination and
+// records the change. arg's link and actor fields are filled in here.
+func (lh *LinkHandler) updateLink(r *http.Request, actorUserID int32, link db.GetLinkForWorkspaceRow, arg db.UpdateLinkForWorkspaceParams) error {
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+	ctx := context.Background()
+
+	arg.ID = link.ID
+	arg.WorkspaceID = membership.WorkspaceID
+	arg.UpdatedBy = actorUserID
+
+	updated, err := lh.queries.UpdateLinkForWorkspace(ctx, arg)
+	if err != nil {
+		return err
+	}
+
+	lh.redisClient.Del(ctx,
+		redirector.CacheKey(link.DomainID, link.ShortCode),
+		redirector.CacheKey(updated.DomainID, updated.ShortCode),
+	)
+
+	lh.auditLogger.Record(audit.Entry{
+		WorkspaceID: membership.WorkspaceID,
+		ActorUserID: actorUserID,
+		Action:      audit.ActionUpdate,
+		TargetType:  audit.TargetLink,
+		TargetID:    strconv.Itoa(int(link.ID)),
+		Before:      newLinkAuditState(link.ShortCode, link.DomainID, link.DestinationUrl, link.Title, link.Notes, link.RedirectStatus),
+		After:       newLinkAuditState(updated.ShortCode, updated.DomainID, updated.DestinationUrl, updated.Title, updated.Notes, updated.RedirectStatus),
+	}.WithRequest(r))
+
+	return nil
+}
+
+func (lh *LinkHandler) DeleteLink(w http.ResponseWriter, r *http.Request) {
+	session, _ := lh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+
+	if !membership.Can(workspaces.EditLinks) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	link, ok := lh.getLinkForWorkspace(w, r, membership.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	err := lh.queries.DeleteLinkForWorkspace(context.Background(), db.DeleteLinkForWorkspaceParams{
+		ID:          link.ID,
+		WorkspaceID: membership.WorkspaceID,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete link", logging.Err(err))
+		http.Error(w, "Failed to delete link", http.StatusInternalServerError)
+		return
+	}
+
+	lh.redisClient.Del(context.Background(), redirector.CacheKey(link.DomainID, link.ShortCode))
+
+	lh.auditLogger.Record(audit.Entry{
+		WorkspaceID: membership.WorkspaceID,
+		ActorUserID: user.UserID,
+		Action:      audit.ActionDelete,
+		TargetType:  audit.TargetLink,
+		TargetID:    strconv.Itoa(int(link.ID)),
+		Before:      newLinkAuditState(link.ShortCode, link.DomainID, link.DestinationUrl, link.Title, link.Notes, link.RedirectStatus),
+	}.WithRequest(r))
+
+	http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/links", http.StatusSeeOther)
+}
+
+func (lh *LinkHandler) LinkAudit(w http.ResponseWriter, r *http.Request) {
+	session, _ := lh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+
+	if !membership.Can(workspaces.ViewLinks) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	link, ok := lh.getLinkForWorkspace(w, r, membership.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	action := r.URL.Query().Get("action")
+	page := audit.Page(r)
+
+	// One extra row tells us whether there's a next page
+	rows, err := lh.queries.GetAuditLogForWorkspace(context.Background(), db.GetAuditLogForWorkspaceParams{
+		WorkspaceID: pgtype.Int4{Int32: membership.WorkspaceID, Valid: true},
+		Action:      pgtype.Text{String: action, Valid: action != ""},
+		TargetType:  pgtype.Text{String: audit.TargetLink, Valid: true},
+		TargetID:    pgtype.Text{String: strconv.Itoa(int(link.ID)), Valid: true},
+		Limit:       audit.PageSize + 1,
+		Offset:      int32((page - 1) * audit.PageSize),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve audit log", logging.Err(err))
+		http.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
+	}
+
+	hasNextPage := len(rows) > audit.PageSize
+	if hasNextPage {
+		rows = rows[:audit.PageSize]
+	}
+
+	data := map[string]interface{}{
+		"user":       user,
+		"membership": membership,
+		"heading":    fmt.Sprintf("History of %s", domains.ShortURL(link.Hostname.String, link.ShortCode)),
+		"backHref":   linkPath(link.ShortCode, link.Hostname.String),
+		"entries":    audit.ListItems(rows),
+		"actions":    []audit.Action{audit.ActionCreate, audit.ActionUpdate, audit.ActionDelete},
+		"filters": map[string]string{
+			"action": action,
+		},
+		"prevHref": audit.PageHref(r, page-1),
+		"nextHref": audit.PageHref(r, page+1),
+		"hasPrev":  page > 1,
+		"hasNext":  hasNextPage,
+	}
+
+	if err := lh.template.ExecuteTemplate(w, r, "audit.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (lh *LinkHandler) getLinkForWorkspace(w http.ResponseWriter, r *http.Request, workspaceID int32) (db.GetLinkForWorkspaceRow, bool) {
+	hostname := r.URL.Query().Get("domain")
+
+	link, err := lh.queries.GetLinkForWorkspace(context.Background(), db.GetLinkForWorkspaceParams{
+		WorkspaceID: workspaceID,
+		ShortCode:   mux.Vars(r)["shortcode"],
+		Hostname:    pgtype.Text{String: hostname, Valid: hostname != ""},
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return link, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve link", logging.Err(err))
+		http.Error(w, "Failed to retrieve link", http.StatusInternalServerError)
+		return link, false
+	}
+
+	return link, true
+}
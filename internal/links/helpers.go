@@ -4,30 +4,62 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/didoarellano/short/internal/auth"
 	"github.com/didoarellano/short/internal/config"
 	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
 	"github.com/didoarellano/short/internal/shortcode"
 	"github.com/didoarellano/short/internal/subscriptions"
 	"github.com/didoarellano/short/internal/templ"
+	"github.com/didoarellano/short/internal/tracing"
 	"github.com/gorilla/sessions"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"golang.org/x/net/html"
 )
 
 type FormData struct {
 	DestinationUrl  string
+	DomainID        int32
 	Slug            string
 	Title           string
 	Notes           string
 	CreateDuplicate bool
 }
 
+type RedirectStatus struct {
+	Code  int32
+	Label string
+}
+
+// RedirectStatuses are the HTTP statuses a link can redirect with. 303 is the
+// default for new links.
+var RedirectStatuses = []RedirectStatus{
+	{Code: http.StatusMovedPermanently, Label: "301 Moved Permanently"},
+	{Code: http.StatusFound, Label: "302 Found"},
+	{Code: http.StatusSeeOther, Label: "303 See Other"},
+	{Code: http.StatusTemporaryRedirect, Label: "307 Temporary Redirect"},
+	{Code: http.StatusPermanentRedirect, Label: "308 Permanent Redirect"},
+}
+
+func isValidRedirectStatus(code int32) bool {
+	for _, status := range RedirectStatuses {
+		if status.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
 type DuplicateUrl struct {
 	Text string
 	Href string
@@ -41,9 +73,10 @@ type DuplicateUrls struct {
 }
 
 type FormFieldValidation struct {
-	Message   string
-	Value     string
-	IsChecked bool
+	Message     string
+	Value       string
+	IsChecked   bool
+	Suggestions []string
 }
 
 type FormValidationErrors struct {
@@ -66,6 +99,7 @@ type ShowCreateFormParams struct {
 	userSubscription subscriptions.Subscription
 	linksCreated     int32
 	customSlugConfig *config.CustomSlugConfig
+	domains          []db.GetVerifiedDomainsForWorkspaceRow
 }
 
 func ShowCreateForm(arg ShowCreateFormParams) {
@@ -82,17 +116,52 @@ func ShowCreateForm(arg ShowCreateFormParams) {
 		"user":             arg.user,
 		"linksRemaining":   arg.userSubscription.MaxLinksPerMonth - arg.linksCreated,
 		"customSlugConfig": arg.customSlugConfig,
+		"domains":          arg.domains,
 	}
 	arg.session.Save(arg.r, arg.w)
-	if err := arg.template.ExecuteTemplate(arg.w, "create_link.html", data); err != nil {
+	if err := arg.template.ExecuteTemplate(arg.w, arg.r, "create_link.html", data); err != nil {
 		http.Error(arg.w, "Failed to render template", http.StatusInternalServerError)
 	}
 }
 
+// workspaceDomain looks up one of the workspace's verified domains, reporting
+// false if it isn't one. A domainID of 0 is the default domain.
+func workspaceDomain(queries *db.Queries, workspaceID, domainID int32) (pgtype.Int4, bool) {
+	if domainID == 0 {
+		return pgtype.Int4{}, true
+	}
+	domain, err := queries.GetDomainForWorkspace(context.Background(), db.GetDomainForWorkspaceParams{
+		ID:          domainID,
+		WorkspaceID: workspaceID,
+	})
+	if err != nil || !domain.VerifiedAt.Valid {
+		return pgtype.Int4{}, false
+	}
+	return pgtype.Int4{Int32: domain.ID, Valid: true}, true
+}
+
+// slugSuggestionTitle is what slugs are suggested from besides the slug
+// itself, the title or failing that the destination's site name.
+func slugSuggestionTitle(formData FormData) string {
+	if formData.Title != "" {
+		return formData.Title
+	}
+	host, err := formatUrlForTitle(formData.DestinationUrl)
+	if err != nil {
+		return ""
+	}
+	if i := strings.LastIndex(host, "."); i > 0 {
+		host = host[:i]
+	}
+	return host
+}
+
 func ParseCreateForm(r *http.Request) FormData {
 	r.ParseForm()
+	domainID, _ := strconv.ParseInt(r.FormValue("domain"), 10, 32)
 	formData := FormData{
 		DestinationUrl:  strings.TrimSpace(r.FormValue("url")),
+		DomainID:        int32(domainID),
 		Slug:            strings.TrimSpace(r.FormValue("slug")),
 		Title:           strings.TrimSpace(r.FormValue("title")),
 		Notes:           strings.TrimSpace(r.FormValue("notes")),
@@ -103,12 +172,14 @@ func ParseCreateForm(r *http.Request) FormData {
 
 type ValidateCreateFormParams struct {
 	queries          *db.Queries
-	userID           int32
+	workspaceID      int32
 	formData         FormData
 	userSubscription subscriptions.Subscription
 }
 
-func ValidateCreateForm(arg ValidateCreateFormParams) FormValidation {
+// ValidateCreateForm checks a new link's form. The error is for anything
+// that stopped it being checked, not for what's wrong with the form.
+func ValidateCreateForm(arg ValidateCreateFormParams) (FormValidation, error) {
 	formData := arg.formData
 
 	validation := FormValidation{
@@ -118,6 +189,9 @@ func ValidateCreateForm(arg ValidateCreateFormParams) FormValidation {
 				"Url": {
 					Value: formData.DestinationUrl,
 				},
+				"Domain": {
+					Value: strconv.Itoa(int(formData.DomainID)),
+				},
 				"Slug": {
 					Value: formData.Slug,
 				},
@@ -140,14 +214,23 @@ func ValidateCreateForm(arg ValidateCreateFormParams) FormValidation {
 			Value:   formData.DestinationUrl,
 			Message: "Destination URL is required",
 		}
-		return validation
+		return validation, nil
 	}
 
-	if formData.CreateDuplicate && !arg.userSubscription.CanCreateDuplicates {
+	domainID, ok := workspaceDomain(arg.queries, arg.workspaceID, formData.DomainID)
+	if !ok {
 		validation.IsValid = false
+		validation.Errors.FormFields["Domain"] = FormFieldValidation{
+			Message: "Choose one of your verified domains",
+		}
+		return validation, nil
 	}
 
-	if formData.Slug != "" && !arg.userSubscription.CanCustomiseSlug {
+	if formData.CreateDuplicate && !arg.userSubscription.Allows(subscriptions.DuplicateLinks) {
+		validation.IsValid = false
+	}
+
+	if formData.Slug != "" && !arg.userSubscription.Allows(subscriptions.CustomSlugs) {
 		validation.IsValid = false
 		validation.Errors.FormFields["Slug"] = FormFieldValidation{
 			Value:   formData.Slug,
@@ -155,7 +238,7 @@ func ValidateCreateForm(arg ValidateCreateFormParams) FormValidation {
 		}
 	}
 
-	if formData.Slug != "" && arg.userSubscription.CanCustomiseSlug {
+	if formData.Slug != "" && arg.userSubscription.Allows(subscriptions.CustomSlugs) {
 		customSlugConfig, _ := config.LoadCustomSlugConfig()
 		err := ValidateCustomSlug(formData.Slug, customSlugConfig)
 
@@ -166,19 +249,30 @@ func ValidateCreateForm(arg ValidateCreateFormParams) FormValidation {
 				Message: err.Error(),
 			}
 		} else {
-			link, err := arg.queries.GetLinkByShortCode(context.Background(), formData.Slug)
-			if err != pgx.ErrNoRows {
+			link, err := arg.queries.GetLinkByShortCode(context.Background(), db.GetLinkByShortCodeParams{
+				DomainID:  domainID,
+				ShortCode: formData.Slug,
+			})
+			if err != nil && err != pgx.ErrNoRows {
+				return validation, err
+			}
+			if err == nil {
+				suggestions, err := SuggestSlugs(context.Background(), arg.queries, domainID, formData.Slug, slugSuggestionTitle(formData))
+				if err != nil {
+					slog.Error("Failed to suggest slugs", logging.Err(err))
+				}
 				validation.IsValid = false
 				validation.Errors.FormFields["Slug"] = FormFieldValidation{
-					Value:   formData.Slug,
-					Message: fmt.Sprintf("%s is already in use", formData.Slug),
+					Value:       formData.Slug,
+					Message:     fmt.Sprintf("%s is already in use", formData.Slug),
+					Suggestions: suggestions,
 				}
 
-				if link.UserID == arg.userID {
+				if link.WorkspaceID == arg.workspaceID {
 					validation.Errors.Duplicates = DuplicateUrls{
 						Urls: []DuplicateUrl{{
 							Text: link.ShortCode,
-							Href: fmt.Sprintf("/%s/links/%s", config.AppData.AppPathPrefix, link.ShortCode),
+							Href: linkPath(link.ShortCode, link.Hostname.String),
 						}},
 						Message: "You've used this slug before",
 					}
@@ -189,13 +283,13 @@ func ValidateCreateForm(arg ValidateCreateFormParams) FormValidation {
 
 	if !formData.CreateDuplicate {
 		links, _ := arg.queries.FindDuplicatesForUrl(context.Background(), db.FindDuplicatesForUrlParams{
-			UserID:         arg.userID,
+			WorkspaceID:    arg.workspaceID,
 			DestinationUrl: formData.DestinationUrl,
 			Limit:          3,
 		})
 
 		if len(links.ShortCodes) > 0 {
-			duplicates := findDuplicateLinks(arg.queries, arg.userID, formData.DestinationUrl)
+			duplicates := findDuplicateLinks(arg.queries, arg.workspaceID, formData.DestinationUrl)
 			if duplicates != nil {
 				validation.IsValid = false
 				validation.Errors.Duplicates = *duplicates
@@ -204,12 +298,12 @@ func ValidateCreateForm(arg ValidateCreateFormParams) FormValidation {
 		}
 	}
 
-	return validation
+	return validation, nil
 }
 
-func findDuplicateLinks(queries *db.Queries, userID int32, destinationUrl string) *DuplicateUrls {
+func findDuplicateLinks(queries *db.Queries, workspaceID int32, destinationUrl string) *DuplicateUrls {
 	links, _ := queries.FindDuplicatesForUrl(context.Background(), db.FindDuplicatesForUrlParams{
-		UserID:         userID,
+		WorkspaceID:    workspaceID,
 		DestinationUrl: destinationUrl,
 		Limit:          3,
 	})
@@ -223,9 +317,9 @@ func findDuplicateLinks(queries *db.Queries, userID int32, destinationUrl string
 		RemainingCount: links.RemainingCount,
 	}
 
-	for _, shortcode := range links.ShortCodes {
+	for i, shortcode := range links.ShortCodes {
 		duplicates.Urls = append(duplicates.Urls, DuplicateUrl{
-			Href: fmt.Sprintf("/%s/links/%s", config.AppData.AppPathPrefix, shortcode),
+			Href: linkPath(shortcode, links.Hostnames[i]),
 			Text: shortcode,
 		})
 	}
@@ -233,8 +327,33 @@ func findDuplicateLinks(queries *db.Queries, userID int32, destinationUrl string
 	return duplicates
 }
 
-func getPageTitle(url string) (string, error) {
-	resp, err := http.Get(url)
+// linkPath is the app path of a link's page. Links on custom domains are
+// identified by hostname as short codes are only unique per domain.
+func linkPath(shortCode, hostname string) string {
+	return linkActionPath(shortCode, hostname, "")
+}
+
+// linkActionPath is the app path of one of a link's subpages, e.g. "edit".
+func linkActionPath(shortCode, hostname, action string) string {
+	path := fmt.Sprintf("/%s/links/%s", config.AppData.AppPathPrefix, shortCode)
+	if action != "" {
+		path += "/" + action
+	}
+	if hostname != "" {
+		path += "?domain=" + url.QueryEscape(hostname)
+	}
+	return path
+}
+
+func getPageTitle(ctx context.Context, url string) (title string, err error) {
+	ctx, span := tracing.Start(ctx, "getPageTitle", semconv.URLFull(url))
+	defer func() { tracing.End(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch the URL: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch the URL: %w", err)
 	}
@@ -263,7 +382,7 @@ func getPageTitle(url string) (string, error) {
 		return ""
 	}
 
-	title := traverse(doc)
+	title = traverse(doc)
 	if title == "" {
 		return "", fmt.Errorf("no title element found")
 	}
@@ -286,17 +405,24 @@ func formatUrlForTitle(rawUrl string) (string, error) {
 	return host, nil
 }
 
-func SaveNewLink(queries *db.Queries, userID int32, formData FormData) (db.Link, error) {
-	var shortCode string
-	if formData.Slug != "" {
-		shortCode = formData.Slug
-	} else {
-		shortCode = shortcode.New(userID, formData.DestinationUrl, 7)
-	}
+var (
+	ErrQuotaExceeded = errors.New("monthly link quota reached")
+	ErrSlugTaken     = errors.New("slug already in use")
+)
 
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// SaveNewLink creates a link and counts it against the workspace's monthly
+// quota in one transaction, so the link is only saved if the quota allows it.
+// Generated short codes are retried if they're taken, custom slugs aren't.
+// It returns the workspace's new count of links created this cycle.
+func SaveNewLink(ctx context.Context, pool *pgxpool.Pool, queries *db.Queries, generator shortcode.Generator, workspaceID, userID int32, formData FormData) (db.CreateLinkRow, db.ConsumeLinkQuotaRow, error) {
 	title := formData.Title
 	if title == "" {
-		tempTitle, err := getPageTitle(formData.DestinationUrl)
+		tempTitle, err := getPageTitle(ctx, formData.DestinationUrl)
 		if err != nil {
 			tempTitle, _ = formatUrlForTitle(formData.DestinationUrl)
 		}
@@ -309,13 +435,65 @@ func SaveNewLink(queries *db.Queries, userID int32, formData FormData) (db.Link,
 		title = tempTitle
 	}
 
-	return queries.CreateLink(context.Background(), db.CreateLinkParams{
-		UserID:         userID,
-		ShortCode:      shortCode,
-		DestinationUrl: formData.DestinationUrl,
-		Title:          pgtype.Text{String: title, Valid: true},
-		Notes:          pgtype.Text{String: formData.Notes, Valid: true},
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return db.CreateLinkRow{}, db.ConsumeLinkQuotaRow{}, err
+	}
+	defer tx.Rollback(ctx)
+	qtx := queries.WithTx(tx)
+
+	if err := qtx.EnsureCurrentUsageCycle(ctx, workspaceID); err != nil {
+		return db.CreateLinkRow{}, db.ConsumeLinkQuotaRow{}, err
+	}
+	usage, err := qtx.ConsumeLinkQuota(ctx, workspaceID)
+	if err == pgx.ErrNoRows {
+		return db.CreateLinkRow{}, db.ConsumeLinkQuotaRow{}, ErrQuotaExceeded
+	}
+	if err != nil {
+		return db.CreateLinkRow{}, db.ConsumeLinkQuotaRow{}, err
+	}
+
+	// Each attempt gets a savepoint as a unique violation would otherwise
+	// abort the whole transaction
+	var link db.CreateLinkRow
+	store := shortcode.StoreFunc(func(ctx context.Context, code string) error {
+		savepoint, err := tx.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer savepoint.Rollback(ctx)
+
+		link, err = queries.WithTx(savepoint).CreateLink(ctx, db.CreateLinkParams{
+			WorkspaceID:    workspaceID,
+			UserID:         userID,
+			DomainID:       pgtype.Int4{Int32: formData.DomainID, Valid: formData.DomainID != 0},
+			ShortCode:      code,
+			DestinationUrl: formData.DestinationUrl,
+			Title:          pgtype.Text{String: title, Valid: true},
+			Notes:          pgtype.Text{String: formData.Notes, Valid: true},
+		})
+		if isUniqueViolation(err) {
+			return shortcode.ErrCollision
+		}
+		if err != nil {
+			return err
+		}
+		return savepoint.Commit(ctx)
 	})
+
+	if formData.Slug != "" {
+		err = store.Claim(ctx, formData.Slug)
+		if err == shortcode.ErrCollision {
+			err = ErrSlugTaken
+		}
+	} else {
+		_, err = generator.Create(ctx, userID, formData.DestinationUrl, store)
+	}
+	if err != nil {
+		return db.CreateLinkRow{}, db.ConsumeLinkQuotaRow{}, err
+	}
+
+	return link, usage, tx.Commit(ctx)
 }
 
 func ValidateCustomSlug(slug string, config *config.CustomSlugConfig) error {
@@ -324,10 +502,16 @@ func ValidateCustomSlug(slug string, config *config.CustomSlugConfig) error {
 		return fmt.Errorf("slug must be between %d and %d characters", config.MinLength, config.MaxLength)
 	}
 
-	for _, word := range config.ReservedWords {
-		if strings.EqualFold(slug, word) {
-			return errors.New("slug is reserved")
-		}
+	if !config.AllowsCharacters(slug) {
+		return errors.New("slug contains characters that aren't allowed")
+	}
+
+	if config.IsReserved(slug) {
+		return errors.New("slug is reserved")
+	}
+
+	if config.ContainsBlockedWord(slug) {
+		return errors.New("slug isn't allowed")
 	}
 
 	return nil
@@ -0,0 +1,125 @@
+package links
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/shortcode"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Needs a database with migrations/schema.sql and migrations/seed.sql
+// applied, e.g. TEST_DATABASE_URL=$DEV_HOST_DB_URL
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	pool, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestSaveNewLinkEnforcesQuotaConcurrently(t *testing.T) {
+	pool := testPool(t)
+	queries := db.New(pool)
+	ctx := context.Background()
+
+	user, err := queries.CreateUser(ctx, db.CreateUserParams{
+		Name:          pgtype.Text{String: "Quota Test", Valid: true},
+		Email:         fmt.Sprintf("quota-%d@example.com", time.Now().UnixNano()),
+		EmailVerified: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.Exec(ctx, "DELETE FROM users WHERE id = $1", user.ID)
+	})
+
+	workspaceID, err := queries.CreateWorkspace(ctx, db.CreateWorkspaceParams{Name: "Quota Test", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.Exec(ctx, "DELETE FROM workspaces WHERE id = $1", workspaceID)
+	})
+
+	subscription, err := queries.AddBasicSubscription(ctx, workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := int(subscription.MaxLinksPerMonth)
+
+	attempts := limit + 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	saved, rejected := 0, 0
+	for i := range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := SaveNewLink(ctx, pool, queries, shortcode.NewHashGenerator(shortcode.Base32Alphabet, 7), workspaceID, user.ID, FormData{
+				DestinationUrl: fmt.Sprintf("https://example.com/%d", i),
+				Title:          "Quota test",
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				saved++
+			case ErrQuotaExceeded:
+				rejected++
+			default:
+				t.Errorf("SaveNewLink() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if saved != limit || rejected != attempts-limit {
+		t.Errorf("saved %d and rejected %d links, want %d and %d", saved, rejected, limit, attempts-limit)
+	}
+
+	usage, err := queries.GetWorkspaceCurrentUsage(ctx, workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var links int
+	pool.QueryRow(ctx, "SELECT count(*) FROM links WHERE workspace_id = $1", workspaceID).Scan(&links)
+	if int(usage.LinksCreated) != limit || links != limit {
+		t.Errorf("usage = %d and links = %d, want both %d", usage.LinksCreated, links, limit)
+	}
+
+	// Once the cycle has ended the quota is back without waiting for the
+	// reset job
+	_, err = pool.Exec(ctx, `UPDATE user_monthly_usage
+		SET created_at = CURRENT_DATE - INTERVAL '1 month',
+		    cycle_start_date = CURRENT_DATE - INTERVAL '1 month',
+		    cycle_end_date = CURRENT_DATE
+		WHERE workspace_id = $1`, workspaceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, usage2, err := SaveNewLink(ctx, pool, queries, shortcode.NewHashGenerator(shortcode.Base32Alphabet, 7), workspaceID, user.ID, FormData{
+		DestinationUrl: "https://example.com/next-cycle",
+		Title:          "Quota test",
+	})
+	if err != nil {
+		t.Fatalf("SaveNewLink() after the cycle ended error = %v", err)
+	}
+	if usage2.LinksCreated != 1 {
+		t.Errorf("usage after the cycle ended = %d, want 1", usage2.LinksCreated)
+	}
+}
@@ -0,0 +1,192 @@
+package links
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/jackc/pgx/v5/pgtype"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const maxSlugSuggestions = 5
+
+// Left out of slugs made from page titles
+var slugStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "at": true, "by": true, "for": true,
+	"in": true, "is": true, "of": true, "on": true, "or": true, "the": true,
+	"to": true, "with": true, "www": true,
+}
+
+type SlugAvailability struct {
+	Slug        string   `json:"slug"`
+	Available   bool     `json:"available"`
+	Message     string   `json:"message,omitempty"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// CheckSlug reports whether slug can be used on the domain and, if it can't,
+// suggests some that can. Slugs are compared ignoring case.
+func CheckSlug(ctx context.Context, queries *db.Queries, domainID pgtype.Int4, slug, title string) (SlugAvailability, error) {
+	customSlugConfig, _ := config.LoadCustomSlugConfig()
+	availability := SlugAvailability{Slug: slug, Available: true}
+
+	if err := ValidateCustomSlug(slug, customSlugConfig); err != nil {
+		availability.Available = false
+		availability.Message = err.Error()
+	} else {
+		taken, err := queries.GetTakenSlugs(ctx, db.GetTakenSlugsParams{
+			DomainID: domainID,
+			Slugs:    []string{strings.ToLower(slug)},
+		})
+		if err != nil {
+			return availability, err
+		}
+		if len(taken) > 0 {
+			availability.Available = false
+			availability.Message = fmt.Sprintf("%s is already in use", slug)
+		}
+	}
+
+	if availability.Available {
+		return availability, nil
+	}
+
+	suggestions, err := SuggestSlugs(ctx, queries, domainID, slug, title)
+	availability.Suggestions = suggestions
+	return availability, err
+}
+
+// SuggestSlugs proposes available slugs like slug, or made from title when
+// slug doesn't give enough.
+func SuggestSlugs(ctx context.Context, queries *db.Queries, domainID pgtype.Int4, slug, title string) ([]string, error) {
+	customSlugConfig, _ := config.LoadCustomSlugConfig()
+	candidates := slugCandidates(slug, title, customSlugConfig)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	taken, err := queries.GetTakenSlugs(ctx, db.GetTakenSlugsParams{
+		DomainID: domainID,
+		Slugs:    candidates,
+	})
+	if err != nil {
+		return nil, err
+	}
+	isTaken := make(map[string]bool, len(taken))
+	for _, t := range taken {
+		isTaken[t] = true
+	}
+
+	suggestions := make([]string, 0, maxSlugSuggestions)
+	for _, c := range candidates {
+		if !isTaken[c] {
+			suggestions = append(suggestions, c)
+		}
+		if len(suggestions) == maxSlugSuggestions {
+			break
+		}
+	}
+	return suggestions, nil
+}
+
+// slugCandidates lists possible slugs, best first: slug hyphenated into its
+// words, then with words from the title, then numbered. Every one is
+// lowercase, different from slug and passes ValidateCustomSlug.
+func slugCandidates(slug, title string, customSlugConfig *config.CustomSlugConfig) []string {
+	words := slugWords(slug)
+	var titleWords []string
+	for _, w := range slugWords(title) {
+		if !slugStopWords[w] {
+			titleWords = append(titleWords, w)
+		}
+	}
+
+	var candidates []string
+	seen := map[string]bool{strings.ToLower(slug): true}
+	add := func(c string) {
+		if c == "" || seen[c] || ValidateCustomSlug(c, customSlugConfig) != nil {
+			return
+		}
+		seen[c] = true
+		candidates = append(candidates, c)
+	}
+
+	base := strings.Join(words, "-")
+	add(base)
+	add(strings.Join(words, ""))
+
+	// The title's opening words, as many as fit
+	for n := 1; n <= len(titleWords) && n <= 4; n++ {
+		add(strings.Join(titleWords[:n], "-"))
+	}
+	if base != "" {
+		for _, w := range titleWords {
+			if len(candidates) >= 3*maxSlugSuggestions {
+				break
+			}
+			add(base + "-" + w)
+			add(w + "-" + base)
+		}
+	}
+
+	if base == "" && len(titleWords) > 0 {
+		base = titleWords[0]
+	}
+	for i := 2; base != "" && i <= 9; i++ {
+		suffix := strconv.Itoa(i)
+		add(base + "-" + suffix)
+		add(base + suffix)
+	}
+
+	return candidates
+}
+
+// slugWords splits s into lowercase words of letters and digits, breaking
+// on anything else, between letters and digits and at camelCase humps.
+// Words with letters that have no plain ASCII form are left out whole.
+func slugWords(s string) []string {
+	// Accents are dropped so café becomes cafe
+	stripAccents := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	if stripped, _, err := transform.String(stripAccents, s); err == nil {
+		s = stripped
+	}
+
+	var words []string
+	var word []rune
+	foreign := false
+	flush := func() {
+		if len(word) > 0 && !foreign {
+			words = append(words, strings.ToLower(string(word)))
+		}
+		word = word[:0]
+		foreign = false
+	}
+
+	var prev rune
+	for _, r := range s {
+		isLetter := unicode.IsLetter(r)
+		isDigit := r < unicode.MaxASCII && unicode.IsDigit(r)
+		switch {
+		case !isLetter && !isDigit:
+			flush()
+		case len(word) > 0 && unicode.IsDigit(prev) != isDigit:
+			flush()
+		case len(word) > 0 && unicode.IsLower(prev) && unicode.IsUpper(r):
+			flush()
+		}
+		if isLetter || isDigit {
+			word = append(word, r)
+			foreign = foreign || r >= unicode.MaxASCII
+		}
+		prev = r
+	}
+	flush()
+	return words
+}
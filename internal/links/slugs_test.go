@@ -0,0 +1,48 @@
+package links
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/didoarellano/short/internal/config"
+)
+
+func TestSlugWords(t *testing.T) {
+	tests := map[string][]string{
+		"SummerSale2025":        {"summer", "sale", "2025"},
+		"summer_sale":           {"summer", "sale"},
+		"The Best Café in Town": {"the", "best", "cafe", "in", "town"},
+		"Crème Brûlée Straße":   {"creme", "brulee"},
+		"--":                    nil,
+	}
+	for s, want := range tests {
+		if got := slugWords(s); !slices.Equal(got, want) {
+			t.Errorf("slugWords(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestSlugCandidates(t *testing.T) {
+	customSlugConfig := &config.CustomSlugConfig{
+		MinLength:     4,
+		MaxLength:     12,
+		ReservedWords: []string{"promo-sale"},
+	}
+	candidates := slugCandidates("PromoSale", "The Spring Promo Sale of the Year", customSlugConfig)
+
+	if len(candidates) == 0 || candidates[0] != "spring" {
+		t.Errorf("Expected suggestions to start with title words, got %v", candidates)
+	}
+	for _, c := range candidates {
+		if strings.EqualFold(c, "PromoSale") || c == "promo-sale" {
+			t.Errorf("Expected %q to be left out", c)
+		}
+		if c != strings.ToLower(c) || len(c) < 4 || len(c) > 12 {
+			t.Errorf("Expected lowercase slugs of 4 to 12 characters, got %q", c)
+		}
+	}
+	if !slices.Contains(candidates, "promo-sale-2") {
+		t.Errorf("Expected a numbered suggestion, got %v", candidates)
+	}
+}
@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDIsLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)})
+
+	tests := []struct {
+		header string
+		keep   bool
+	}{
+		{header: "abc-123", keep: true},
+		{header: ""},
+		{header: "no spaces allowed"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		var seen string
+		handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = RequestID(r.Context())
+			logger.InfoContext(r.Context(), "Handled")
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(RequestIDHeader, tt.header)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if seen == "" || (seen == tt.header) != tt.keep {
+			t.Errorf("Request ID for %q = %q", tt.header, seen)
+		}
+		if got := rec.Header().Get(RequestIDHeader); got != seen {
+			t.Errorf("Expected response header %q, got %q", seen, got)
+		}
+		var entry map[string]any
+		json.Unmarshal(buf.Bytes(), &entry)
+		if entry["request_id"] != seen {
+			t.Errorf("Expected request_id %q in log, got %v", seen, entry["request_id"])
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogMailerWritesFile(t *testing.T) {
+	dir := t.TempDir()
+	m := NewLogMailer(dir)
+
+	err := m.Send(context.Background(), Message{
+		To:      "someone@example.com",
+		Subject: "Hello",
+		Body:    "line one\nline two",
+	})
+	if err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("got %d files, want 1", len(entries))
+	}
+	if !strings.HasSuffix(entries[0].Name(), "someone@example.com.eml") {
+		t.Errorf("unexpected file name %s", entries[0].Name())
+	}
+
+	b, _ := os.ReadFile(dir + "/" + entries[0].Name())
+	content := string(b)
+	for _, want := range []string{"To: someone@example.com\r\n", "Subject: Hello\r\n", "\r\n\r\nline one\r\nline two"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("message missing %q:\n%s", want, content)
+		}
+	}
+}
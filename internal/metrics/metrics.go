@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "short_http_requests_total",
+		Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "short_http_request_duration_seconds",
+		Help:    "How long HTTP requests took by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// RedirectCache counts redirect lookups by result: hit, miss, negative,
+	// when the short code is cached as not found, error or fallback, when
+	// Redis failed but the link was held in memory.
+	RedirectCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "short_redirect_cache_lookups_total",
+		Help: "Redirect cache lookups by result.",
+	}, []string{"result"})
+
+	VisitsPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "short_visits_pending",
+		Help: "Visits waiting to be recorded.",
+	})
+
+	VisitFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "short_visit_record_failures_total",
+		Help: "Visits that couldn't be recorded.",
+	})
+
+	GeoDataDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "short_geodata_lookup_duration_seconds",
+		Help:    "How long looking up visitors' locations took.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	GeoDataErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "short_geodata_lookup_errors_total",
+		Help: "Failed lookups of visitors' locations.",
+	})
+
+	// LinksCreated counts new links by the workspace's plan.
+	LinksCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "short_links_created_total",
+		Help: "Links created by plan.",
+	}, []string{"plan"})
+
+	// JobRuns counts scheduled job runs by job and result: success or
+	// error.
+	JobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "short_job_runs_total",
+		Help: "Scheduled job runs by job and result.",
+	}, []string{"job", "result"})
+
+	JobProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "short_job_processed_total",
+		Help: "Things processed by scheduled jobs.",
+	}, []string{"job"})
+
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "short_job_duration_seconds",
+		Help:    "How long scheduled job runs took.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"job"})
+
+	// JobLastSuccess is when each job last finished without an error, as a
+	// Unix timestamp, for alerting on jobs that have stopped running.
+	JobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "short_job_last_success_timestamp_seconds",
+		Help: "When each scheduled job last succeeded.",
+	}, []string{"job"})
+
+	// RateLimited counts requests refused for going over the named limit.
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "short_rate_limited_requests_total",
+		Help: "Requests refused by rate limit.",
+	}, []string{"limit"})
+)
+
+// Handler serves the metrics for Prometheus to scrape. It shouldn't be
+// reachable from the internet.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Middleware counts and times requests by the route they matched, so paths
+// with short codes or IDs in them share a series.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		started := time.Now()
+		next.ServeHTTP(recorder, r)
+
+		requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(started).Seconds())
+		requests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+	})
+}
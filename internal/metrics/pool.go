@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	poolAcquiredConns = prometheus.NewDesc("short_db_pool_acquired_conns", "Connections in use.", nil, nil)
+	poolIdleConns     = prometheus.NewDesc("short_db_pool_idle_conns", "Connections waiting to be used.", nil, nil)
+	poolTotalConns    = prometheus.NewDesc("short_db_pool_total_conns", "Connections open.", nil, nil)
+	poolMaxConns      = prometheus.NewDesc("short_db_pool_max_conns", "Most connections the pool will open.", nil, nil)
+	poolAcquires      = prometheus.NewDesc("short_db_pool_acquires_total", "Connections handed out.", nil, nil)
+	poolEmptyAcquires = prometheus.NewDesc("short_db_pool_empty_acquires_total", "Connections handed out after waiting for one to free up or open.", nil, nil)
+	poolAcquireWait   = prometheus.NewDesc("short_db_pool_acquire_seconds_total", "Time spent waiting for connections.", nil, nil)
+)
+
+type poolCollector struct {
+	pool *pgxpool.Pool
+}
+
+// RegisterPool reports pool's stats with the other metrics.
+func RegisterPool(pool *pgxpool.Pool) {
+	prometheus.MustRegister(&poolCollector{pool: pool})
+}
+
+func (pc *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredConns
+	ch <- poolIdleConns
+	ch <- poolTotalConns
+	ch <- poolMaxConns
+	ch <- poolAcquires
+	ch <- poolEmptyAcquires
+	ch <- poolAcquireWait
+}
+
+func (pc *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := pc.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMaxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquires, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireWait, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/breaker"
+	"github.com/didoarellano/short/internal/clientip"
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/metrics"
+	"github.com/didoarellano/short/internal/session"
+	"github.com/didoarellano/short/internal/subscriptions"
+	"github.com/go-redis/redis/v8"
+)
+
+// Result is what a client has left of a limit after a request.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// How long until the oldest request counted leaves the window, which is
+	// when a client that's been refused can try again
+	Reset time.Duration
+}
+
+// Store counts requests in a sliding window shared by every instance of
+// the app.
+type Store interface {
+	// Hit counts a request against key unless limit requests have already
+	// been made in the window before now.
+	Hit(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (Result, error)
+}
+
+// KeyFunc says who a request counts against.
+type KeyFunc func(r *http.Request) string
+
+// ByIP counts requests against the client's address.
+func ByIP(r *http.Request) string {
+	return "ip:" + clientip.FromRequest(r)
+}
+
+// ByUser counts requests against the signed in user, or the client's
+// address without one.
+func ByUser(sessionStore session.SessionStore) KeyFunc {
+	return func(r *http.Request) string {
+		s, _ := sessionStore.Get(r, "session")
+		if user, ok := s.Values["user"].(auth.UserSession); ok {
+			return fmt.Sprintf("user:%d", user.UserID)
+		}
+		return ByIP(r)
+	}
+}
+
+const (
+	// Limits are checked before redirects, so a slow Redis mustn't hold
+	// them up for long
+	hitTimeout = 100 * time.Millisecond
+	// A failing store is left alone for this long before it's tried again
+	storeCooldown = 10 * time.Second
+)
+
+type Limiter struct {
+	store   Store
+	breaker *breaker.Breaker
+	rules   config.RateLimitConfig
+	now     func() time.Time
+}
+
+func New(r *redis.Client, rules config.RateLimitConfig) *Limiter {
+	return newLimiter(&RedisStore{redisClient: r}, rules)
+}
+
+func newLimiter(s Store, rules config.RateLimitConfig) *Limiter {
+	return &Limiter{
+		store:   s,
+		breaker: breaker.New(5, storeCooldown),
+		rules:   rules,
+		now:     time.Now,
+	}
+}
+
+// hit counts a request in the store unless it's been failing, giving it
+// hitTimeout to answer.
+func (l *Limiter) hit(ctx context.Context, key string, limit int, window time.Duration) (Result, error) {
+	var result Result
+	err := l.breaker.Do(func() error {
+		ctx, cancel := context.WithTimeout(ctx, hitTimeout)
+		defer cancel()
+		var err error
+		result, err = l.store.Hit(ctx, key, limit, window, l.now())
+		return err
+	}, func(err error) bool {
+		return !errors.Is(err, context.Canceled)
+	})
+	return result, err
+}
+
+// limitFunc is how many requests r's client can make per window, or not ok
+// if it can't be told and r shouldn't be limited.
+type limitFunc func(r *http.Request) (limit int, window time.Duration, ok bool)
+
+// defaultAPIRequestsPerMinute applies to plans without an
+// api_requests_per_minute entitlement, so one left out of plan_entitlements
+// doesn't lock the plan out of the API
+const defaultAPIRequestsPerMinute = 30
+
+// Middleware refuses requests over the named limit with 429 Too Many
+// Requests. Limits can differ by plan for routes behind
+// UserSubscriptionMiddleware.
+func (l *Limiter) Middleware(name string, key KeyFunc) func(next http.Handler) http.Handler {
+	rule, ok := l.rules[name]
+	if !ok {
+		panic(fmt.Sprintf("ratelimit: no %q rate limit configured", name))
+	}
+	return l.limit(name, key, false, func(r *http.Request) (int, time.Duration, bool) {
+		var plan string
+		if subscriptionContext, ok := r.Context().Value(subscriptions.SubscriptionKey).(subscriptions.UserSubscriptionContext); ok {
+			plan = subscriptionContext.Subscription.Name
+		}
+		return rule.For(plan), rule.Per(), true
+	})
+}
+
+// API limits requests to the workspace plan's APIRequestsPerMinute, and
+// tells clients where they stand on every response with RateLimit-*
+// headers. It needs UserSubscriptionMiddleware to have run. Requests are let
+// through when the workspace's subscription couldn't be loaded, the same as
+// when the limits can't be checked.
+func (l *Limiter) API(key KeyFunc) func(next http.Handler) http.Handler {
+	return l.limit("api", key, true, func(r *http.Request) (int, time.Duration, bool) {
+		subscriptionContext, ok := r.Context().Value(subscriptions.SubscriptionKey).(subscriptions.UserSubscriptionContext)
+		if !ok || subscriptionContext.Subscription.Name == "" {
+			return 0, 0, false
+		}
+		limit := int(subscriptionContext.Subscription.Limit(subscriptions.APIRequestsPerMinute))
+		if limit <= 0 {
+			limit = defaultAPIRequestsPerMinute
+		}
+		return limit, time.Minute, true
+	})
+}
+
+func (l *Limiter) limit(name string, key KeyFunc, headers bool, limitFor limitFunc) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit, window, ok := limitFor(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			k := fmt.Sprintf("ratelimit:%s:%s", name, key(r))
+			result, err := l.hit(r.Context(), k, limit, window)
+			// Requests are let through rather than refused when the limits
+			// can't be checked
+			if err != nil {
+				if !errors.Is(err, context.Canceled) && !errors.Is(err, breaker.ErrOpen) {
+					slog.ErrorContext(r.Context(), "Failed to check rate limit", slog.String("limit", name), logging.Err(err))
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reset := strconv.Itoa(int(math.Ceil(result.Reset.Seconds())))
+			if headers {
+				w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+				w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+				w.Header().Set("RateLimit-Reset", reset)
+			}
+			if !result.Allowed {
+				metrics.RateLimited.WithLabelValues(name).Inc()
+				w.Header().Set("Retry-After", reset)
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
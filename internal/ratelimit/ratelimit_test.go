@@ -0,0 +1,196 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/subscriptions"
+)
+
+// memoryStore keeps each key's requests in memory.
+type memoryStore map[string][]time.Time
+
+func (m memoryStore) Hit(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (Result, error) {
+	var kept []time.Time
+	for _, t := range m[key] {
+		if now.Sub(t) < window {
+			kept = append(kept, t)
+		}
+	}
+	allowed := len(kept) < limit
+	if allowed {
+		kept = append(kept, now)
+	}
+	m[key] = kept
+	return Result{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: limit - len(kept),
+		Reset:     kept[0].Add(window).Sub(now),
+	}, nil
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := newLimiter(memoryStore{}, config.RateLimitConfig{})
+	l.now = func() time.Time { return now }
+	handler := l.API(ByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remoteAddr string, limit int32) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		r = r.WithContext(context.WithValue(r.Context(), subscriptions.SubscriptionKey, subscriptions.UserSubscriptionContext{
+			Subscription: subscriptions.Subscription{
+				Name:         "pro1",
+				Entitlements: subscriptions.Entitlements{subscriptions.APIRequestsPerMinute: limit},
+			},
+		}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("203.0.113.1:1", 2); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be allowed, got %d", i+1, w.Code)
+		}
+	}
+	w := request("203.0.113.1:1", 2)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected headers %v", w.Header())
+	}
+
+	if w := request("203.0.113.2:1", 2); w.Code != http.StatusOK {
+		t.Errorf("Expected other clients to be allowed, got %d", w.Code)
+	}
+	if w := request("203.0.113.3:1", 3); w.Header().Get("RateLimit-Limit") != "3" {
+		t.Errorf("Expected the plan's limit, got %q", w.Header().Get("RateLimit-Limit"))
+	}
+
+	now = now.Add(time.Minute)
+	if w := request("203.0.113.1:1", 2); w.Code != http.StatusOK {
+		t.Errorf("Expected requests to be allowed once the window's passed, got %d", w.Code)
+	}
+}
+
+func TestAPIDefaultsMissingEntitlements(t *testing.T) {
+	l := newLimiter(memoryStore{}, config.RateLimitConfig{})
+	handler := l.API(ByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, entitlements := range []subscriptions.Entitlements{nil, {subscriptions.APIRequestsPerMinute: 0}} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), subscriptions.SubscriptionKey, subscriptions.UserSubscriptionContext{
+			Subscription: subscriptions.Subscription{Name: "basic", Entitlements: entitlements},
+		}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected %v to be allowed, got %d", entitlements, w.Code)
+		}
+		if got, want := w.Header().Get("RateLimit-Limit"), strconv.Itoa(defaultAPIRequestsPerMinute); got != want {
+			t.Errorf("Expected the default limit %s for %v, got %q", want, entitlements, got)
+		}
+	}
+}
+
+func TestAPILetsRequestsThroughWithoutASubscription(t *testing.T) {
+	l := newLimiter(memoryStore{}, config.RateLimitConfig{})
+	handler := l.API(ByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+	}{
+		{"no subscription context", context.Background()},
+		{"subscription failed to load", context.WithValue(context.Background(), subscriptions.SubscriptionKey, subscriptions.UserSubscriptionContext{})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil).WithContext(tt.ctx)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected the request to be allowed, got %d", w.Code)
+			}
+			if w.Header().Get("RateLimit-Limit") != "" {
+				t.Errorf("Expected no rate limit headers, got %v", w.Header())
+			}
+		})
+	}
+}
+
+func TestMiddlewareUsesPlanLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rate-limits.json")
+	os.WriteFile(path, []byte(`{"create_link": {"requests": 1, "window": "1m", "plans": {"pro1": 2}}}`), 0644)
+	t.Setenv("RATE_LIMIT_CONFIG", path)
+	rules, err := config.LoadRateLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(memoryStore{}, rules)
+	handler := l.Middleware("create_link", ByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	allowed := 0
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("POST", "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), subscriptions.SubscriptionKey, subscriptions.UserSubscriptionContext{
+			Subscription: subscriptions.Subscription{Name: "pro1"},
+		}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code == http.StatusOK {
+			allowed++
+		}
+		if w.Header().Get("RateLimit-Limit") != "" {
+			t.Error("Expected no rate limit headers outside the API")
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("Expected the plan's 2 requests to be allowed, got %d", allowed)
+	}
+}
+
+// slowStore takes as long as it's allowed to and then fails.
+type slowStore struct {
+	calls int
+}
+
+func (s *slowStore) Hit(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (Result, error) {
+	s.calls++
+	<-ctx.Done()
+	return Result{}, ctx.Err()
+}
+
+func TestLimiterLetsRequestsThroughWhenTheStoreFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rate-limits.json")
+	os.WriteFile(path, []byte(`{"redirect": {"requests": 1, "window": "1m"}}`), 0644)
+	t.Setenv("RATE_LIMIT_CONFIG", path)
+	rules, err := config.LoadRateLimitConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &slowStore{}
+	l := newLimiter(store, rules)
+	handler := l.Middleware("redirect", ByIP)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be let through, got %d", i+1, w.Code)
+		}
+	}
+	if store.calls != l.breaker.Threshold {
+		t.Errorf("Expected the store to be left alone after %d failures, got %d calls", l.breaker.Threshold, store.calls)
+	}
+}
@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Each key is a sorted set of the requests in the window, scored by when
+// they were made in milliseconds. Old requests are dropped, then the new one
+// is added if there's room. Returns whether it was, how many requests are
+// left and how long until the oldest one leaves the window.
+var hitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+  redis.call('ZADD', KEYS[1], now, ARGV[4])
+  redis.call('PEXPIRE', KEYS[1], window)
+  count = count + 1
+  allowed = 1
+end
+
+local reset = window
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+  reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, limit - count, reset}
+`)
+
+type RedisStore struct {
+	redisClient *redis.Client
+}
+
+func (rs *RedisStore) Hit(ctx context.Context, key string, limit int, window time.Duration, now time.Time) (Result, error) {
+	// Requests made in the same millisecond each need their own member
+	b := make([]byte, 4)
+	rand.Read(b)
+	member := now.Format(time.RFC3339Nano) + ":" + hex.EncodeToString(b)
+
+	v, err := hitScript.Run(ctx, rs.redisClient, []string{key},
+		now.UnixMilli(), window.Milliseconds(), limit, member,
+	).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:   v[0] == 1,
+		Limit:     limit,
+		Remaining: max(int(v[1]), 0),
+		Reset:     time.Duration(v[2]) * time.Millisecond,
+	}, nil
+}
@@ -3,25 +3,61 @@ package redirector
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/didoarellano/short/internal/breaker"
+	"github.com/didoarellano/short/internal/clientip"
 	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/domains"
 	"github.com/didoarellano/short/internal/geodata"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/metrics"
+	"github.com/didoarellano/short/internal/tracing"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/mileusna/useragent"
+	"golang.org/x/sync/singleflight"
 )
 
+const (
+	hotLinksSize = 10000
+	// How stale a link can be when it's served without Redis
+	hotLinkTTL = 10 * time.Minute
+	// A failing backend is left alone for this long before it's tried again
+	backendCooldown = 10 * time.Second
+	cachedLinkTTL   = 24 * time.Hour
+	// Unknown short codes are remembered briefly so scanners and typos don't
+	// all reach Postgres. Creating or re-enabling a link clears its entry.
+	notFoundTTL = time.Minute
+	// The most visited links over warmWindow are cached on startup
+	warmLinks  = 1000
+	warmWindow = 7 * 24 * time.Hour
+)
+
+// notFoundValue is cached in place of a link for short codes that don't
+// lead anywhere.
+const notFoundValue = "-"
+
+var errNotFound = errors.New("short code not found")
+
 type Redirector struct {
 	queries        *db.Queries
 	redisClient    *redis.Client
 	geodataFetcher geodata.GeoDataFetcher
+	redisBreaker   *breaker.Breaker
+	dbBreaker      *breaker.Breaker
+	hotLinks       *hotLinks
+	// Concurrent misses for the same key share one database lookup
+	lookups singleflight.Group
 }
 
 func New(q *db.Queries, r *redis.Client, g geodata.GeoDataFetcher) *Redirector {
@@ -29,36 +65,205 @@ func New(q *db.Queries, r *redis.Client, g geodata.GeoDataFetcher) *Redirector {
 		queries:        q,
 		redisClient:    r,
 		geodataFetcher: g,
+		redisBreaker:   breaker.New(5, backendCooldown),
+		dbBreaker:      breaker.New(5, backendCooldown),
+		hotLinks:       newHotLinks(hotLinksSize, hotLinkTTL),
 	}
 }
 
+type cachedLink struct {
+	ID             int32
+	DestinationUrl string
+	RedirectStatus int32
+	VersionID      int32
+}
+
+// CacheKey is the Redis key a short code's destination is cached under.
+// Links on the default domain have no domain ID. Short codes aren't case
+// sensitive so every way of writing one shares a key.
+func CacheKey(domainID pgtype.Int4, shortcode string) string {
+	shortcode = strings.ToLower(shortcode)
+	if !domainID.Valid {
+		return fmt.Sprintf("shortcode:%s", shortcode)
+	}
+	return fmt.Sprintf("domain:%d:shortcode:%s", domainID.Int32, shortcode)
+}
+
 func (rr *Redirector) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	shortcode := vars["shortcode"]
 
-	ctx := context.Background()
-	key := fmt.Sprintf("shortcode:%s", shortcode)
-	destinationUrl, err := rr.redisClient.Get(ctx, key).Result()
+	var domainID pgtype.Int4
+	if domain, ok := r.Context().Value(domains.DomainKey).(domains.CustomDomain); ok {
+		domainID = pgtype.Int4{Int32: domain.ID, Valid: true}
+	}
 
-	if err == redis.Nil {
-		destinationUrl, err = rr.queries.GetDestinationUrl(ctx, shortcode)
-		if err != nil {
-			log.Printf("Destination URL not found: %v", err)
+	ctx := r.Context()
+	key := CacheKey(domainID, shortcode)
+	link, err := rr.getCachedLink(ctx, key)
+	switch {
+	case err == nil:
+		metrics.RedirectCache.WithLabelValues("hit").Inc()
+	case err == errNotFound:
+		metrics.RedirectCache.WithLabelValues("negative").Inc()
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case err == redis.Nil:
+		metrics.RedirectCache.WithLabelValues("miss").Inc()
+	default:
+		if !errors.Is(err, breaker.ErrOpen) {
+			slog.ErrorContext(ctx, "Failed to read cached link", logging.Err(err))
+		}
+		// Popular links keep working while Redis is down
+		if hot, ok := rr.hotLinks.Get(key); ok {
+			link, err = hot, nil
+			metrics.RedirectCache.WithLabelValues("fallback").Inc()
+		} else {
+			metrics.RedirectCache.WithLabelValues("error").Inc()
+		}
+	}
+
+	if err != nil {
+		link, err = rr.lookUpLink(ctx, key, domainID, shortcode)
+		if err == pgx.ErrNoRows {
 			http.Error(w, "Not found", http.StatusNotFound)
 			return
 		}
+		if err != nil {
+			if !errors.Is(err, breaker.ErrOpen) {
+				slog.ErrorContext(ctx, "Failed to look up short code", logging.Err(err))
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(backendCooldown.Seconds())))
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	rr.hotLinks.Add(key, link)
+
+	metrics.VisitsPending.Inc()
+	// Recording carries on after the response, with the request's ID to log
+	go rr.RecordVisit(context.WithoutCancel(ctx), r, link.ID, link.VersionID)
 
-		err = rr.redisClient.Set(ctx, key, destinationUrl, 24*time.Hour).Err()
+	// Entries cached before redirect settings existed have no status
+	status := int(link.RedirectStatus)
+	if status == 0 {
+		status = http.StatusSeeOther
+	}
+
+	http.Redirect(w, r, link.DestinationUrl, status)
+}
+
+// lookUpLink finds a short code's destination in the database and caches
+// the answer, whether or not there is one. Callers missing the same key at
+// the same time wait for the first one's lookup instead of making their own.
+func (rr *Redirector) lookUpLink(ctx context.Context, key string, domainID pgtype.Int4, shortcode string) (cachedLink, error) {
+	v, err, _ := rr.lookups.Do(key, func() (any, error) {
+		// Shared with the other callers, so one leaving mustn't cancel it
+		ctx := context.WithoutCancel(ctx)
+		var row db.GetDestinationUrlRow
+		err := rr.dbBreaker.Do(func() error {
+			var err error
+			row, err = rr.queries.GetDestinationUrl(ctx, db.GetDestinationUrlParams{
+				DomainID:  domainID,
+				ShortCode: shortcode,
+			})
+			return err
+		}, isDatabaseFailure)
+		if err == pgx.ErrNoRows {
+			rr.setCachedValue(ctx, key, notFoundValue, notFoundTTL)
+			return nil, err
+		}
 		if err != nil {
-			log.Printf("Failed to cache shortcode: %v", err)
+			return nil, err
+		}
+		link := cachedLink(row)
+		rr.setCachedLink(ctx, key, link)
+		return link, nil
+	})
+	if err != nil {
+		return cachedLink{}, err
+	}
+	return v.(cachedLink), nil
+}
+
+func (rr *Redirector) getCachedLink(ctx context.Context, key string) (cachedLink, error) {
+	var s string
+	err := rr.redisBreaker.Do(func() error {
+		var err error
+		s, err = rr.redisClient.Get(ctx, key).Result()
+		return err
+	}, isRedisFailure)
+	if err != nil {
+		return cachedLink{}, err
+	}
+	return decodeCachedLink(s)
+}
+
+func decodeCachedLink(s string) (cachedLink, error) {
+	if s == notFoundValue {
+		return cachedLink{}, errNotFound
+	}
+	var link cachedLink
+	err := json.Unmarshal([]byte(s), &link)
+	return link, err
+}
+
+func (rr *Redirector) setCachedLink(ctx context.Context, key string, link cachedLink) {
+	b, _ := json.Marshal(link)
+	rr.setCachedValue(ctx, key, string(b), cachedLinkTTL)
+}
+
+func (rr *Redirector) setCachedValue(ctx context.Context, key, value string, ttl time.Duration) {
+	err := rr.redisBreaker.Do(func() error {
+		return rr.redisClient.Set(ctx, key, value, ttl).Err()
+	}, isRedisFailure)
+	if err != nil && !errors.Is(err, breaker.ErrOpen) {
+		slog.ErrorContext(ctx, "Failed to cache shortcode", logging.Err(err))
+	}
+}
+
+// WarmCache caches the links visited most lately, in Redis and in memory,
+// so they're ready before their first visits come in. It returns how many
+// links it cached.
+func (rr *Redirector) WarmCache(ctx context.Context) (int, error) {
+	rows, err := rr.queries.GetMostVisitedLinks(ctx, db.GetMostVisitedLinksParams{
+		Since: pgtype.Timestamptz{Time: time.Now().Add(-warmWindow), Valid: true},
+		Limit: warmLinks,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	pipe := rr.redisClient.Pipeline()
+	for _, row := range rows {
+		key := CacheKey(row.DomainID, row.ShortCode)
+		link := cachedLink{
+			ID:             row.ID,
+			DestinationUrl: row.DestinationUrl,
+			RedirectStatus: row.RedirectStatus,
+			VersionID:      row.VersionID,
 		}
-	} else if err != nil {
-		log.Printf("redis error %v:", err)
+		b, _ := json.Marshal(link)
+		pipe.Set(ctx, key, string(b), cachedLinkTTL)
+		rr.hotLinks.Add(key, link)
 	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
 
-	go rr.RecordVisit(ctx, r, shortcode)
+// Missing keys and unknown short codes are answers, not failures. Neither
+// is a request that was cancelled.
+func isRedisFailure(err error) bool {
+	return err != redis.Nil && !errors.Is(err, context.Canceled)
+}
 
-	http.Redirect(w, r, destinationUrl, http.StatusSeeOther)
+func isDatabaseFailure(err error) bool {
+	return err != pgx.ErrNoRows && !errors.Is(err, context.Canceled)
 }
 
 type UserAgentDetails struct {
@@ -104,52 +309,49 @@ func parseUserAgent(uaString string) ([]byte, error) {
 	return uaJSON, nil
 }
 
-func getClientIP(r *http.Request) string {
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		ips := strings.Split(forwarded, ",")
-		clientIP := strings.TrimSpace(ips[0])
-		return clientIP
-	}
-
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
-	}
-
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+func (rr *Redirector) GetGeoData(ctx context.Context, r *http.Request) geodata.GeoData {
+	ip := clientip.FromRequest(r)
+	_, span := tracing.Start(ctx, "GetGeoData")
+	started := time.Now()
+	geoData, err := rr.geodataFetcher.GetGeoData(net.ParseIP(ip))
+	metrics.GeoDataDuration.Observe(time.Since(started).Seconds())
+	tracing.End(span, err)
 	if err != nil {
-		return ""
+		metrics.GeoDataErrors.Inc()
+		slog.ErrorContext(ctx, "Failed to look up geodata", logging.Err(err))
 	}
-	return ip
-}
-
-func (rr *Redirector) GetGeoData(r *http.Request) geodata.GeoData {
-	ip := getClientIP(r)
-	geoData, _ := rr.geodataFetcher.GetGeoData(net.ParseIP(ip))
 	return geoData
 }
 
-func (rr *Redirector) RecordVisit(ctx context.Context, r *http.Request, shortcode string) {
+// RecordVisit stores a visit to a link. versionID is the link version that
+// served the visit, 0 if unknown.
+func (rr *Redirector) RecordVisit(ctx context.Context, r *http.Request, linkID, versionID int32) {
+	defer metrics.VisitsPending.Dec()
+	// Part of the redirect's trace though it finishes after the response
+	ctx, span := tracing.Start(ctx, "RecordVisit")
+	defer span.End()
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Recovered from panic in background job: %v", r)
+			metrics.VisitFailures.Inc()
+			slog.ErrorContext(ctx, "Recovered from panic recording visit", slog.Any("panic", r))
 		}
 	}()
 
 	uaData, _ := parseUserAgent(r.UserAgent())
 	referrer := r.Referer()
-	geoData := rr.GetGeoData(r)
+	geoData := rr.GetGeoData(ctx, r)
 	geoDataJSON, _ := json.Marshal(geoData)
 
 	err := rr.queries.RecordVisit(ctx, db.RecordVisitParams{
-		ShortCode:     shortcode,
+		LinkID:        linkID,
+		LinkVersionID: pgtype.Int4{Int32: versionID, Valid: versionID != 0},
 		UserAgentData: uaData,
 		GeoData:       geoDataJSON,
 		ReferrerUrl:   pgtype.Text{String: referrer, Valid: referrer != ""},
 	})
 
 	if err != nil {
-		log.Printf("Failed to record visit: %v", err)
+		metrics.VisitFailures.Inc()
+		slog.ErrorContext(ctx, "Failed to record visit", logging.Err(err))
 	}
 }
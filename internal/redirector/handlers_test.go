@@ -0,0 +1,31 @@
+package redirector
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestDecodeCachedLink(t *testing.T) {
+	if _, err := decodeCachedLink(notFoundValue); err != errNotFound {
+		t.Errorf("decodeCachedLink(%q) error = %v, want errNotFound", notFoundValue, err)
+	}
+
+	want := cachedLink{ID: 3, DestinationUrl: "https://example.com", RedirectStatus: 301, VersionID: 7}
+	b, _ := json.Marshal(want)
+	got, err := decodeCachedLink(string(b))
+	if err != nil {
+		t.Fatalf("decodeCachedLink() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("decodeCachedLink() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCacheKeyIgnoresCase(t *testing.T) {
+	domainID := pgtype.Int4{Int32: 4, Valid: true}
+	if CacheKey(domainID, "Promo") != CacheKey(domainID, "promo") {
+		t.Error("Expected short codes differing in case to share a cache key")
+	}
+}
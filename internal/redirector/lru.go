@@ -0,0 +1,69 @@
+package redirector
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// hotLinks keeps the most recently used links in memory for when Redis is
+// unavailable. It isn't told when links change, so entries only live for
+// ttl and are only used as a fallback.
+type hotLinks struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type hotLink struct {
+	key     string
+	link    cachedLink
+	expires time.Time
+}
+
+func newHotLinks(size int, ttl time.Duration) *hotLinks {
+	return &hotLinks{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+		now:     time.Now,
+	}
+}
+
+func (h *hotLinks) Get(key string) (cachedLink, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.entries[key]
+	if !ok {
+		return cachedLink{}, false
+	}
+	entry := e.Value.(*hotLink)
+	if h.now().After(entry.expires) {
+		h.order.Remove(e)
+		delete(h.entries, key)
+		return cachedLink{}, false
+	}
+	h.order.MoveToFront(e)
+	return entry.link, true
+}
+
+func (h *hotLinks) Add(key string, link cachedLink) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	expires := h.now().Add(h.ttl)
+	if e, ok := h.entries[key]; ok {
+		e.Value = &hotLink{key: key, link: link, expires: expires}
+		h.order.MoveToFront(e)
+		return
+	}
+	h.entries[key] = h.order.PushFront(&hotLink{key: key, link: link, expires: expires})
+	if h.order.Len() > h.size {
+		oldest := h.order.Back()
+		h.order.Remove(oldest)
+		delete(h.entries, oldest.Value.(*hotLink).key)
+	}
+}
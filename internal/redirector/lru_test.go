@@ -0,0 +1,29 @@
+package redirector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHotLinks(t *testing.T) {
+	now := time.Now()
+	h := newHotLinks(2, time.Minute)
+	h.now = func() time.Time { return now }
+
+	h.Add("a", cachedLink{ID: 1})
+	h.Add("b", cachedLink{ID: 2})
+	h.Get("a")
+	h.Add("c", cachedLink{ID: 3})
+
+	if _, ok := h.Get("b"); ok {
+		t.Error("Expected the least recently used link to be evicted")
+	}
+	if link, ok := h.Get("a"); !ok || link.ID != 1 {
+		t.Errorf("Expected link 1, got %+v", link)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := h.Get("c"); ok {
+		t.Error("Expected expired links to be dropped")
+	}
+}
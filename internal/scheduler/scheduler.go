@@ -0,0 +1,160 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/metrics"
+	"github.com/go-redis/redis/v8"
+)
+
+// JobFunc does a job's work and returns how many things it processed.
+type JobFunc func(ctx context.Context) (int, error)
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      JobFunc
+}
+
+// Locker hands out locks shared by every instance of the app.
+type Locker interface {
+	// Acquire takes key for ttl, reporting false if someone else holds it.
+	Acquire(ctx context.Context, key, owner string, ttl time.Duration) (bool, error)
+}
+
+// Scheduler runs jobs in the background on every instance of the app. Each
+// run is claimed through a lock that's held for the job's interval, so only
+// one instance runs it each time it's due however many are up.
+type Scheduler struct {
+	locker      Locker
+	redisClient *redis.Client
+	owner       string
+	jobs        []job
+	wg          sync.WaitGroup
+}
+
+func New(r *redis.Client) *Scheduler {
+	s := newScheduler(&RedisLocker{redisClient: r})
+	s.redisClient = r
+	return s
+}
+
+func newScheduler(l Locker) *Scheduler {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &Scheduler{
+		locker: l,
+		owner:  hex.EncodeToString(b),
+	}
+}
+
+func lockKey(name string) string {
+	return fmt.Sprintf("scheduler:%s:lock", name)
+}
+
+func runKey(name string) string {
+	return fmt.Sprintf("scheduler:%s:last_run", name)
+}
+
+// Every adds a job to run once every interval.
+func (s *Scheduler) Every(name string, interval time.Duration, fn JobFunc) {
+	s.jobs = append(s.jobs, job{name: name, interval: interval, run: fn})
+}
+
+// Start runs each job straight away and then on its interval until ctx is
+// done.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ticker := time.NewTicker(j.interval)
+			defer ticker.Stop()
+			for {
+				s.tick(ctx, j)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until every job started by Start has stopped.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Scheduler) tick(ctx context.Context, j job) {
+	// The lock runs out a little before the next tick so whichever instance
+	// gets there first can claim it
+	acquired, err := s.locker.Acquire(ctx, lockKey(j.name), s.owner, j.interval*9/10)
+	if err != nil {
+		slog.ErrorContext(ctx, "Scheduler failed to lock job", slog.String("job", j.name), logging.Err(err))
+		return
+	}
+	if !acquired {
+		return
+	}
+	s.run(ctx, j)
+}
+
+// RunNow runs the named job immediately, whether or not it's due.
+func (s *Scheduler) RunNow(ctx context.Context, name string) error {
+	for _, j := range s.jobs {
+		if j.name == name {
+			return s.run(ctx, j)
+		}
+	}
+	return fmt.Errorf("unknown job %q", name)
+}
+
+// run runs j and records how it went. The last run of each job is kept in
+// Redis so it can be checked from outside the app.
+func (s *Scheduler) run(ctx context.Context, j job) error {
+	started := time.Now()
+	processed, err := j.run(ctx)
+	duration := time.Since(started)
+
+	result := map[string]interface{}{
+		"started_at":  started.UTC().Format(time.RFC3339),
+		"duration_ms": duration.Milliseconds(),
+		"processed":   processed,
+		"error":       "",
+	}
+	metrics.JobDuration.WithLabelValues(j.name).Observe(duration.Seconds())
+	metrics.JobProcessed.WithLabelValues(j.name).Add(float64(processed))
+	if err != nil {
+		result["error"] = err.Error()
+		metrics.JobRuns.WithLabelValues(j.name, "error").Inc()
+		slog.ErrorContext(ctx, "Scheduled job failed", slog.String("job", j.name), slog.Duration("duration", duration), logging.Err(err))
+	} else {
+		metrics.JobRuns.WithLabelValues(j.name, "success").Inc()
+		metrics.JobLastSuccess.WithLabelValues(j.name).SetToCurrentTime()
+		slog.InfoContext(ctx, "Scheduled job finished", slog.String("job", j.name), slog.Int("processed", processed), slog.Duration("duration", duration))
+	}
+
+	if s.redisClient != nil {
+		if err := s.redisClient.HSet(ctx, runKey(j.name), result).Err(); err != nil {
+			slog.ErrorContext(ctx, "Failed to record job run", slog.String("job", j.name), logging.Err(err))
+		}
+	}
+	return err
+}
+
+type RedisLocker struct {
+	redisClient *redis.Client
+}
+
+func (rl *RedisLocker) Acquire(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	return rl.redisClient.SetNX(ctx, key, owner, ttl).Result()
+}
@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/didoarellano/short/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type memoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]time.Time
+}
+
+func (ml *memoryLocker) Acquire(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	if expires, ok := ml.locks[key]; ok && time.Now().Before(expires) {
+		return false, nil
+	}
+	ml.locks[key] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func TestOnlyOneInstanceRunsEachTick(t *testing.T) {
+	locker := &memoryLocker{locks: make(map[string]time.Time)}
+	var runs atomic.Int32
+	job := func(ctx context.Context) (int, error) {
+		runs.Add(1)
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var instances []*Scheduler
+	for range 3 {
+		s := newScheduler(locker)
+		s.Every("reset-usage", time.Hour, job)
+		s.Start(ctx)
+		instances = append(instances, s)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	for _, s := range instances {
+		s.Wait()
+	}
+
+	if got := runs.Load(); got != 1 {
+		t.Errorf("job ran %d times, want 1", got)
+	}
+}
+
+func TestRunNow(t *testing.T) {
+	s := newScheduler(&memoryLocker{locks: make(map[string]time.Time)})
+	failure := errors.New("failed")
+	s.Every("expire-subscriptions", time.Hour, func(ctx context.Context) (int, error) {
+		return 0, failure
+	})
+
+	if err := s.RunNow(context.Background(), "expire-subscriptions"); err != failure {
+		t.Errorf("RunNow() error = %v, want %v", err, failure)
+	}
+	if err := s.RunNow(context.Background(), "missing"); err == nil {
+		t.Error("RunNow(missing) error = nil, want an error")
+	}
+}
+
+func TestRunRecordsMetrics(t *testing.T) {
+	s := newScheduler(&memoryLocker{locks: make(map[string]time.Time)})
+	s.Every("metrics-test", time.Hour, func(ctx context.Context) (int, error) {
+		return 3, nil
+	})
+	s.RunNow(context.Background(), "metrics-test")
+
+	if got := testutil.ToFloat64(metrics.JobRuns.WithLabelValues("metrics-test", "success")); got != 1 {
+		t.Errorf("Expected 1 successful run, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.JobProcessed.WithLabelValues("metrics-test")); got != 3 {
+		t.Errorf("Expected 3 processed, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.JobLastSuccess.WithLabelValues("metrics-test")); got == 0 {
+		t.Error("Expected the last success to be recorded")
+	}
+}
@@ -0,0 +1,81 @@
+package session
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// KeyPrefix is the prefix redisstore stores sessions under.
+const KeyPrefix = "session:"
+
+const (
+	defaultIdleTimeout     = 24 * time.Hour
+	defaultAbsoluteTimeout = 30 * 24 * time.Hour
+)
+
+type Config struct {
+	Secure          bool
+	SameSite        http.SameSite
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+}
+
+// LoadConfig reads the session cookie and lifetime settings from the
+// environment. Cookies are Secure everywhere but dev unless
+// SESSION_COOKIE_SECURE says otherwise.
+func LoadConfig() Config {
+	cfg := Config{
+		Secure:          os.Getenv("ENV") != "dev",
+		SameSite:        http.SameSiteLaxMode,
+		IdleTimeout:     durationFromEnv("SESSION_IDLE_TIMEOUT", defaultIdleTimeout),
+		AbsoluteTimeout: durationFromEnv("SESSION_ABSOLUTE_TIMEOUT", defaultAbsoluteTimeout),
+	}
+
+	switch os.Getenv("SESSION_COOKIE_SECURE") {
+	case "true":
+		cfg.Secure = true
+	case "false":
+		cfg.Secure = false
+	}
+
+	switch strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")) {
+	case "strict":
+		cfg.SameSite = http.SameSiteStrictMode
+	case "none":
+		// Browsers drop SameSite=None cookies that aren't Secure
+		cfg.SameSite = http.SameSiteNoneMode
+		cfg.Secure = true
+	}
+
+	return cfg
+}
+
+// CookieOptions are the options new sessions are created with. The cookie
+// and the stored session both live until the absolute timeout.
+func (c Config) CookieOptions() sessions.Options {
+	return sessions.Options{
+		Path:     "/",
+		MaxAge:   int(c.AbsoluteTimeout.Seconds()),
+		Secure:   c.Secure,
+		HttpOnly: true,
+		SameSite: c.SameSite,
+	}
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		slog.Warn("Invalid duration, using the default", slog.String("key", key), slog.String("value", v), slog.Duration("default", fallback))
+		return fallback
+	}
+	return d
+}
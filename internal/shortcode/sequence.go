@@ -0,0 +1,103 @@
+package shortcode
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"math/rand/v2"
+)
+
+// Counter hands out numbers, never the same one twice.
+type Counter interface {
+	Next(ctx context.Context) (int64, error)
+}
+
+// CounterFunc lets an ordinary function be used as a Counter.
+type CounterFunc func(ctx context.Context) (int64, error)
+
+func (f CounterFunc) Next(ctx context.Context) (int64, error) {
+	return f(ctx)
+}
+
+// SequenceGenerator numbers codes with a counter, so they're as short as
+// they can be and unique by construction. The number is written in an
+// alphabet shuffled by a salt and rotated per code, so consecutive codes
+// don't look alike and can't be counted through without knowing the salt.
+type SequenceGenerator struct {
+	counter   Counter
+	alphabet  string
+	minLength int
+	// MaxAttempts bounds how many numbers are tried. Only custom slugs can
+	// collide with a sequence code.
+	MaxAttempts int
+}
+
+func NewSequenceGenerator(counter Counter, alphabet string, minLength int, salt string) *SequenceGenerator {
+	return &SequenceGenerator{
+		counter:     counter,
+		alphabet:    shuffle(alphabet, salt),
+		minLength:   minLength,
+		MaxAttempts: 6,
+	}
+}
+
+func (g *SequenceGenerator) Create(ctx context.Context, userID int32, url string, store Store) (string, error) {
+	for range g.MaxAttempts {
+		n, err := g.counter.Next(ctx)
+		if err != nil {
+			return "", err
+		}
+		code := g.Encode(n)
+		err = store.Claim(ctx, code)
+		if err == nil {
+			return code, nil
+		}
+		if !errors.Is(err, ErrCollision) {
+			return "", err
+		}
+	}
+	return "", ErrExhausted
+}
+
+// Encode writes n as a code of at least minLength characters. The first
+// character picks how the alphabet is rotated for the rest, which is n in
+// that alphabet, so different numbers always give different codes.
+func (g *SequenceGenerator) Encode(n int64) string {
+	size := len(g.alphabet)
+	offset := int(mix(uint64(n)) % uint64(size))
+	rotated := g.alphabet[offset:] + g.alphabet[:offset]
+
+	// Counting from size^(minLength-2) keeps the rest minLength-1 long
+	base := big.NewInt(int64(size))
+	v := new(big.Int).Exp(base, big.NewInt(int64(g.minLength-2)), nil)
+	v.Add(v, new(big.Int).SetUint64(uint64(n)))
+
+	code := []byte{g.alphabet[offset]}
+	digit := new(big.Int)
+	for v.Sign() > 0 {
+		v.DivMod(v, base, digit)
+		code = append(code, rotated[digit.Int64()])
+	}
+	return string(code)
+}
+
+// mix scatters consecutive numbers (splitmix64's finaliser)
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// shuffle reorders alphabet the same way every time for the same salt.
+func shuffle(alphabet, salt string) string {
+	chars := []byte(alphabet)
+	r := rand.New(rand.NewChaCha8(sha256.Sum256([]byte(salt))))
+	r.Shuffle(len(chars), func(i, j int) {
+		chars[i], chars[j] = chars[j], chars[i]
+	})
+	return string(chars)
+}
@@ -0,0 +1,77 @@
+package shortcode
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEncodeIsUnique(t *testing.T) {
+	g := NewSequenceGenerator(nil, LowercaseAlphabet, 4, "salt")
+	seen := make(map[string]int64)
+	for n := int64(1); n <= 100000; n++ {
+		code := g.Encode(n)
+		if len(code) < 4 {
+			t.Fatalf("Encode(%d) = %q, expected at least 4 characters", n, code)
+		}
+		if prev, ok := seen[code]; ok {
+			t.Fatalf("Encode(%d) and Encode(%d) both gave %q", prev, n, code)
+		}
+		seen[code] = n
+	}
+}
+
+func TestEncodeDependsOnSalt(t *testing.T) {
+	a := NewSequenceGenerator(nil, Base32Alphabet, 6, "one")
+	b := NewSequenceGenerator(nil, Base32Alphabet, 6, "two")
+	if a.Encode(42) == b.Encode(42) {
+		t.Errorf("Expected different codes for different salts, got %q", a.Encode(42))
+	}
+	if a.Encode(42) != NewSequenceGenerator(nil, Base32Alphabet, 6, "one").Encode(42) {
+		t.Error("Expected the same code for the same salt")
+	}
+
+	// Neighbours shouldn't share a prefix
+	if a.Encode(1000)[:3] == a.Encode(1001)[:3] {
+		t.Errorf("Expected unrelated codes for consecutive numbers, got %q and %q", a.Encode(1000), a.Encode(1001))
+	}
+}
+
+func TestSequenceCreateSkipsTakenCodes(t *testing.T) {
+	var n int64
+	counter := CounterFunc(func(ctx context.Context) (int64, error) {
+		n++
+		return n, nil
+	})
+	g := NewSequenceGenerator(counter, Base32Alphabet, 7, "")
+	store := &takenStore{taken: 1}
+
+	code, err := g.Create(context.Background(), 1, "https://example.com", store)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if code != g.Encode(2) {
+		t.Errorf("Expected the code for 2, %q, got %q", g.Encode(2), code)
+	}
+}
+
+func TestGeneratorFromEnvSequence(t *testing.T) {
+	t.Setenv("SHORTCODE_STRATEGY", "sequence")
+	t.Setenv("SHORTCODE_ALPHABET", "")
+	t.Setenv("SHORTCODE_LENGTH", "")
+	g, err := GeneratorFromEnv(nil)
+	if err != nil {
+		t.Fatalf("GeneratorFromEnv() error = %v", err)
+	}
+	sg, ok := g.(*SequenceGenerator)
+	if !ok {
+		t.Fatalf("Expected a *SequenceGenerator, got %T", g)
+	}
+	if sg.minLength != 7 || sg.alphabet == Base32Alphabet {
+		t.Errorf("Expected a shuffled alphabet and length 7, got %q and %d", sg.alphabet, sg.minLength)
+	}
+
+	t.Setenv("SHORTCODE_STRATEGY", "random")
+	if _, err := GeneratorFromEnv(nil); err == nil {
+		t.Error("Expected an error for an unknown strategy, got nil")
+	}
+}
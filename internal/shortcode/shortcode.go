@@ -1,46 +1,185 @@
 package shortcode
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
 
-	"github.com/akamensky/base58"
+// Short codes aren't case sensitive, so alphabets only use one case.
+const (
+	// Digits and lowercase letters without 0/o and 1/l
+	Base32Alphabet = "23456789abcdefghijkmnpqrstuvwxyz"
+	// Without characters that are easily mistaken for each other: 0/o,
+	// 1/i/l, 2/z, 5/s, 8/b and u/v, for codes that are printed or read out
+	LowercaseAlphabet = "34679abcdefghijkmnpqrtwxy"
 )
 
-type ShortCode struct {
-	UserID int64
-	URL    string
-	Length int
+var alphabets = map[string]string{
+	"base32":    Base32Alphabet,
+	"lowercase": LowercaseAlphabet,
 }
 
-const base58Chars = "123456789abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+var (
+	// ErrCollision is returned by a Store when a code is already taken.
+	ErrCollision = errors.New("short code already in use")
+	ErrExhausted = errors.New("couldn't find an unused short code")
+)
 
-func New(userID int32, url string, length int) string {
-	return GenerateShortCode(userID, url, length)
+// Store saves whatever is being shortened under a code.
+type Store interface {
+	// Claim saves under code, returning ErrCollision if it's taken.
+	Claim(ctx context.Context, code string) error
 }
 
-// Hash the URL and user ID to create a unique short code
-func GenerateShortCode(userID int32, url string, length int) string {
-	salt := generateSalt()
-	data := fmt.Sprintf("%d-%s-%s", userID, url, salt)
+// StoreFunc lets an ordinary function be used as a Store.
+type StoreFunc func(ctx context.Context, code string) error
+
+func (f StoreFunc) Claim(ctx context.Context, code string) error {
+	return f(ctx, code)
+}
+
+// Generator comes up with short codes and claims them in a Store.
+type Generator interface {
+	Create(ctx context.Context, userID int32, url string, store Store) (string, error)
+}
+
+// HashGenerator makes codes from a salted hash of the URL. It needs no
+// coordination but codes can collide, so it retries with longer ones.
+type HashGenerator struct {
+	Alphabet string
+	Length   int
+	// MaxAttempts bounds how many codes are tried before giving up
+	MaxAttempts int
+	// The code grows by a character after this many collisions in a row,
+	// as they mean codes of the current length are getting scarce. Less
+	// than 1 grows it after every collision.
+	CollisionsPerLength int
+}
+
+func NewHashGenerator(alphabet string, length int) *HashGenerator {
+	return &HashGenerator{
+		Alphabet:            alphabet,
+		Length:              length,
+		MaxAttempts:         6,
+		CollisionsPerLength: 2,
+	}
+}
+
+// GeneratorFromEnv configures a Generator from the environment:
+//
+//   - SHORTCODE_STRATEGY, hash (the default) or sequence. Sequence codes are
+//     numbered by counter.
+//   - SHORTCODE_ALPHABET, either base32 (the default), lowercase or the
+//     characters to use, in one case.
+//   - SHORTCODE_LENGTH, 7 by default. Sequence codes start at this length.
+//   - SHORTCODE_SALT, which shuffles the alphabet of sequence codes. Changing
+//     it after codes have been handed out can produce ones already taken.
+func GeneratorFromEnv(counter Counter) (Generator, error) {
+	alphabet := Base32Alphabet
+	if v := os.Getenv("SHORTCODE_ALPHABET"); v != "" {
+		if v == "base58" || v == "nolookalikes" {
+			return nil, fmt.Errorf("SHORTCODE_ALPHABET %s has mixed case letters, use base32 or lowercase", v)
+		}
+		if named, ok := alphabets[strings.ToLower(v)]; ok {
+			alphabet = named
+		} else {
+			alphabet = v
+		}
+	}
+	if err := validateAlphabet(alphabet); err != nil {
+		return nil, err
+	}
 
-	hash := sha256.New()
-	hash.Write([]byte(data))
-	hashed := hash.Sum(nil)
+	length := 7
+	if v := os.Getenv("SHORTCODE_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 4 {
+			return nil, fmt.Errorf("SHORTCODE_LENGTH must be a number of at least 4, got %q", v)
+		}
+		length = n
+	}
 
-	hashPart := hashed[:8]
+	switch strategy := os.Getenv("SHORTCODE_STRATEGY"); strategy {
+	case "", "hash":
+		return NewHashGenerator(alphabet, length), nil
+	case "sequence":
+		return NewSequenceGenerator(counter, alphabet, length, os.Getenv("SHORTCODE_SALT")), nil
+	default:
+		return nil, fmt.Errorf("SHORTCODE_STRATEGY must be hash or sequence, got %q", strategy)
+	}
+}
 
-	shortCode := base58.Encode(hashPart)
+func validateAlphabet(alphabet string) error {
+	if len(alphabet) < 16 {
+		return fmt.Errorf("short code alphabet needs at least 16 characters, got %d", len(alphabet))
+	}
+	seen := make(map[rune]bool)
+	for _, c := range alphabet {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`/?#%&\`, c) {
+			return fmt.Errorf("short code alphabet can't contain %q", c)
+		}
+		// Codes differing only in case are the same code
+		folded := unicode.ToLower(c)
+		if seen[folded] {
+			return fmt.Errorf("short code alphabet repeats %q ignoring case", c)
+		}
+		seen[folded] = true
+	}
+	return nil
+}
 
-	if len(shortCode) > length {
-		return shortCode[:length]
+// Create generates codes and claims them in store until one is free. Anything
+// other than a collision stops it straight away.
+func (g *HashGenerator) Create(ctx context.Context, userID int32, url string, store Store) (string, error) {
+	length := g.Length
+	collisionsPerLength := max(g.CollisionsPerLength, 1)
+	for attempt := 1; attempt <= g.MaxAttempts; attempt++ {
+		code := g.Generate(userID, url, length)
+		err := store.Claim(ctx, code)
+		if err == nil {
+			return code, nil
+		}
+		if !errors.Is(err, ErrCollision) {
+			return "", err
+		}
+		if attempt%collisionsPerLength == 0 {
+			length++
+		}
 	}
-	for len(shortCode) < length {
-		shortCode += string(base58Chars[0])
+	return "", ErrExhausted
+}
+
+// Generate hashes the URL and user ID with a random salt into a code of
+// length characters from the alphabet.
+func (g *HashGenerator) Generate(userID int32, url string, length int) string {
+	salt := generateSalt()
+	data := fmt.Sprintf("%d-%s-%s", userID, url, salt)
+
+	hash := sha256.Sum256([]byte(data))
+	n := new(big.Int).SetBytes(hash[:])
+	base := big.NewInt(int64(len(g.Alphabet)))
+	digit := new(big.Int)
+
+	code := make([]byte, 0, length)
+	for len(code) < length {
+		// Codes longer than the hash can encode are topped up with a new hash
+		if n.Sign() == 0 {
+			hash = sha256.Sum256(hash[:])
+			n.SetBytes(hash[:])
+		}
+		n.DivMod(n, base, digit)
+		code = append(code, g.Alphabet[digit.Int64()])
 	}
-	return shortCode
+	return string(code)
 }
 
 func generateSalt() string {
@@ -1,6 +1,9 @@
 package shortcode
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -17,9 +20,10 @@ func TestShortCodeLength(t *testing.T) {
 		{userID: 1, url: "https://anotherexample.com", length: 8, wantLength: 8},
 	}
 
+	g := NewHashGenerator(Base32Alphabet, 7)
 	for _, tt := range tests {
 		t.Run(tt.url, func(t *testing.T) {
-			got := GenerateShortCode(tt.userID, tt.url, tt.length)
+			got := g.Generate(tt.userID, tt.url, tt.length)
 			gotLength := len(got)
 			if gotLength != tt.wantLength {
 				t.Errorf("Expected %v, got %v", tt.wantLength, gotLength)
@@ -33,9 +37,10 @@ func TestUniqueForSameURL(t *testing.T) {
 	url := "https://example.com"
 	userID := int32(1)
 	length := 7
+	g := NewHashGenerator(Base32Alphabet, length)
 
-	code1 := GenerateShortCode(userID, url, length)
-	code2 := GenerateShortCode(userID, url, length)
+	code1 := g.Generate(userID, url, length)
+	code2 := g.Generate(userID, url, length)
 
 	if code1 == code2 {
 		t.Errorf("Expected different short codes, got same: %v", code1)
@@ -48,11 +53,131 @@ func TestUniqueToUser(t *testing.T) {
 	userID1 := int32(1)
 	userID2 := int32(2)
 	length := 8
+	g := NewHashGenerator(Base32Alphabet, length)
 
-	code1 := GenerateShortCode(userID1, url, length)
-	code2 := GenerateShortCode(userID2, url, length)
+	code1 := g.Generate(userID1, url, length)
+	code2 := g.Generate(userID2, url, length)
 
 	if code1 == code2 {
 		t.Errorf("Expected different short codes, got same: %v", code1)
 	}
 }
+
+// takenStore reports a collision for the first n codes it's asked for.
+type takenStore struct {
+	taken   int
+	claimed []string
+}
+
+func (ts *takenStore) Claim(ctx context.Context, code string) error {
+	ts.claimed = append(ts.claimed, code)
+	if len(ts.claimed) <= ts.taken {
+		return ErrCollision
+	}
+	return nil
+}
+
+func TestCreateRetriesCollisions(t *testing.T) {
+	g := NewHashGenerator(LowercaseAlphabet, 5)
+	store := &takenStore{taken: 3}
+
+	code, err := g.Create(context.Background(), 1, "https://example.com", store)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if len(store.claimed) != 4 {
+		t.Errorf("Expected 4 attempts, got %d", len(store.claimed))
+	}
+	// Grows by one after every 2 collisions
+	for i, want := range []int{5, 5, 6, 6} {
+		if got := len(store.claimed[i]); got != want {
+			t.Errorf("Attempt %d: expected length %d, got %d", i+1, want, got)
+		}
+	}
+	for _, c := range code {
+		if !strings.ContainsRune(LowercaseAlphabet, c) {
+			t.Errorf("Expected only characters from %q, got %q", LowercaseAlphabet, code)
+		}
+	}
+}
+
+func TestCreateGivesUp(t *testing.T) {
+	g := NewHashGenerator(Base32Alphabet, 7)
+	store := &takenStore{taken: 100}
+
+	if _, err := g.Create(context.Background(), 1, "https://example.com", store); err != ErrExhausted {
+		t.Errorf("Expected %v, got %v", ErrExhausted, err)
+	}
+	if len(store.claimed) != g.MaxAttempts {
+		t.Errorf("Expected %d attempts, got %d", g.MaxAttempts, len(store.claimed))
+	}
+
+	failure := errors.New("connection refused")
+	attempts := 0
+	_, err := g.Create(context.Background(), 1, "https://example.com", StoreFunc(func(ctx context.Context, code string) error {
+		attempts++
+		return failure
+	}))
+	if err != failure || attempts != 1 {
+		t.Errorf("Expected %v after 1 attempt, got %v after %d", failure, err, attempts)
+	}
+}
+
+func TestCreateWithoutCollisionsPerLength(t *testing.T) {
+	g := &HashGenerator{Alphabet: Base32Alphabet, Length: 7, MaxAttempts: 3}
+	store := &takenStore{taken: 2}
+
+	code, err := g.Create(context.Background(), 1, "https://example.com", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 9 {
+		t.Errorf("Expected the code to grow after each collision, got %q", code)
+	}
+}
+
+func TestGeneratorFromEnv(t *testing.T) {
+	tests := []struct {
+		alphabet     string
+		length       string
+		wantAlphabet string
+		wantLength   int
+		wantErr      bool
+	}{
+		{wantAlphabet: Base32Alphabet, wantLength: 7},
+		{alphabet: "lowercase", length: "9", wantAlphabet: LowercaseAlphabet, wantLength: 9},
+		{alphabet: "base58", wantErr: true},
+		{alphabet: "abcdefghijklmnopqrstuvwxyzA", wantErr: true},
+		{alphabet: "abcdefghijklmnopqrstuvwxyz", wantAlphabet: "abcdefghijklmnopqrstuvwxyz", wantLength: 7},
+		{alphabet: "abc", wantErr: true},
+		{alphabet: "aabcdefghijklmnopqrstuvwxyz", wantErr: true},
+		{alphabet: "abcdefghijklmnopqrstuvwxyz/", wantErr: true},
+		{length: "3", wantErr: true},
+		{length: "seven", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alphabet+":"+tt.length, func(t *testing.T) {
+			t.Setenv("SHORTCODE_STRATEGY", "")
+			t.Setenv("SHORTCODE_ALPHABET", tt.alphabet)
+			t.Setenv("SHORTCODE_LENGTH", tt.length)
+			g, err := GeneratorFromEnv(nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GeneratorFromEnv(nil) error = %v", err)
+			}
+			hg, ok := g.(*HashGenerator)
+			if !ok {
+				t.Fatalf("Expected a *HashGenerator, got %T", g)
+			}
+			if hg.Alphabet != tt.wantAlphabet || hg.Length != tt.wantLength {
+				t.Errorf("Expected %q and %d, got %q and %d", tt.wantAlphabet, tt.wantLength, hg.Alphabet, hg.Length)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package subscriptions
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+)
+
+// Entitlement is something a plan may allow, stored in plan_entitlements.
+// Features are allowed with a value of 1, limits are the value itself.
+type Entitlement string
+
+const (
+	CustomSlugs            Entitlement = "custom_slugs"
+	DuplicateLinks         Entitlement = "duplicate_links"
+	Analytics              Entitlement = "analytics"
+	AnalyticsRetentionDays Entitlement = "analytics_retention_days"
+	MaxCustomDomains       Entitlement = "max_custom_domains"
+	MaxTeamMembers         Entitlement = "max_team_members"
+	APIRequestsPerMinute   Entitlement = "api_requests_per_minute"
+	PasswordProtectedLinks Entitlement = "password_protected_links"
+)
+
+type Entitlements map[Entitlement]int32
+
+// Allows reports whether e is included at all.
+func (es Entitlements) Allows(e Entitlement) bool {
+	return es[e] > 0
+}
+
+// Limit is e's value, zero if it isn't included.
+func (es Entitlements) Limit(e Entitlement) int32 {
+	return es[e]
+}
+
+func parseEntitlements(b []byte) Entitlements {
+	entitlements := Entitlements{}
+	if err := json.Unmarshal(b, &entitlements); err != nil {
+		slog.Error("Failed to parse entitlements", logging.Err(err))
+	}
+	return entitlements
+}
+
+func (s Subscription) Allows(e Entitlement) bool {
+	return s.Entitlements.Allows(e)
+}
+
+func (s Subscription) Limit(e Entitlement) int32 {
+	return s.Entitlements.Limit(e)
+}
+
+func newSubscription(row db.GetWorkspaceSubscriptionRow) Subscription {
+	return Subscription{
+		Status:           row.Status,
+		Name:             row.Name,
+		MaxLinksPerMonth: row.MaxLinksPerMonth,
+		Entitlements:     parseEntitlements(row.Entitlements),
+	}
+}
+
+// Plan is a subscription that can be bought.
+type Plan struct {
+	ID               int32
+	Name             string
+	MaxLinksPerMonth int32
+	Entitlements     Entitlements
+}
+
+func newPlans(rows []db.GetSubscriptionsRow) []Plan {
+	plans := make([]Plan, 0, len(rows))
+	for _, row := range rows {
+		plans = append(plans, Plan{
+			ID:               row.ID,
+			Name:             row.Name,
+			MaxLinksPerMonth: row.MaxLinksPerMonth,
+			Entitlements:     parseEntitlements(row.Entitlements),
+		})
+	}
+	return plans
+}
+
+// MemberLimit is how many people, including pending invitations, a
+// workspace's plan allows.
+func (us *UserSubscriptionService) MemberLimit(workspaceID int32) (int32, error) {
+	subscription, err := us.GetSubscriptionForWorkspace(workspaceID)
+	if err != nil {
+		return 0, err
+	}
+	return subscription.Limit(MaxTeamMembers), nil
+}
+
+// HasEntitlement reports whether the current workspace's plan allows e. It
+// needs UserSubscriptionMiddleware to have run.
+func HasEntitlement(r *http.Request, e Entitlement) bool {
+	subscriptionContext, ok := r.Context().Value(SubscriptionKey).(UserSubscriptionContext)
+	return ok && subscriptionContext.Subscription.Allows(e)
+}
+
+// RequireEntitlement sends workspaces whose plan doesn't allow e to the
+// billing page to upgrade. It needs UserSubscriptionMiddleware to have run.
+func (us *UserSubscriptionService) RequireEntitlement(e Entitlement) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if HasEntitlement(r, e) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			session, _ := us.sessionStore.Get(r, "session")
+			session.AddFlash("Your plan doesn't include that. Upgrade to use it.")
+			session.Save(r, w)
+			http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/billing", http.StatusSeeOther)
+		})
+	}
+}
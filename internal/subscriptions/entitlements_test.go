@@ -0,0 +1,40 @@
+package subscriptions
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEntitlements(t *testing.T) {
+	subscription := Subscription{
+		Entitlements: parseEntitlements([]byte(`{"analytics": 1, "analytics_retention_days": 90, "custom_slugs": 0}`)),
+	}
+
+	if !subscription.Allows(Analytics) {
+		t.Error("Allows(analytics) = false, want true")
+	}
+	if subscription.Allows(CustomSlugs) {
+		t.Error("Allows(custom_slugs) = true, want false")
+	}
+	if subscription.Allows(PasswordProtectedLinks) {
+		t.Error("Allows(password_protected_links) = true, want false for a missing key")
+	}
+	if got := subscription.Limit(AnalyticsRetentionDays); got != 90 {
+		t.Errorf("Limit(analytics_retention_days) = %d, want 90", got)
+	}
+}
+
+func TestHasEntitlement(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if HasEntitlement(r, Analytics) {
+		t.Error("HasEntitlement() = true without a subscription in the context")
+	}
+
+	ctx := context.WithValue(r.Context(), SubscriptionKey, UserSubscriptionContext{
+		Subscription: Subscription{Entitlements: Entitlements{Analytics: 1}},
+	})
+	if !HasEntitlement(r.WithContext(ctx), Analytics) {
+		t.Error("HasEntitlement() = false, want true")
+	}
+}
@@ -0,0 +1,218 @@
+package subscriptions
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/session"
+	"github.com/didoarellano/short/internal/templ"
+	"github.com/didoarellano/short/internal/workspaces"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Payments takes payment for plans. Without one, plan changes apply without
+// charging, which is how plans are given out in dev.
+type Payments interface {
+	Sells(plan string) bool
+	// Checkout returns the URL to send the user to to pay for plan.
+	Checkout(r *http.Request, workspaceID int32, plan string) (string, error)
+	// SetRenewalPlan sets the plan the workspace's paid subscription renews
+	// onto. Plans that aren't sold stop it renewing.
+	SetRenewalPlan(ctx context.Context, workspaceID int32, plan string) error
+}
+
+// freePlan is the only plan that never has to be paid for
+const freePlan = "basic"
+
+type SubscriptionHandler struct {
+	template            *templ.Templ
+	queries             *db.Queries
+	sessionStore        session.SessionStore
+	subscriptionService *UserSubscriptionService
+	payments            Payments
+}
+
+func NewSubscriptionHandlers(t *templ.Templ, q *db.Queries, s session.SessionStore, us *UserSubscriptionService, p Payments) *SubscriptionHandler {
+	return &SubscriptionHandler{
+		template:            t,
+		queries:             q,
+		sessionStore:        s,
+		subscriptionService: us,
+		payments:            p,
+	}
+}
+
+func (sh *SubscriptionHandler) Billing(w http.ResponseWriter, r *http.Request) {
+	session, _ := sh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+	userSubscriptionContext := r.Context().Value(SubscriptionKey).(UserSubscriptionContext)
+	ctx := context.Background()
+
+	plan, err := sh.queries.GetWorkspacePlan(ctx, membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace plan", logging.Err(err))
+		http.Error(w, "Failed to retrieve plan", http.StatusInternalServerError)
+		return
+	}
+
+	plans, err := sh.subscriptionService.GetPlans(ctx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve plans", logging.Err(err))
+		http.Error(w, "Failed to retrieve plan", http.StatusInternalServerError)
+		return
+	}
+
+	// Basic never ends
+	var periodEnds *time.Time
+	if plan.EndDate.InfinityModifier == pgtype.Finite {
+		periodEnds = &plan.EndDate.Time
+	}
+
+	var current Plan
+	for _, p := range plans {
+		if p.ID == plan.SubscriptionID {
+			current = p
+		}
+	}
+
+	var message string
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message, _ = flashes[0].(string)
+	}
+	session.Save(r, w)
+
+	// The plan changes when the payment provider tells us it's been paid
+	// for, which may not have happened by the time the user is sent back
+	if message == "" && r.URL.Query().Get("checkout") == "success" {
+		message = "Thanks! Your new plan will be active as soon as your payment is confirmed."
+	}
+
+	data := map[string]interface{}{
+		"user":             user,
+		"membership":       membership,
+		"plan":             plan,
+		"current":          current,
+		"plans":            plans,
+		"periodEnds":       periodEnds,
+		"linksCreated":     userSubscriptionContext.LinksCreated,
+		"canManageBilling": membership.Can(workspaces.ManageBilling),
+		"paymentFailed":    plan.PaymentFailedAt.Valid,
+		"message":          message,
+	}
+
+	if err := sh.template.ExecuteTemplate(w, r, "billing.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (sh *SubscriptionHandler) ChangePlan(w http.ResponseWriter, r *http.Request) {
+	session, _ := sh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+	billingPath := "/" + config.AppData.AppPathPrefix + "/billing"
+
+	if !membership.Can(workspaces.ManageBilling) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	subscriptionID, err := strconv.ParseInt(r.FormValue("subscription_id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid plan", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+
+	// Upgrading onto a paid plan, or onto any paid plan when the workspace
+	// isn't paying yet, buys a new subscription which replaces the current
+	// one once it's been paid for. Paid downgrades are scheduled like any
+	// other and the existing subscription renews onto the cheaper plan.
+	if sh.payments != nil {
+		current, err := sh.queries.GetWorkspacePlan(ctx, membership.WorkspaceID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to retrieve workspace plan", logging.Err(err))
+			http.Error(w, "Failed to change plan", http.StatusInternalServerError)
+			return
+		}
+
+		plans, err := sh.queries.GetSubscriptions(ctx)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to retrieve plans", logging.Err(err))
+			http.Error(w, "Failed to change plan", http.StatusInternalServerError)
+			return
+		}
+
+		var target, currentPlan db.GetSubscriptionsRow
+		for _, p := range plans {
+			if p.ID == int32(subscriptionID) {
+				target = p
+			}
+			if p.ID == current.SubscriptionID {
+				currentPlan = p
+			}
+		}
+
+		paid := target.ID != 0 && target.ID != current.SubscriptionID && target.Name != freePlan
+		if paid && !sh.payments.Sells(target.Name) {
+			http.Error(w, "This plan can't be bought", http.StatusBadRequest)
+			return
+		}
+		if paid && (!current.ProviderSubscriptionID.Valid || target.MaxLinksPerMonth > currentPlan.MaxLinksPerMonth) {
+			checkoutURL, err := sh.payments.Checkout(r, membership.WorkspaceID, target.Name)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to start checkout", logging.Err(err))
+				http.Error(w, "Failed to change plan", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, checkoutURL, http.StatusSeeOther)
+			return
+		}
+	}
+
+	scheduled, err := sh.subscriptionService.ChangePlan(r, membership.WorkspaceID, user.UserID, int32(subscriptionID))
+	if err == ErrUnknownPlan {
+		http.Error(w, "Invalid plan", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to change plan", logging.Err(err))
+		http.Error(w, "Failed to change plan", http.StatusInternalServerError)
+		return
+	}
+
+	plan, err := sh.queries.GetWorkspacePlan(ctx, membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace plan", logging.Err(err))
+	}
+
+	// A scheduled downgrade happens when the paid period ends, so the paid
+	// subscription renews onto the new plan, or stops renewing for basic.
+	// Keeping the current plan puts it back.
+	if sh.payments != nil && err == nil {
+		renewalPlan := plan.Name
+		if scheduled {
+			renewalPlan = plan.PendingSubscriptionName.String
+		}
+		if err := sh.payments.SetRenewalPlan(ctx, membership.WorkspaceID, renewalPlan); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to update subscription renewal", logging.Err(err))
+		}
+	}
+	if scheduled {
+		session.AddFlash(fmt.Sprintf("You'll move to %s when your current period ends", plan.PendingSubscriptionName.String))
+	} else {
+		session.AddFlash(fmt.Sprintf("You're on the %s plan", plan.Name))
+	}
+	session.Save(r, w)
+	http.Redirect(w, r, billingPath, http.StatusSeeOther)
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"net/http"
 
-	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/workspaces"
 )
 
 type key string
@@ -19,11 +19,10 @@ type UserSubscriptionContext struct {
 func (us *UserSubscriptionService) UserSubscriptionMiddleware() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			session, _ := us.sessionStore.Get(r, "session")
-			user := session.Values["user"].(auth.UserSession)
-			userID := user.UserID
-			subscription, _ := us.GetSubscriptionForUser(userID)
-			linksCreated, _ := us.GetCurrentUsageForUser(userID)
+			membership := r.Context().Value(workspaces.MembershipKey).(workspaces.Membership)
+			workspaceID := membership.WorkspaceID
+			subscription, _ := us.GetSubscriptionForWorkspace(workspaceID)
+			linksCreated, _ := us.GetCurrentUsageForWorkspace(workspaceID)
 			ctx := context.WithValue(r.Context(), SubscriptionKey, UserSubscriptionContext{
 				Subscription: subscription,
 				LinksCreated: linksCreated,
@@ -3,93 +3,343 @@ package subscriptions
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/didoarellano/short/internal/audit"
 	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
 	"github.com/didoarellano/short/internal/session"
 	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type UserSubscriptionService struct {
 	queries      *db.Queries
 	sessionStore session.SessionStore
 	redisClient  *redis.Client
+	auditLogger  *audit.Logger
 }
 
 type Subscription struct {
-	Status              string
-	Name                string
-	MaxLinksPerMonth    int32
-	CanCustomiseSlug    bool
-	CanCreateDuplicates bool
-	CanViewAnalytics    bool
+	Status           string
+	Name             string
+	MaxLinksPerMonth int32
+	Entitlements     Entitlements
 }
 
-func NewUserSubscriptionService(q *db.Queries, s session.SessionStore, r *redis.Client) *UserSubscriptionService {
+var (
+	ErrUnknownPlan          = errors.New("no such plan")
+	ErrNoActiveSubscription = errors.New("workspace has no active subscription")
+)
+
+func subscriptionCacheKey(workspaceID int32) string {
+	return fmt.Sprintf("workspace:%d:subscription", workspaceID)
+}
+
+func usageCacheKey(workspaceID int32) string {
+	return fmt.Sprintf("workspace:%d:links_created", workspaceID)
+}
+
+func NewUserSubscriptionService(q *db.Queries, s session.SessionStore, r *redis.Client, a *audit.Logger) *UserSubscriptionService {
 	return &UserSubscriptionService{
 		queries:      q,
 		redisClient:  r,
 		sessionStore: s,
+		auditLogger:  a,
 	}
 }
 
-func (us *UserSubscriptionService) GetSubscriptionForUser(userID int32) (Subscription, error) {
+// AddBasicSubscription puts a new workspace on the basic plan and caches it.
+func (us *UserSubscriptionService) AddBasicSubscription(r *http.Request, workspaceID, actorUserID int32) (db.AddBasicSubscriptionRow, error) {
+	ctx := context.Background()
+
+	sub, err := us.queries.AddBasicSubscription(ctx, workspaceID)
+	if err != nil {
+		return sub, err
+	}
+
+	subscription := newSubscription(db.GetWorkspaceSubscriptionRow(sub))
+	us.auditLogger.Record(audit.Entry{
+		WorkspaceID: workspaceID,
+		ActorUserID: actorUserID,
+		Action:      audit.ActionSubscriptionChange,
+		TargetType:  audit.TargetWorkspace,
+		TargetID:    strconv.Itoa(int(workspaceID)),
+		After:       subscription,
+	}.WithRequest(r))
+
+	if b, err := json.Marshal(subscription); err == nil {
+		us.redisClient.Set(ctx, subscriptionCacheKey(workspaceID), string(b), 0)
+	}
+
+	return sub, nil
+}
+
+func (us *UserSubscriptionService) GetSubscriptionForWorkspace(workspaceID int32) (Subscription, error) {
 	ctx := context.Background()
 	var subscription Subscription
 
-	s, err := us.redisClient.Get(ctx, fmt.Sprintf("user:%d:subscription", userID)).Result()
+	s, err := us.redisClient.Get(ctx, subscriptionCacheKey(workspaceID)).Result()
 	if err != redis.Nil {
 		err = json.Unmarshal([]byte(s), &subscription)
 		if err != nil {
 			return subscription, err
 		}
-	} else {
-		sub, err := us.queries.GetUserSubscription(ctx, userID)
+	}
+
+	// Subscriptions cached before plans had entitlements are reloaded
+	if err == redis.Nil || subscription.Entitlements == nil {
+		sub, err := us.queries.GetWorkspaceSubscription(ctx, workspaceID)
 		if err != nil {
 			return subscription, err
 		}
 
-		subscription = Subscription(sub)
+		subscription = newSubscription(sub)
 		b, err := json.Marshal(subscription)
 		if err != nil {
 			return subscription, err
 		}
 
-		us.redisClient.Set(ctx, fmt.Sprintf("user:%d:subscription", userID), string(b), 0)
+		us.redisClient.Set(ctx, subscriptionCacheKey(workspaceID), string(b), 0)
 	}
 
 	return subscription, nil
 }
 
-func (us *UserSubscriptionService) GetCurrentUsageForUser(userID int32) (int32, error) {
-	var links_created int32
-	var e error
+// GetPlans returns every plan, cheapest first.
+func (us *UserSubscriptionService) GetPlans(ctx context.Context) ([]Plan, error) {
+	rows, err := us.queries.GetSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newPlans(rows), nil
+}
 
-	key := fmt.Sprintf("user:%d:links_created", userID)
+func (us *UserSubscriptionService) GetCurrentUsageForWorkspace(workspaceID int32) (int32, error) {
+	key := usageCacheKey(workspaceID)
 	ctx := context.Background()
 
 	s, err := us.redisClient.Get(ctx, key).Result()
-
 	if err != redis.Nil {
 		i, err := strconv.ParseInt(s, 10, 32)
+		return int32(i), err
+	}
+
+	usage, err := us.queries.GetWorkspaceCurrentUsage(ctx, workspaceID)
+	if err != nil {
+		return 0, err
+	}
+	us.SetCachedCurrentUsageForWorkspace(workspaceID, usage.LinksCreated, usage.CycleEndDate.Time)
+	return usage.LinksCreated, nil
+}
+
+// Counts only go up within a cycle so a lower value is from a request that
+// finished late and is ignored. Each count expires with its cycle so one
+// that arrives after the cycle's been reset can't outlive it.
+var setUsageIfHigher = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[1]))
+if current == nil or current < tonumber(ARGV[1]) then
+  redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+end
+return 0
+`)
+
+// SetCachedCurrentUsageForWorkspace caches a count of links created read from
+// the database, until cycleEnd.
+func (us *UserSubscriptionService) SetCachedCurrentUsageForWorkspace(workspaceID, value int32, cycleEnd time.Time) {
+	ttl := time.Until(cycleEnd)
+	if ttl <= 0 {
+		return
+	}
+	ctx := context.Background()
+	if err := setUsageIfHigher.Run(ctx, us.redisClient, []string{usageCacheKey(workspaceID)}, value, ttl.Milliseconds()).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to cache usage", slog.Int("workspace_id", int(workspaceID)), logging.Err(err))
+	}
+}
+
+func (us *UserSubscriptionService) InvalidateSubscription(ctx context.Context, workspaceID int32) {
+	if err := us.redisClient.Del(ctx, subscriptionCacheKey(workspaceID)).Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to invalidate cached subscription", logging.Err(err))
+	}
+}
+
+// ChangePlan moves a workspace onto another plan. Upgrades start a new period
+// straight away. Downgrades wait for the current period to end so nothing
+// already paid for is lost. Choosing the current plan cancels a pending
+// downgrade. It reports whether the change was scheduled for later.
+func (us *UserSubscriptionService) ChangePlan(r *http.Request, workspaceID, actorUserID, subscriptionID int32) (bool, error) {
+	ctx := context.Background()
+
+	plan, err := us.queries.GetWorkspacePlan(ctx, workspaceID)
+	if err != nil {
+		return false, err
+	}
+
+	plans, err := us.queries.GetSubscriptions(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var current, target *db.GetSubscriptionsRow
+	for i := range plans {
+		if plans[i].ID == plan.SubscriptionID {
+			current = &plans[i]
+		}
+		if plans[i].ID == subscriptionID {
+			target = &plans[i]
+		}
+	}
+	if current == nil || target == nil {
+		return false, ErrUnknownPlan
+	}
+
+	if target.MaxLinksPerMonth > current.MaxLinksPerMonth {
+		return false, us.ChangeSubscription(r, workspaceID, actorUserID, subscriptionID)
+	}
+
+	var pending pgtype.Int4
+	if target.ID != current.ID {
+		pending = pgtype.Int4{Int32: target.ID, Valid: true}
+	}
+	_, err = us.queries.SetPendingSubscription(ctx, db.SetPendingSubscriptionParams{
+		WorkspaceID:           workspaceID,
+		PendingSubscriptionID: pending,
+	})
+	if err != nil {
+		return false, err
+	}
+	us.InvalidateSubscription(ctx, workspaceID)
+
+	var after string
+	if pending.Valid {
+		after = target.Name
+	}
+	us.auditLogger.Record(audit.Entry{
+		WorkspaceID: workspaceID,
+		ActorUserID: actorUserID,
+		Action:      audit.ActionSubscriptionChange,
+		TargetType:  audit.TargetWorkspace,
+		TargetID:    strconv.Itoa(int(workspaceID)),
+		Before:      map[string]string{"pending": plan.PendingSubscriptionName.String},
+		After:       map[string]string{"pending": after},
+	}.WithRequest(r))
+
+	return pending.Valid, nil
+}
+
+// ChangeSubscription ends a workspace's current period and starts a new one
+// on subscriptionID immediately.
+func (us *UserSubscriptionService) ChangeSubscription(r *http.Request, workspaceID, actorUserID, subscriptionID int32) error {
+	ctx := context.Background()
+
+	before, err := us.queries.GetWorkspaceSubscription(ctx, workspaceID)
+	if err != nil {
+		return err
+	}
+
+	changed, err := us.queries.ChangeWorkspaceSubscription(ctx, db.ChangeWorkspaceSubscriptionParams{
+		WorkspaceID:    workspaceID,
+		SubscriptionID: subscriptionID,
+	})
+	if err != nil {
+		return err
+	}
+	if changed == 0 {
+		return ErrNoActiveSubscription
+	}
+	us.InvalidateSubscription(ctx, workspaceID)
+
+	after, err := us.queries.GetWorkspaceSubscription(ctx, workspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace subscription", logging.Err(err))
+	}
+
+	us.auditLogger.Record(audit.Entry{
+		WorkspaceID: workspaceID,
+		ActorUserID: actorUserID,
+		Action:      audit.ActionSubscriptionChange,
+		TargetType:  audit.TargetWorkspace,
+		TargetID:    strconv.Itoa(int(workspaceID)),
+		Before:      newSubscription(before),
+		After:       newSubscription(after),
+	}.WithRequest(r))
+
+	return nil
+}
+
+// ExpireDueSubscriptions moves every workspace whose period has ended onto
+// basic. Nothing here is paid for, so pending paid plans aren't applied. It
+// returns how many were moved.
+func (us *UserSubscriptionService) ExpireDueSubscriptions(ctx context.Context) (int, error) {
+	workspaceIDs, err := us.queries.GetDueSubscriptions(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, workspaceID := range workspaceIDs {
+		before, err := us.queries.GetWorkspaceSubscription(ctx, workspaceID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to retrieve workspace subscription", slog.Int("workspace_id", int(workspaceID)), logging.Err(err))
+			continue
+		}
+
+		changed, err := us.queries.ExpireDueSubscription(ctx, workspaceID)
 		if err != nil {
-			e = err
+			slog.ErrorContext(ctx, "Failed to expire subscription", slog.Int("workspace_id", int(workspaceID)), logging.Err(err))
+			continue
 		}
-		links_created = int32(i)
-	} else {
-		links_created, err = us.queries.GetUserCurrentUsage(ctx, userID)
+		if changed == 0 {
+			continue
+		}
+		expired++
+		us.InvalidateSubscription(ctx, workspaceID)
+
+		after, err := us.queries.GetWorkspaceSubscription(ctx, workspaceID)
 		if err != nil {
-			e = err
+			slog.ErrorContext(ctx, "Failed to retrieve workspace subscription", slog.Int("workspace_id", int(workspaceID)), logging.Err(err))
 		}
-		us.redisClient.Set(ctx, key, links_created, 0)
+
+		us.auditLogger.Record(audit.Entry{
+			WorkspaceID: workspaceID,
+			Action:      audit.ActionSubscriptionChange,
+			TargetType:  audit.TargetWorkspace,
+			TargetID:    strconv.Itoa(int(workspaceID)),
+			Before:      newSubscription(before),
+			After:       newSubscription(after),
+		})
 	}
 
-	return links_created, e
+	return expired, nil
 }
 
-func (us *UserSubscriptionService) SetCachedCurrentUsageForUser(userID, value int32) {
-	key := fmt.Sprintf("user:%d:links_created", userID)
-	ctx := context.Background()
-	us.redisClient.Set(ctx, key, value, 0)
+// ResetDueUsage starts a new usage cycle for every workspace whose cycle has
+// ended and drops their cached counts. It returns how many were reset.
+func (us *UserSubscriptionService) ResetDueUsage(ctx context.Context) (int, error) {
+	cycles, err := us.queries.RollUsageCycles(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]string, 0, len(cycles))
+	for _, cycle := range cycles {
+		keys = append(keys, usageCacheKey(cycle.WorkspaceID))
+		slog.InfoContext(ctx, "Reset usage",
+			slog.Int("workspace_id", int(cycle.WorkspaceID)),
+			slog.Int("links_created", int(cycle.PreviousLinksCreated)),
+			slog.String("cycle_start", cycle.CycleStartDate.Time.Format(time.DateOnly)),
+			slog.String("cycle_end", cycle.CycleEndDate.Time.Format(time.DateOnly)))
+	}
+	if len(keys) > 0 {
+		if err := us.redisClient.Del(ctx, keys...).Err(); err != nil {
+			slog.ErrorContext(ctx, "Failed to invalidate cached usage", logging.Err(err))
+		}
+	}
+
+	return len(cycles), nil
 }
@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/csrf"
 	"github.com/didoarellano/short/internal/session"
 )
 
@@ -22,13 +23,14 @@ func New(t *template.Template, AppData *config.GlobalAppData, s session.SessionS
 	}
 }
 
-func (templ *Templ) ExecuteTemplate(w http.ResponseWriter, templateName string, localData map[string]interface{}) error {
+func (templ *Templ) ExecuteTemplate(w http.ResponseWriter, r *http.Request, templateName string, localData map[string]interface{}) error {
 	data := make(map[string]interface{})
 	for k, v := range localData {
 		data[k] = v
 	}
 	data["AppPathPrefix"] = templ.AppData.AppPathPrefix
 	data["RedirectorBaseURL"] = templ.AppData.RedirectorBaseURL
+	data["csrfToken"] = csrf.Token(r)
 	return templ.t.ExecuteTemplate(w, templateName, data)
 }
 
@@ -39,7 +41,7 @@ func (templ *Templ) RenderStatic(templateName string) http.HandlerFunc {
 		data := map[string]interface{}{
 			"user": user,
 		}
-		if err := templ.ExecuteTemplate(w, templateName, data); err != nil {
+		if err := templ.ExecuteTemplate(w, r, templateName, data); err != nil {
 			http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		}
 	}
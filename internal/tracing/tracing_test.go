@@ -0,0 +1,17 @@
+package tracing
+
+import "testing"
+
+func TestQueryName(t *testing.T) {
+	tests := map[string]string{
+		"-- name: GetDestinationUrl :one\nSELECT l.id FROM links l": "GetDestinationUrl",
+		"  -- name: RecordVisit :exec\nINSERT INTO analytics":       "RecordVisit",
+		"select 1": "SELECT",
+		"begin":    "BEGIN",
+	}
+	for sql, want := range tests {
+		if got := queryName(sql); got != want {
+			t.Errorf("queryName(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
@@ -0,0 +1,608 @@
+package workspaces
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/didoarellano/short/internal/audit"
+	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/mailer"
+	"github.com/didoarellano/short/internal/session"
+	"github.com/didoarellano/short/internal/templ"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const invitationTTL = 7 * 24 * time.Hour
+
+type WorkspaceHandler struct {
+	template            *templ.Templ
+	queries             *db.Queries
+	sessionStore        session.SessionStore
+	subscriptionService auth.SubscriptionService
+	auditLogger         *audit.Logger
+	mailer              mailer.Mailer
+}
+
+func NewWorkspaceHandlers(t *templ.Templ, q *db.Queries, s session.SessionStore, ss auth.SubscriptionService, a *audit.Logger, m mailer.Mailer) *WorkspaceHandler {
+	return &WorkspaceHandler{
+		template:            t,
+		queries:             q,
+		sessionStore:        s,
+		subscriptionService: ss,
+		auditLogger:         a,
+		mailer:              m,
+	}
+}
+
+type memberAuditState struct {
+	UserID int32  `json:"user_id"`
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+}
+
+func memberTargetID(workspaceID, userID int32) string {
+	return fmt.Sprintf("%d:%d", workspaceID, userID)
+}
+
+func basePath() string {
+	return "/" + config.AppData.AppPathPrefix + "/workspaces"
+}
+
+func redirectWithMessage(w http.ResponseWriter, r *http.Request, session *sessions.Session, message string) {
+	session.AddFlash(message)
+	session.Save(r, w)
+	http.Redirect(w, r, basePath(), http.StatusFound)
+}
+
+func (wh *WorkspaceHandler) Workspaces(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(MembershipKey).(Membership)
+	ctx := context.Background()
+
+	workspaces, err := wh.queries.GetWorkspacesForUser(ctx, user.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve user's workspaces", logging.Err(err))
+		http.Error(w, "Failed to retrieve workspaces", http.StatusInternalServerError)
+		return
+	}
+
+	members, err := wh.queries.GetWorkspaceMembers(ctx, membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace members", logging.Err(err))
+		http.Error(w, "Failed to retrieve workspace members", http.StatusInternalServerError)
+		return
+	}
+
+	var invitations []db.GetPendingInvitationsForWorkspaceRow
+	if membership.Can(ManageMembers) {
+		invitations, err = wh.queries.GetPendingInvitationsForWorkspace(ctx, membership.WorkspaceID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to retrieve workspace invitations", logging.Err(err))
+		}
+	}
+
+	var message string
+	if flashes := session.Flashes(); len(flashes) > 0 {
+		message, _ = flashes[0].(string)
+	}
+	session.Save(r, w)
+
+	data := map[string]interface{}{
+		"user":             user,
+		"membership":       membership,
+		"workspaces":       workspaces,
+		"members":          members,
+		"invitations":      invitations,
+		"invitableRoles":   InvitableRoles,
+		"canManageMembers": membership.Can(ManageMembers),
+		"canManageOwners":  membership.Can(ManageOwners),
+		"message":          message,
+	}
+
+	if err := wh.template.ExecuteTemplate(w, r, "workspaces.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (wh *WorkspaceHandler) CreateWorkspace(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	ctx := context.Background()
+
+	r.ParseForm()
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		redirectWithMessage(w, r, session, "Workspace name is required")
+		return
+	}
+
+	workspaceID, err := wh.queries.CreateWorkspace(ctx, db.CreateWorkspaceParams{
+		Name:   name,
+		UserID: user.UserID,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create workspace", logging.Err(err))
+		http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
+		return
+	}
+
+	wh.auditLogger.Record(audit.Entry{
+		WorkspaceID: workspaceID,
+		ActorUserID: user.UserID,
+		Action:      audit.ActionCreate,
+		TargetType:  audit.TargetWorkspace,
+		TargetID:    strconv.Itoa(int(workspaceID)),
+		After:       map[string]string{"name": name},
+	}.WithRequest(r))
+
+	if _, err := wh.subscriptionService.AddBasicSubscription(r, workspaceID, user.UserID); err != nil {
+		slog.ErrorContext(r.Context(), "Adding basic subscription to workspace failed", logging.Err(err))
+		http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
+		return
+	}
+
+	user.WorkspaceID = workspaceID
+	session.Values["user"] = user
+	redirectWithMessage(w, r, session, fmt.Sprintf("Created %s", name))
+}
+
+func (wh *WorkspaceHandler) SwitchWorkspace(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+
+	r.ParseForm()
+	workspaceID, err := strconv.ParseInt(r.FormValue("workspace_id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	membership, err := wh.queries.GetWorkspaceMembership(context.Background(), db.GetWorkspaceMembershipParams{
+		WorkspaceID: int32(workspaceID),
+		UserID:      user.UserID,
+	})
+	if err == pgx.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to get workspace membership", logging.Err(err))
+		http.Error(w, "Failed to switch workspace", http.StatusInternalServerError)
+		return
+	}
+
+	user.WorkspaceID = membership.ID
+	session.Values["user"] = user
+	if err := session.Save(r, w); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save session", logging.Err(err))
+		http.Error(w, "Failed to switch workspace", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/"+config.AppData.AppPathPrefix+"/links", http.StatusSeeOther)
+}
+
+func (wh *WorkspaceHandler) InviteMember(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(MembershipKey).(Membership)
+	ctx := context.Background()
+
+	if !membership.Can(ManageMembers) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	role := Role(r.FormValue("role"))
+
+	if !strings.Contains(email, "@") {
+		redirectWithMessage(w, r, session, "Enter a valid email address")
+		return
+	}
+	if !role.IsValid() || role == RoleOwner {
+		redirectWithMessage(w, r, session, "Choose a valid role")
+		return
+	}
+
+	members, err := wh.queries.GetWorkspaceMembers(ctx, membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace members", logging.Err(err))
+		http.Error(w, "Failed to invite member", http.StatusInternalServerError)
+		return
+	}
+	for _, member := range members {
+		if strings.EqualFold(member.Email, email) {
+			redirectWithMessage(w, r, session, fmt.Sprintf("%s is already a member", email))
+			return
+		}
+	}
+
+	invitations, err := wh.queries.GetPendingInvitationsForWorkspace(ctx, membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace invitations", logging.Err(err))
+		http.Error(w, "Failed to invite member", http.StatusInternalServerError)
+		return
+	}
+	memberLimit, err := wh.subscriptionService.MemberLimit(membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace's member limit", logging.Err(err))
+		http.Error(w, "Failed to invite member", http.StatusInternalServerError)
+		return
+	}
+	if int32(len(members)+len(invitations)) >= memberLimit {
+		redirectWithMessage(w, r, session, "You can't invite any more members. Upgrade your plan for more.")
+		return
+	}
+
+	token := generateInvitationToken()
+	_, err = wh.queries.CreateWorkspaceInvitation(ctx, db.CreateWorkspaceInvitationParams{
+		WorkspaceID: membership.WorkspaceID,
+		Email:       email,
+		Role:        string(role),
+		TokenHash:   hashInvitationToken(token),
+		InvitedBy:   pgtype.Int4{Int32: user.UserID, Valid: true},
+		ExpiresAt:   pgtype.Timestamp{Time: time.Now().Add(invitationTTL), Valid: true},
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		redirectWithMessage(w, r, session, fmt.Sprintf("%s has already been invited", email))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to create invitation", logging.Err(err))
+		http.Error(w, "Failed to invite member", http.StatusInternalServerError)
+		return
+	}
+
+	invitationURL := fmt.Sprintf("%s/%s/invitations/%s", config.AppData.RedirectorBaseURL, config.AppData.AppPathPrefix, token)
+	if wh.mailer == nil {
+		redirectWithMessage(w, r, session, fmt.Sprintf("Invited %s. Send them this link to join: %s", email, invitationURL))
+		return
+	}
+
+	err = wh.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: fmt.Sprintf("You've been invited to %s on Short", membership.WorkspaceName),
+		Body:    fmt.Sprintf("You've been invited to join %s on Short as %s.\n\nUse this link to accept:\n\n%s\n\nIt expires in %d days. If you weren't expecting it you can ignore this email.", membership.WorkspaceName, role, invitationURL, int(invitationTTL.Hours()/24)),
+	})
+	if err != nil {
+		// The invitation is still good, so hand the link over rather than
+		// making them revoke it and try again.
+		slog.ErrorContext(r.Context(), "Failed to send invitation", logging.Err(err))
+		redirectWithMessage(w, r, session, fmt.Sprintf("Invited %s but we couldn't email them. Send them this link to join: %s", email, invitationURL))
+		return
+	}
+
+	redirectWithMessage(w, r, session, fmt.Sprintf("We've emailed an invitation to %s", email))
+}
+
+func (wh *WorkspaceHandler) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	membership := r.Context().Value(MembershipKey).(Membership)
+
+	if !membership.Can(ManageMembers) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	err = wh.queries.DeleteWorkspaceInvitation(context.Background(), db.DeleteWorkspaceInvitationParams{
+		ID:          int32(id),
+		WorkspaceID: membership.WorkspaceID,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete invitation", logging.Err(err))
+		http.Error(w, "Failed to revoke invitation", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, basePath(), http.StatusSeeOther)
+}
+
+func (wh *WorkspaceHandler) UpdateMemberRole(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(MembershipKey).(Membership)
+
+	if !membership.Can(ManageMembers) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	member, ok := wh.getMember(w, r, membership.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	r.ParseForm()
+	role := Role(r.FormValue("role"))
+	if !role.IsValid() {
+		redirectWithMessage(w, r, session, "Choose a valid role")
+		return
+	}
+
+	if (role == RoleOwner || Role(member.Role) == RoleOwner) && !membership.Can(ManageOwners) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if Role(member.Role) == RoleOwner && role != RoleOwner && !wh.hasOtherOwners(w, r, session, membership.WorkspaceID) {
+		return
+	}
+
+	err := wh.queries.UpdateWorkspaceMemberRole(context.Background(), db.UpdateWorkspaceMemberRoleParams{
+		WorkspaceID: membership.WorkspaceID,
+		UserID:      member.ID,
+		Role:        string(role),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update member role", logging.Err(err))
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	wh.auditLogger.Record(audit.Entry{
+		WorkspaceID: membership.WorkspaceID,
+		ActorUserID: user.UserID,
+		Action:      audit.ActionUpdate,
+		TargetType:  audit.TargetWorkspaceMember,
+		TargetID:    memberTargetID(membership.WorkspaceID, member.ID),
+		Before:      memberAuditState{UserID: member.ID, Email: member.Email, Role: member.Role},
+		After:       memberAuditState{UserID: member.ID, Email: member.Email, Role: string(role)},
+	}.WithRequest(r))
+
+	http.Redirect(w, r, basePath(), http.StatusSeeOther)
+}
+
+func (wh *WorkspaceHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(MembershipKey).(Membership)
+
+	member, ok := wh.getMember(w, r, membership.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	// Anyone can leave a workspace
+	isLeaving := member.ID == user.UserID
+	if !isLeaving && !membership.Can(ManageMembers) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !isLeaving && Role(member.Role) == RoleOwner && !membership.Can(ManageOwners) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if Role(member.Role) == RoleOwner && !wh.hasOtherOwners(w, r, session, membership.WorkspaceID) {
+		return
+	}
+
+	err := wh.queries.RemoveWorkspaceMember(context.Background(), db.RemoveWorkspaceMemberParams{
+		WorkspaceID: membership.WorkspaceID,
+		UserID:      member.ID,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to remove member", logging.Err(err))
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	wh.auditLogger.Record(audit.Entry{
+		WorkspaceID: membership.WorkspaceID,
+		ActorUserID: user.UserID,
+		Action:      audit.ActionDelete,
+		TargetType:  audit.TargetWorkspaceMember,
+		TargetID:    memberTargetID(membership.WorkspaceID, member.ID),
+		Before:      memberAuditState{UserID: member.ID, Email: member.Email, Role: member.Role},
+	}.WithRequest(r))
+
+	// WorkspaceMiddleware moves the user back to their default workspace
+	http.Redirect(w, r, basePath(), http.StatusSeeOther)
+}
+
+func (wh *WorkspaceHandler) getMember(w http.ResponseWriter, r *http.Request, workspaceID int32) (db.GetWorkspaceMembersRow, bool) {
+	var member db.GetWorkspaceMembersRow
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["userID"], 10, 32)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return member, false
+	}
+
+	members, err := wh.queries.GetWorkspaceMembers(context.Background(), workspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace members", logging.Err(err))
+		http.Error(w, "Failed to retrieve workspace members", http.StatusInternalServerError)
+		return member, false
+	}
+
+	for _, m := range members {
+		if m.ID == int32(userID) {
+			return m, true
+		}
+	}
+
+	http.Error(w, "Not found", http.StatusNotFound)
+	return member, false
+}
+
+// hasOtherOwners guards against leaving a workspace without an owner.
+func (wh *WorkspaceHandler) hasOtherOwners(w http.ResponseWriter, r *http.Request, session *sessions.Session, workspaceID int32) bool {
+	owners, err := wh.queries.CountWorkspaceOwners(context.Background(), workspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to count workspace owners", logging.Err(err))
+		http.Error(w, "Failed to update workspace", http.StatusInternalServerError)
+		return false
+	}
+	if owners < 2 {
+		redirectWithMessage(w, r, session, "A workspace needs at least one owner")
+		return false
+	}
+	return true
+}
+
+func (wh *WorkspaceHandler) ShowInvitation(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+
+	invitation, err := wh.queries.GetPendingInvitationByTokenHash(context.Background(), hashInvitationToken(mux.Vars(r)["token"]))
+	if err != nil && err != pgx.ErrNoRows {
+		slog.ErrorContext(r.Context(), "Failed to retrieve invitation", logging.Err(err))
+		http.Error(w, "Failed to retrieve invitation", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"user":       user,
+		"invitation": invitation,
+		"isValid":    err == nil,
+	}
+
+	if err := wh.template.ExecuteTemplate(w, r, "invitation.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
+
+func (wh *WorkspaceHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	ctx := context.Background()
+
+	invitation, err := wh.queries.GetPendingInvitationByTokenHash(ctx, hashInvitationToken(mux.Vars(r)["token"]))
+	if err == pgx.ErrNoRows {
+		http.Error(w, "This invitation is invalid or has expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve invitation", logging.Err(err))
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	account, err := wh.queries.GetUser(ctx, user.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve user", logging.Err(err))
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+	if !account.EmailVerified {
+		http.Error(w, "Sign in with a provider that verifies your email address to accept this invitation", http.StatusForbidden)
+		return
+	}
+	if !strings.EqualFold(account.Email, invitation.Email) {
+		http.Error(w, "This invitation was sent to a different email address", http.StatusForbidden)
+		return
+	}
+
+	err = wh.queries.AcceptWorkspaceInvitation(ctx, db.AcceptWorkspaceInvitationParams{
+		InvitationID: invitation.ID,
+		UserID:       user.UserID,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to accept invitation", logging.Err(err))
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	wh.auditLogger.Record(audit.Entry{
+		WorkspaceID: invitation.WorkspaceID,
+		ActorUserID: user.UserID,
+		Action:      audit.ActionCreate,
+		TargetType:  audit.TargetWorkspaceMember,
+		TargetID:    memberTargetID(invitation.WorkspaceID, user.UserID),
+		After:       memberAuditState{UserID: user.UserID, Email: account.Email, Role: invitation.Role},
+	}.WithRequest(r))
+
+	user.WorkspaceID = invitation.WorkspaceID
+	session.Values["user"] = user
+	redirectWithMessage(w, r, session, fmt.Sprintf("You've joined %s", invitation.WorkspaceName))
+}
+
+func (wh *WorkspaceHandler) AuditLog(w http.ResponseWriter, r *http.Request) {
+	session, _ := wh.sessionStore.Get(r, "session")
+	user := session.Values["user"].(auth.UserSession)
+	membership := r.Context().Value(MembershipKey).(Membership)
+	ctx := context.Background()
+
+	if !membership.Can(ManageMembers) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	action := query.Get("action")
+	targetType := query.Get("target_type")
+	actorID, actorErr := strconv.ParseInt(query.Get("actor"), 10, 32)
+	page := audit.Page(r)
+
+	// One extra row tells us whether there's a next page
+	rows, err := wh.queries.GetAuditLogForWorkspace(ctx, db.GetAuditLogForWorkspaceParams{
+		WorkspaceID: pgtype.Int4{Int32: membership.WorkspaceID, Valid: true},
+		Action:      pgtype.Text{String: action, Valid: action != ""},
+		TargetType:  pgtype.Text{String: targetType, Valid: targetType != ""},
+		ActorUserID: pgtype.Int4{Int32: int32(actorID), Valid: actorErr == nil},
+		Limit:       audit.PageSize + 1,
+		Offset:      int32((page - 1) * audit.PageSize),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve audit log", logging.Err(err))
+		http.Error(w, "Failed to retrieve audit log", http.StatusInternalServerError)
+		return
+	}
+
+	hasNextPage := len(rows) > audit.PageSize
+	if hasNextPage {
+		rows = rows[:audit.PageSize]
+	}
+
+	members, err := wh.queries.GetWorkspaceMembers(ctx, membership.WorkspaceID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to retrieve workspace members", logging.Err(err))
+	}
+
+	data := map[string]interface{}{
+		"user":        user,
+		"membership":  membership,
+		"heading":     fmt.Sprintf("Audit log for %s", membership.WorkspaceName),
+		"entries":     audit.ListItems(rows),
+		"actions":     audit.Actions,
+		"targetTypes": audit.TargetTypes,
+		"members":     members,
+		"filters": map[string]string{
+			"action":      action,
+			"target_type": targetType,
+			"actor":       query.Get("actor"),
+		},
+		"prevHref": audit.PageHref(r, page-1),
+		"nextHref": audit.PageHref(r, page+1),
+		"hasPrev":  page > 1,
+		"hasNext":  hasNextPage,
+	}
+
+	if err := wh.template.ExecuteTemplate(w, r, "audit.html", data); err != nil {
+		http.Error(w, "Failed to render template", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,73 @@
+package workspaces
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/session"
+	"github.com/jackc/pgx/v5"
+)
+
+type key string
+
+const MembershipKey key = "membership"
+
+// WorkspaceMiddleware loads the signed in user's membership of their current
+// workspace. If they're no longer a member (e.g. they were removed) the
+// session is switched back to their default workspace.
+func WorkspaceMiddleware(queries *db.Queries, sessionStore session.SessionStore) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, _ := sessionStore.Get(r, "session")
+			user := session.Values["user"].(auth.UserSession)
+			ctx := context.Background()
+
+			membership, err := queries.GetWorkspaceMembership(ctx, db.GetWorkspaceMembershipParams{
+				WorkspaceID: user.WorkspaceID,
+				UserID:      user.UserID,
+			})
+
+			if err == pgx.ErrNoRows {
+				workspaceID, err := queries.GetDefaultWorkspaceForUser(ctx, user.UserID)
+				if err == pgx.ErrNoRows {
+					http.Error(w, "You're not a member of any workspace", http.StatusForbidden)
+					return
+				}
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to get default workspace", logging.Err(err))
+					http.Error(w, "Failed to load workspace", http.StatusInternalServerError)
+					return
+				}
+
+				membership, err = queries.GetWorkspaceMembership(ctx, db.GetWorkspaceMembershipParams{
+					WorkspaceID: workspaceID,
+					UserID:      user.UserID,
+				})
+				if err != nil {
+					slog.ErrorContext(r.Context(), "Failed to get workspace membership", logging.Err(err))
+					http.Error(w, "Failed to load workspace", http.StatusInternalServerError)
+					return
+				}
+
+				user.WorkspaceID = workspaceID
+				session.Values["user"] = user
+				session.Save(r, w)
+			} else if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to get workspace membership", logging.Err(err))
+				http.Error(w, "Failed to load workspace", http.StatusInternalServerError)
+				return
+			}
+
+			ctx = context.WithValue(r.Context(), MembershipKey, Membership{
+				WorkspaceID:   membership.ID,
+				WorkspaceName: membership.Name,
+				Role:          Role(membership.Role),
+			})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package workspaces
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleAdmin  Role = "admin"
+	RoleEditor Role = "editor"
+	RoleViewer Role = "viewer"
+)
+
+type Permission int
+
+const (
+	ViewLinks Permission = iota
+	EditLinks
+	ManageDomains
+	ManageMembers
+	ManageOwners
+	ManageBilling
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleOwner:  {ViewLinks, EditLinks, ManageDomains, ManageMembers, ManageOwners, ManageBilling},
+	RoleAdmin:  {ViewLinks, EditLinks, ManageDomains, ManageMembers},
+	RoleEditor: {ViewLinks, EditLinks},
+	RoleViewer: {ViewLinks},
+}
+
+func (r Role) Can(p Permission) bool {
+	for _, permission := range rolePermissions[r] {
+		if permission == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Role) IsValid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// InvitableRoles are the roles that can be given through an invitation.
+// Ownership can only be granted to existing members.
+var InvitableRoles = []Role{RoleAdmin, RoleEditor, RoleViewer}
+
+type Membership struct {
+	WorkspaceID   int32
+	WorkspaceName string
+	Role          Role
+}
+
+func (m Membership) Can(p Permission) bool {
+	return m.Role.Can(p)
+}
+
+func generateInvitationToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Only the hash of an invitation token is stored so a database leak can't be
+// used to join workspaces.
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,38 @@
+package workspaces
+
+import "testing"
+
+func TestRolePermissions(t *testing.T) {
+	tests := []struct {
+		role       Role
+		permission Permission
+		want       bool
+	}{
+		{role: RoleViewer, permission: ViewLinks, want: true},
+		{role: RoleViewer, permission: EditLinks, want: false},
+		{role: RoleEditor, permission: EditLinks, want: true},
+		{role: RoleEditor, permission: ManageDomains, want: false},
+		{role: RoleAdmin, permission: ManageMembers, want: true},
+		{role: RoleAdmin, permission: ManageOwners, want: false},
+		{role: RoleAdmin, permission: ManageBilling, want: false},
+		{role: RoleOwner, permission: ManageOwners, want: true},
+		{role: RoleOwner, permission: ManageBilling, want: true},
+		{role: Role("stranger"), permission: ViewLinks, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.role.Can(tt.permission); got != tt.want {
+			t.Errorf("%s.Can(%d): expected %v, got %v", tt.role, tt.permission, tt.want, got)
+		}
+	}
+}
+
+func TestInvitationTokenHash(t *testing.T) {
+	token := generateInvitationToken()
+	if hashInvitationToken(token) == token {
+		t.Error("Expected token to be hashed")
+	}
+	if hashInvitationToken(token) != hashInvitationToken(token) {
+		t.Error("Expected hashing to be deterministic")
+	}
+}
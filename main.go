@@ -6,18 +6,39 @@ import (
 	"encoding/gob"
 	"html/template"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/didoarellano/short/internal/admin"
+	"github.com/didoarellano/short/internal/audit"
 	"github.com/didoarellano/short/internal/auth"
+	"github.com/didoarellano/short/internal/billing"
+	"github.com/didoarellano/short/internal/clientip"
 	"github.com/didoarellano/short/internal/config"
+	"github.com/didoarellano/short/internal/csrf"
 	"github.com/didoarellano/short/internal/db"
+	"github.com/didoarellano/short/internal/domains"
 	"github.com/didoarellano/short/internal/geodata"
+	"github.com/didoarellano/short/internal/health"
 	"github.com/didoarellano/short/internal/links"
+	"github.com/didoarellano/short/internal/logging"
+	"github.com/didoarellano/short/internal/mailer"
+	"github.com/didoarellano/short/internal/metrics"
+	"github.com/didoarellano/short/internal/ratelimit"
 	"github.com/didoarellano/short/internal/redirector"
+	"github.com/didoarellano/short/internal/scheduler"
+	"github.com/didoarellano/short/internal/session"
+	"github.com/didoarellano/short/internal/shortcode"
 	"github.com/didoarellano/short/internal/subscriptions"
 	"github.com/didoarellano/short/internal/templ"
+	"github.com/didoarellano/short/internal/tracing"
+	"github.com/didoarellano/short/internal/workspaces"
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -31,36 +52,87 @@ var stdtemplate = template.Must(template.ParseFS(resources, "templates/*"))
 //go:embed static/*
 var static embed.FS
 
+// fly.toml's kill_timeout allows for both of these
+const (
+	shutdownDrainDelay = 5 * time.Second
+	shutdownTimeout    = 20 * time.Second
+)
+
 var queries *db.Queries
 var sessionStore *redisstore.RedisStore
 
 func main() {
 	gob.Register(auth.UserSession{})
 	gob.Register(links.FormValidationErrors{})
+	logging.Setup()
 	ctx := context.Background()
 
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		fatal("Failed to set up tracing", err)
+	}
+
 	opt, err := redis.ParseURL(os.Getenv("REDIS_URL"))
 	if err != nil {
-		log.Fatal(err)
+		fatal("Invalid REDIS_URL", err)
 	}
 	redisClient := redis.NewClient(opt)
+	redisClient.AddHook(tracing.RedisHook{})
 
 	sessionStore, err = redisstore.NewRedisStore(ctx, redisClient)
 	if err != nil {
-		log.Fatal("Faled to create redis store", err)
+		fatal("Failed to create redis store", err)
 	}
+	sessionConfig := session.LoadConfig()
+	sessionStore.Options(sessionConfig.CookieOptions())
 
-	dbpool, err := pgxpool.New(ctx, os.Getenv("DATABASE_URL"))
+	poolConfig, err := pgxpool.ParseConfig(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		fatal("Invalid DATABASE_URL", err)
+	}
+	poolConfig.ConnConfig.Tracer = tracing.PgxTracer{}
+	dbpool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to create database pool", err)
 	}
 	defer dbpool.Close()
 	queries = db.New(dbpool)
+	metrics.RegisterPool(dbpool)
 
 	auth.Initialise()
+	if err := clientip.SetTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		fatal("Invalid TRUSTED_PROXIES", err)
+	}
+	rateLimits, err := config.LoadRateLimitConfig()
+	if err != nil {
+		fatal("Failed to load rate limit config", err)
+	}
+	limiter := ratelimit.New(redisClient, rateLimits)
+	if _, err := config.LoadCustomSlugConfig(); err != nil {
+		fatal("Failed to load custom slug config", err)
+	}
+	// Edits to CUSTOM_SLUG_CONFIG are picked up on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := config.ReloadCustomSlugConfig(); err != nil {
+				slog.Error("Failed to reload custom slug config", logging.Err(err))
+				continue
+			}
+			slog.Info("Reloaded custom slug config")
+		}
+	}()
+
 	t := templ.New(stdtemplate, config.AppData, sessionStore)
 
 	rootRouter := mux.NewRouter()
+	rootRouter.Use(tracing.Middleware, metrics.Middleware)
+
+	// Before anything else so custom domains and short codes can't shadow them
+	checker := health.NewChecker(dbpool, redisClient)
+	rootRouter.HandleFunc("/healthz", checker.Liveness).Methods("GET")
+	rootRouter.HandleFunc("/readyz", checker.Readiness).Methods("GET")
 
 	var geodataFetcher geodata.GeoDataFetcher
 	if os.Getenv("ENV") == "dev" {
@@ -70,13 +142,79 @@ func main() {
 	}
 
 	redirector := redirector.New(queries, redisClient, geodataFetcher)
-	rootRouter.HandleFunc("/{shortcode}", redirector.RedirectHandler).Methods("GET")
+	redirect := limiter.Middleware("redirect", ratelimit.ByIP)(http.HandlerFunc(redirector.RedirectHandler))
+
+	// Custom domains only serve short links, never the app
+	customDomainRouter := rootRouter.MatcherFunc(domains.CustomDomainMatcher()).Subrouter()
+	customDomainRouter.Use(domains.CustomDomainMiddleware(queries, redisClient, t.RenderStatic("404.html")))
+	customDomainRouter.Handle("/{shortcode}", redirect).Methods("GET")
+	customDomainRouter.NotFoundHandler = t.RenderStatic("404.html")
+
+	rootRouter.Handle("/{shortcode}", redirect).Methods("GET")
 
 	rootRouter.HandleFunc("/", t.RenderStatic("index.html")).Methods("GET")
-	rootRouter.NotFoundHandler = t.RenderStatic("404.html")
+	csrfMiddleware := csrf.Middleware(sessionStore)
+	rootRouter.NotFoundHandler = csrfMiddleware(t.RenderStatic("404.html"))
+
+	auditLogger := audit.NewLogger(queries)
+	userSubscriptionService := subscriptions.NewUserSubscriptionService(queries, sessionStore, redisClient, auditLogger)
+
+	// Background jobs run on every instance, the scheduler makes sure only
+	// one of them does each run. `run-app <job>` runs one by hand.
+	jobs := scheduler.New(redisClient)
+	jobs.Every("reset-usage", time.Hour, userSubscriptionService.ResetDueUsage)
+	jobs.Every("expire-subscriptions", 15*time.Minute, userSubscriptionService.ExpireDueSubscriptions)
+	if len(os.Args) > 1 {
+		if err := jobs.RunNow(ctx, os.Args[1]); err != nil {
+			fatal("Failed to run job", err)
+		}
+		return
+	}
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	jobs.Start(jobsCtx)
 
-	authHandlers := auth.NewAuthHandlers(t, queries, sessionStore, redisClient)
+	// Popular links are cached before their first visits come in
+	go func() {
+		warmed, err := redirector.WarmCache(jobsCtx)
+		if err != nil {
+			slog.Error("Failed to warm redirect cache", logging.Err(err))
+			return
+		}
+		slog.Info("Warmed redirect cache", slog.Int("links", warmed))
+	}()
+
+	// Without a payment provider plan changes apply without charging
+	var payments subscriptions.Payments
+	if key := os.Getenv("STRIPE_SECRET_KEY"); key != "" {
+		prices := map[string]string{}
+		for _, plan := range []string{"pro1", "pro2"} {
+			if price := os.Getenv("STRIPE_PRICE_" + strings.ToUpper(plan)); price != "" {
+				prices[plan] = price
+			}
+		}
+		stripe := billing.NewStripeProvider(key, os.Getenv("STRIPE_WEBHOOK_SECRET"), prices)
+		billingService := billing.NewService(dbpool, queries, stripe, userSubscriptionService, auditLogger)
+		payments = billingService
+
+		// Outside the app so webhooks aren't held to CSRF checks, they're
+		// verified by signature instead
+		billingHandlers := billing.NewBillingHandlers(billingService)
+		rootRouter.HandleFunc("/webhooks/billing", billingHandlers.Webhook).Methods("POST")
+	}
+
+	// Without a mailer email sign in is disabled and invitation links are
+	// shown to whoever sent the invitation instead
+	var m mailer.Mailer
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		m = mailer.NewSMTPMailer(host, os.Getenv("SMTP_PORT"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("MAIL_FROM"))
+	} else if os.Getenv("ENV") == "dev" {
+		m = mailer.NewLogMailer(os.Getenv("MAIL_DIR"))
+	}
+
+	sessionManager := auth.NewSessionManager(sessionStore, redisClient, sessionConfig)
+	authHandlers := auth.NewAuthHandlers(t, queries, sessionStore, redisClient, userSubscriptionService, auditLogger, m, sessionManager)
 	appRouter := rootRouter.PathPrefix("/" + config.AppData.AppPathPrefix).Subrouter()
+	appRouter.Use(csrfMiddleware)
 
 	subFS, _ := fs.Sub(static, "static")
 	fs := http.FileServer(http.FS(subFS))
@@ -84,22 +222,148 @@ func main() {
 
 	appRouter.HandleFunc("/signin", authHandlers.Signin).Methods("GET")
 	appRouter.HandleFunc("/signout", authHandlers.Signout).Methods("POST")
-	appRouter.HandleFunc("/auth/{provider}", authHandlers.BeginAuth).Methods("GET")
-	appRouter.HandleFunc("/auth/{provider}/callback", authHandlers.OAuthCallback).Methods("GET")
+	limitSignin := limiter.Middleware("signin", ratelimit.ByIP)
+	appRouter.Handle("/signin/email", limitSignin(http.HandlerFunc(authHandlers.RequestMagicLink))).Methods("POST")
+	appRouter.HandleFunc("/signin/email/{token}", authHandlers.ShowMagicLink).Methods("GET")
+	appRouter.Handle("/signin/email/{token}", limitSignin(http.HandlerFunc(authHandlers.CompleteMagicLink))).Methods("POST")
+	knownProvider := auth.KnownProvider(t.RenderStatic("404.html"))
+	appRouter.Handle("/auth/{provider}", limitSignin(knownProvider(http.HandlerFunc(authHandlers.BeginAuth)))).Methods("GET")
+	appRouter.Handle("/auth/{provider}/callback", limitSignin(knownProvider(http.HandlerFunc(authHandlers.OAuthCallback)))).Methods("GET")
 
-	userSubscriptionService := subscriptions.NewUserSubscriptionService(queries, sessionStore, redisClient)
-	linkHandlers := links.NewLinkHandlers(t, queries, sessionStore, redisClient, *userSubscriptionService)
+	shortCodes, err := shortcode.GeneratorFromEnv(shortcode.CounterFunc(queries.NextShortCodeNumber))
+	if err != nil {
+		fatal("Invalid short code config", err)
+	}
+	linkHandlers := links.NewLinkHandlers(t, dbpool, queries, sessionStore, redisClient, *userSubscriptionService, auditLogger, shortCodes)
 	privateAppRouter := appRouter.PathPrefix("/").Subrouter()
 	privateAppRouter.Use(auth.PrivateRoute(sessionStore))
+	privateAppRouter.Use(sessionManager.Middleware())
+	privateAppRouter.Use(workspaces.WorkspaceMiddleware(queries, sessionStore))
 	privateAppRouter.Use(userSubscriptionService.UserSubscriptionMiddleware())
 	privateAppRouter.HandleFunc("/links", linkHandlers.UserLinks).Methods("GET")
-	privateAppRouter.HandleFunc("/links/new", linkHandlers.CreateLink).Methods("GET", "POST")
+	byUser := ratelimit.ByUser(sessionStore)
+	privateAppRouter.HandleFunc("/links/new", linkHandlers.CreateLink).Methods("GET")
+	privateAppRouter.Handle("/links/new", limiter.Middleware("create_link", byUser)(http.HandlerFunc(linkHandlers.CreateLink))).Methods("POST")
+	privateAppRouter.Handle("/links/slug-availability", limiter.API(byUser)(http.HandlerFunc(linkHandlers.SlugAvailability))).Methods("GET")
 	privateAppRouter.HandleFunc("/links/{shortcode}", linkHandlers.UserLink).Methods("GET")
+	privateAppRouter.HandleFunc("/links/{shortcode}/edit", linkHandlers.EditLink).Methods("GET", "POST")
+	privateAppRouter.HandleFunc("/links/{shortcode}/delete", linkHandlers.DeleteLink).Methods("POST")
+	privateAppRouter.HandleFunc("/links/{shortcode}/versions/{version}/rollback", linkHandlers.RollbackLink).Methods("POST")
+	privateAppRouter.HandleFunc("/links/{shortcode}/audit", linkHandlers.LinkAudit).Methods("GET")
+
+	privateAppRouter.HandleFunc("/account", authHandlers.Account).Methods("GET")
+	privateAppRouter.HandleFunc("/account/identities/{id}/delete", authHandlers.UnlinkIdentity).Methods("POST")
+	privateAppRouter.HandleFunc("/account/sessions/{id}/revoke", authHandlers.RevokeSession).Methods("POST")
+	privateAppRouter.HandleFunc("/account/sessions/revoke-all", authHandlers.SignoutEverywhere).Methods("POST")
+
+	subscriptionHandlers := subscriptions.NewSubscriptionHandlers(t, queries, sessionStore, userSubscriptionService, payments)
+	privateAppRouter.HandleFunc("/billing", subscriptionHandlers.Billing).Methods("GET")
+	privateAppRouter.HandleFunc("/billing/plan", subscriptionHandlers.ChangePlan).Methods("POST")
+
+	domainHandlers := domains.NewDomainHandlers(t, queries, sessionStore, redisClient, net.DefaultResolver)
+	privateAppRouter.HandleFunc("/domains", domainHandlers.UserDomains).Methods("GET")
+	requireCustomDomains := userSubscriptionService.RequireEntitlement(subscriptions.MaxCustomDomains)
+	privateAppRouter.Handle("/domains", requireCustomDomains(http.HandlerFunc(domainHandlers.AddDomain))).Methods("POST")
+	privateAppRouter.Handle("/domains/{id}/verify", requireCustomDomains(http.HandlerFunc(domainHandlers.VerifyDomain))).Methods("POST")
+	privateAppRouter.HandleFunc("/domains/{id}/delete", domainHandlers.RemoveDomain).Methods("POST")
+
+	workspaceHandlers := workspaces.NewWorkspaceHandlers(t, queries, sessionStore, userSubscriptionService, auditLogger, m)
+	privateAppRouter.HandleFunc("/workspaces", workspaceHandlers.Workspaces).Methods("GET")
+	privateAppRouter.HandleFunc("/workspaces/audit", workspaceHandlers.AuditLog).Methods("GET")
+	privateAppRouter.HandleFunc("/workspaces", workspaceHandlers.CreateWorkspace).Methods("POST")
+	privateAppRouter.HandleFunc("/workspaces/switch", workspaceHandlers.SwitchWorkspace).Methods("POST")
+	privateAppRouter.HandleFunc("/workspaces/invitations", workspaceHandlers.InviteMember).Methods("POST")
+	privateAppRouter.HandleFunc("/workspaces/invitations/{id}/revoke", workspaceHandlers.RevokeInvitation).Methods("POST")
+	privateAppRouter.HandleFunc("/workspaces/members/{userID}/role", workspaceHandlers.UpdateMemberRole).Methods("POST")
+	privateAppRouter.HandleFunc("/workspaces/members/{userID}/remove", workspaceHandlers.RemoveMember).Methods("POST")
+	privateAppRouter.HandleFunc("/invitations/{token}", workspaceHandlers.ShowInvitation).Methods("GET")
+	privateAppRouter.HandleFunc("/invitations/{token}", workspaceHandlers.AcceptInvitation).Methods("POST")
+
+	adminHandlers := admin.NewAdminHandlers(t, queries, sessionStore, redisClient, sessionManager, userSubscriptionService, auditLogger)
+	adminRouter := privateAppRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(admin.RequireAdmin(queries, sessionStore, t.RenderStatic("404.html")))
+	adminRouter.HandleFunc("/users", adminHandlers.Users).Methods("GET")
+	adminRouter.HandleFunc("/users/{id}", adminHandlers.User).Methods("GET")
+	adminRouter.HandleFunc("/users/{id}/disable", adminHandlers.DisableUser).Methods("POST")
+	adminRouter.HandleFunc("/users/{id}/enable", adminHandlers.EnableUser).Methods("POST")
+	adminRouter.HandleFunc("/workspaces/{id}/subscription", adminHandlers.ChangeSubscription).Methods("POST")
+	adminRouter.HandleFunc("/links", adminHandlers.Links).Methods("GET")
+	adminRouter.HandleFunc("/links/{id}/disable", adminHandlers.DisableLink).Methods("POST")
+	adminRouter.HandleFunc("/links/{id}/enable", adminHandlers.EnableLink).Methods("POST")
+
+	config.ReserveRoutes(topLevelRoutes(rootRouter)...)
+	config.ReserveRoutes(config.AppData.AppPathPrefix, "static")
 
 	port, exists := os.LookupEnv("PORT")
 	if !exists {
 		port = "8080"
 	}
-	log.Println("Server started on port " + port)
-	log.Fatal(http.ListenAndServe(":"+port, rootRouter))
+
+	// Metrics get their own listener so they aren't served to the public
+	metricsAddr, exists := os.LookupEnv("METRICS_ADDR")
+	if !exists {
+		metricsAddr = ":9091"
+	}
+	if metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler())
+		go func() {
+			slog.Info("Metrics served", slog.String("addr", metricsAddr))
+			fatal("Metrics server stopped", http.ListenAndServe(metricsAddr, metricsMux))
+		}()
+	}
+
+	server := &http.Server{Addr: ":" + port, Handler: logging.RequestIDMiddleware(rootRouter)}
+	go func() {
+		slog.Info("Server started", slog.String("port", port))
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			fatal("Server stopped", err)
+		}
+	}()
+
+	// On the way down the app first reports itself not ready and waits for
+	// the load balancer to notice, then finishes the requests and jobs it's
+	// in the middle of
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	slog.Info("Shutting down")
+	checker.ShutDown()
+	time.Sleep(shutdownDrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to finish in-flight requests", logging.Err(err))
+	}
+	stopJobs()
+	jobs.Wait()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", logging.Err(err))
+	}
+	slog.Info("Shut down")
+}
+
+// fatal logs err and exits, for failures that leave the app unable to run.
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
+
+// topLevelRoutes lists the first part of every fixed path router serves, so
+// short links can't shadow them.
+func topLevelRoutes(router *mux.Router) []string {
+	var words []string
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		first, _, _ := strings.Cut(strings.TrimPrefix(tmpl, "/"), "/")
+		if first != "" && !strings.Contains(first, "{") {
+			words = append(words, first)
+		}
+		return nil
+	})
+	return words
 }
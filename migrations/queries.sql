@@ -3,89 +3,380 @@ SELECT * FROM users
 WHERE id = $1 LIMIT 1;
 
 -- name: GetUserByEmail :one
-SELECT id, name, email
+SELECT id, name, email, role, disabled_at
 FROM users
-WHERE email = $1;
+WHERE email = $1
+  AND email_verified;
 
 -- name: CreateUser :one
-INSERT INTO users (name, email, oauth_provider)
+INSERT INTO users (name, email, email_verified)
 VALUES ($1, $2, $3)
-RETURNING id, name, email;
+RETURNING id, name, email, role, disabled_at;
 
--- name: GetUserSubscription :one
-SELECT us.status, s.name, s.max_links_per_month, s.can_customise_path, s.can_create_duplicates, s.can_view_analytics
+-- name: GetUserByIdentity :one
+SELECT u.id, u.name, u.email, u.role, u.disabled_at
+FROM user_identities i
+JOIN users u
+ON i.user_id = u.id
+WHERE i.provider = $1
+  AND i.provider_user_id = $2;
+
+-- name: GetIdentity :one
+SELECT *
+FROM user_identities
+WHERE provider = $1
+  AND provider_user_id = $2;
+
+-- name: CreateUserIdentity :one
+INSERT INTO user_identities (user_id, provider, provider_user_id, email)
+VALUES ($1, $2, $3, $4)
+RETURNING *;
+
+-- name: GetIdentitiesForUser :many
+SELECT *
+FROM user_identities
+WHERE user_id = $1
+ORDER BY created_at;
+
+-- name: DeleteUserIdentity :execrows
+-- Users can't remove their last way of signing in
+DELETE FROM user_identities
+WHERE user_identities.id = $1
+  AND user_identities.user_id = $2
+  AND (SELECT COUNT(*) FROM user_identities i WHERE i.user_id = $2) > 1;
+
+-- name: CreateWorkspace :one
+WITH workspace AS (
+  INSERT INTO workspaces (name)
+  VALUES (sqlc.arg('name'))
+  RETURNING id
+),
+owner AS (
+  INSERT INTO workspace_members (workspace_id, user_id, role)
+  SELECT id, sqlc.arg('user_id'), 'owner'
+  FROM workspace
+)
+SELECT id FROM workspace;
+
+-- name: GetDefaultWorkspaceForUser :one
+SELECT workspace_id
+FROM workspace_members
+WHERE user_id = $1
+ORDER BY role = 'owner' DESC, created_at
+LIMIT 1;
+
+-- name: GetWorkspacesForUser :many
+SELECT w.id, w.name, wm.role
+FROM workspace_members wm
+JOIN workspaces w
+ON wm.workspace_id = w.id
+WHERE wm.user_id = $1
+ORDER BY w.created_at;
+
+-- name: GetWorkspaceMembership :one
+SELECT w.id, w.name, wm.role
+FROM workspace_members wm
+JOIN workspaces w
+ON wm.workspace_id = w.id
+WHERE wm.workspace_id = $1
+  AND wm.user_id = $2;
+
+-- name: GetWorkspaceMembers :many
+SELECT u.id, u.name, u.email, wm.role
+FROM workspace_members wm
+JOIN users u
+ON wm.user_id = u.id
+WHERE wm.workspace_id = $1
+ORDER BY wm.created_at;
+
+-- name: CountWorkspaceOwners :one
+SELECT COUNT(*)
+FROM workspace_members
+WHERE workspace_id = $1
+  AND role = 'owner';
+
+-- name: UpdateWorkspaceMemberRole :exec
+UPDATE workspace_members
+SET role = $3,
+    updated_at = CURRENT_TIMESTAMP
+WHERE workspace_id = $1
+  AND user_id = $2;
+
+-- name: RemoveWorkspaceMember :exec
+DELETE FROM workspace_members
+WHERE workspace_id = $1
+  AND user_id = $2;
+
+-- name: CreateWorkspaceInvitation :one
+INSERT INTO workspace_invitations (workspace_id, email, role, token_hash, invited_by, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING *;
+
+-- name: GetPendingInvitationsForWorkspace :many
+SELECT id, email, role, expires_at
+FROM workspace_invitations
+WHERE workspace_id = $1
+  AND accepted_at IS NULL
+  AND expires_at > CURRENT_TIMESTAMP
+ORDER BY created_at;
+
+-- name: GetPendingInvitationByTokenHash :one
+SELECT wi.id, wi.workspace_id, w.name AS workspace_name, wi.email, wi.role
+FROM workspace_invitations wi
+JOIN workspaces w
+ON wi.workspace_id = w.id
+WHERE wi.token_hash = $1
+  AND wi.accepted_at IS NULL
+  AND wi.expires_at > CURRENT_TIMESTAMP;
+
+-- name: AcceptWorkspaceInvitation :exec
+WITH invitation AS (
+  UPDATE workspace_invitations
+  SET accepted_at = CURRENT_TIMESTAMP
+  WHERE id = sqlc.arg('invitation_id')
+  RETURNING workspace_id, role
+)
+INSERT INTO workspace_members (workspace_id, user_id, role)
+SELECT workspace_id, sqlc.arg('user_id'), role
+FROM invitation
+ON CONFLICT (workspace_id, user_id) DO NOTHING;
+
+-- name: DeleteWorkspaceInvitation :exec
+DELETE FROM workspace_invitations
+WHERE id = $1
+  AND workspace_id = $2;
+
+-- name: GetWorkspaceSubscription :one
+SELECT us.status, s.name, s.max_links_per_month, (
+    SELECT COALESCE(jsonb_object_agg(e.key, e.value), '{}')
+    FROM plan_entitlements e
+    WHERE e.subscription_id = s.id
+  )::jsonb AS entitlements
 FROM user_subscriptions us
 JOIN subscriptions s
 ON us.subscription_id=s.id
-WHERE us.user_id=$1;
+WHERE us.workspace_id=$1
+  AND us.status = 'active'
+ORDER BY us.start_date DESC
+LIMIT 1;
 
 -- name: AddBasicSubscription :one
 WITH user_sub AS (
-  INSERT INTO user_subscriptions (user_id, subscription_id, end_date)
+  INSERT INTO user_subscriptions (workspace_id, subscription_id, end_date)
   VALUES ($1, (SELECT id FROM subscriptions WHERE name = 'basic'), 'infinity')
   RETURNING status, subscription_id
 ),
 user_usage AS (
-  INSERT INTO user_monthly_usage (user_id, cycle_start_date, cycle_end_date)
+  INSERT INTO user_monthly_usage (workspace_id, cycle_start_date, cycle_end_date)
   VALUES (
     $1, CURRENT_DATE, CURRENT_DATE + INTERVAL '1 month'
   )
 )
-SELECT us.status, s.name, s.max_links_per_month, s.can_customise_path, s.can_create_duplicates, s.can_view_analytics
+SELECT us.status, s.name, s.max_links_per_month, (
+    SELECT COALESCE(jsonb_object_agg(e.key, e.value), '{}')
+    FROM plan_entitlements e
+    WHERE e.subscription_id = s.id
+  )::jsonb AS entitlements
 FROM user_sub us
 JOIN subscriptions s
 ON us.subscription_id = s.id;
 
--- name: GetUserCurrentUsage :one
-SELECT links_created
+-- name: GetWorkspaceCurrentUsage :one
+SELECT links_created, cycle_end_date
 FROM user_monthly_usage
-WHERE user_id = $1
+WHERE workspace_id = $1
   AND cycle_start_date <= CURRENT_DATE
   AND cycle_end_date > CURRENT_DATE;
 
+-- name: EnsureCurrentUsageCycle :exec
+-- Rolls the workspace's usage over to the cycle covering today, or starts
+-- its first one, the same way RollUsageCycles does. Creating links mustn't
+-- wait on the job to reset a cycle that's ended. Whichever concurrent call
+-- conflicts second finds the cycle already current and leaves it.
+WITH existing AS (
+  SELECT COALESCE(user_monthly_usage.created_at::date, user_monthly_usage.cycle_start_date) AS anniversary
+  FROM user_monthly_usage
+  WHERE user_monthly_usage.workspace_id = sqlc.arg(workspace_id)
+),
+elapsed AS (
+  SELECT a.anniversary,
+    (EXTRACT(YEAR FROM age(CURRENT_DATE, a.anniversary)) * 12 + EXTRACT(MONTH FROM age(CURRENT_DATE, a.anniversary)))::int AS months
+  FROM (SELECT COALESCE((SELECT anniversary FROM existing), CURRENT_DATE) AS anniversary) a
+),
+cycle AS (
+  SELECT elapsed.anniversary,
+    CASE WHEN elapsed.anniversary + (elapsed.months + 1) * INTERVAL '1 month' <= CURRENT_DATE
+      THEN elapsed.months + 1
+      ELSE elapsed.months
+    END AS months
+  FROM elapsed
+)
+INSERT INTO user_monthly_usage (workspace_id, cycle_start_date, cycle_end_date)
+SELECT sqlc.arg(workspace_id),
+  cycle.anniversary + cycle.months * INTERVAL '1 month',
+  cycle.anniversary + (cycle.months + 1) * INTERVAL '1 month'
+FROM cycle
+ON CONFLICT (workspace_id) DO UPDATE
+SET links_created = 0,
+    cycle_start_date = EXCLUDED.cycle_start_date,
+    cycle_end_date = EXCLUDED.cycle_end_date,
+    updated_at = CURRENT_TIMESTAMP
+WHERE user_monthly_usage.cycle_end_date <= CURRENT_DATE;
+
+-- name: ConsumeLinkQuota :one
+-- Counts one more link against the workspace's current cycle, returning the
+-- new count and when the cycle ends, or no rows if the plan's limit has been
+-- reached. The row lock makes concurrent calls take turns so the limit can't
+-- be overshot. Call it after EnsureCurrentUsageCycle in the same transaction
+-- as CreateLink.
+UPDATE user_monthly_usage
+SET links_created = user_monthly_usage.links_created + 1,
+    updated_at = CURRENT_TIMESTAMP
+FROM user_subscriptions us
+JOIN subscriptions s
+ON us.subscription_id = s.id
+WHERE user_monthly_usage.workspace_id = $1
+  AND user_monthly_usage.cycle_start_date <= CURRENT_DATE
+  AND user_monthly_usage.cycle_end_date > CURRENT_DATE
+  AND us.workspace_id = user_monthly_usage.workspace_id
+  AND us.status = 'active'
+  AND user_monthly_usage.links_created < s.max_links_per_month
+RETURNING user_monthly_usage.links_created, user_monthly_usage.cycle_end_date;
+
+-- name: NextShortCodeNumber :one
+SELECT nextval('short_code_seq')::bigint;
+
 -- name: CreateLink :one
-WITH updated_usage AS (
-  UPDATE user_monthly_usage
-  SET links_created = links_created + 1,
-      updated_at = CURRENT_TIMESTAMP
-  WHERE user_id = $1
-    AND cycle_start_date <= CURRENT_DATE
-    AND cycle_end_date > CURRENT_DATE
+WITH new_link AS (
+  INSERT INTO links (workspace_id, user_id, domain_id, short_code, destination_url, title, notes)
+  VALUES ($1, $2, $3, $4, $5, $6, $7)
+  RETURNING *
+),
+first_version AS (
+  INSERT INTO link_versions (link_id, version, destination_url, title, notes, redirect_status, created_by)
+  SELECT id, 1, destination_url, title, notes, redirect_status, user_id
+  FROM new_link
 )
-INSERT INTO links (user_id, short_code, destination_url, title, notes)
-VALUES ($1, $2, $3, $4, $5)
-RETURNING *;
+SELECT * FROM new_link;
 
 -- name: GetDestinationUrl :one
-SELECT destination_url
-FROM links
-WHERE short_code = $1
+-- A disabled creator takes the link down in every workspace, not just the
+-- ones they own.
+SELECT l.id, l.destination_url, l.redirect_status, COALESCE((
+  SELECT v.id
+  FROM link_versions v
+  WHERE v.link_id = l.id
+  ORDER BY v.version DESC
+  LIMIT 1
+), 0)::int AS version_id
+FROM links l
+JOIN users u
+ON l.user_id = u.id
+WHERE l.domain_id IS NOT DISTINCT FROM sqlc.narg('domain_id')
+AND lower(l.short_code) = lower(sqlc.arg('short_code'))
+AND l.disabled_at IS NULL
+AND u.disabled_at IS NULL
 LIMIT 1;
 
--- name: GetLinkForUser :one
-SELECT short_code, destination_url, title, notes, created_at, updated_at
-FROM links
-WHERE user_id = $1
-AND short_code = $2
+-- name: GetMostVisitedLinks :many
+SELECT l.id, l.domain_id, l.short_code, l.destination_url, l.redirect_status, COALESCE((
+  SELECT v.id
+  FROM link_versions v
+  WHERE v.link_id = l.id
+  ORDER BY v.version DESC
+  LIMIT 1
+), 0)::int AS version_id
+FROM links l
+JOIN users u
+ON l.user_id = u.id
+JOIN (
+  SELECT link_id, COUNT(*) AS visits
+  FROM analytics
+  WHERE recorded_at >= sqlc.arg('since')
+  GROUP BY link_id
+) a
+ON a.link_id = l.id
+WHERE l.disabled_at IS NULL
+AND u.disabled_at IS NULL
+ORDER BY a.visits DESC
+LIMIT sqlc.arg('limit');
+
+-- name: GetLinkForWorkspace :one
+SELECT l.id, l.domain_id, l.short_code, d.hostname, l.destination_url, l.title, l.notes, l.redirect_status, l.disabled_at, l.created_at, l.updated_at
+FROM links l
+LEFT JOIN domains d
+ON l.domain_id = d.id
+WHERE l.workspace_id = $1
+AND lower(l.short_code) = lower(sqlc.arg(short_code))
+AND d.hostname IS NOT DISTINCT FROM sqlc.narg('hostname')
 LIMIT 1;
 
--- name: GetPaginatedLinksForUser :one
+-- name: UpdateLinkForWorkspace :one
+WITH updated_link AS (
+  UPDATE links
+  SET destination_url = sqlc.arg('destination_url'),
+      title = sqlc.arg('title'),
+      notes = sqlc.arg('notes'),
+      redirect_status = sqlc.arg('redirect_status'),
+      updated_at = CURRENT_TIMESTAMP
+  WHERE links.id = sqlc.arg('id')
+    AND links.workspace_id = sqlc.arg('workspace_id')
+  RETURNING *
+),
+new_version AS (
+  INSERT INTO link_versions (link_id, version, destination_url, title, notes, redirect_status, created_by)
+  SELECT id, (
+    SELECT COALESCE(MAX(version), 0) + 1
+    FROM link_versions
+    WHERE link_versions.link_id = sqlc.arg('id')
+  ), destination_url, title, notes, redirect_status, sqlc.arg('updated_by')::int
+  FROM updated_link
+)
+SELECT * FROM updated_link;
+
+-- name: GetLinkVersions :many
+SELECT v.version, v.destination_url, v.title, v.notes, v.redirect_status, u.email AS created_by_email, v.created_at, (
+  SELECT COUNT(*)
+  FROM analytics a
+  WHERE a.link_version_id = v.id
+) AS visits
+FROM link_versions v
+LEFT JOIN users u
+ON v.created_by = u.id
+WHERE v.link_id = $1
+ORDER BY v.version DESC;
+
+-- name: GetLinkVersion :one
+SELECT *
+FROM link_versions
+WHERE link_id = $1
+  AND version = $2;
+
+-- name: DeleteLinkForWorkspace :exec
+DELETE FROM links
+WHERE id = $1
+  AND workspace_id = $2;
+
+-- name: GetPaginatedLinksForWorkspace :one
 WITH paginated_links AS (
-  SELECT short_code, destination_url, title, notes
-  FROM links
-  WHERE user_id = $1
-  ORDER BY created_at DESC
+  SELECT l.short_code, d.hostname, l.destination_url, l.title, l.notes
+  FROM links l
+  LEFT JOIN domains d
+  ON l.domain_id = d.id
+  WHERE l.workspace_id = $1
+  ORDER BY l.created_at DESC
   LIMIT $2
   OFFSET $3
 )
 SELECT
   (SELECT COUNT(*)
     FROM links l
-    WHERE l.user_id = $1
+    WHERE l.workspace_id = $1
   ) as total_count,
   ARRAY_AGG(
     jsonb_build_object(
       'short_code', short_code,
+      'hostname', hostname,
       'destination_url', destination_url,
       'title', title,
       'notes', notes
@@ -95,32 +386,382 @@ FROM paginated_links;
 
 -- name: FindDuplicatesForUrl :one
 WITH limited_links AS (
-  SELECT short_code
-  FROM links
-  WHERE user_id = $1
-    AND destination_url = $2
-  ORDER BY created_at DESC
+  SELECT l.short_code, COALESCE(d.hostname, '') AS hostname
+  FROM links l
+  LEFT JOIN domains d
+  ON l.domain_id = d.id
+  WHERE l.workspace_id = $1
+    AND l.destination_url = $2
+  ORDER BY l.created_at DESC
   LIMIT sqlc.arg('limit')
 )
 SELECT
   ARRAY_AGG(short_code)::text[] AS short_codes,
+  ARRAY_AGG(hostname)::text[] AS hostnames,
   GREATEST((SELECT COUNT(*)
               FROM links  As l
-              WHERE l.user_id = $1
+              WHERE l.workspace_id = $1
                 AND l.destination_url = $2) - sqlc.arg('limit'), 0)::int AS remaining_count
 FROM limited_links;
 
 -- name: GetLinkByShortCode :one
-SELECT user_id, short_code from links
-WHERE short_code = $1
+SELECT l.workspace_id, l.short_code, d.hostname
+FROM links l
+LEFT JOIN domains d
+ON l.domain_id = d.id
+WHERE l.domain_id IS NOT DISTINCT FROM sqlc.narg('domain_id')
+AND lower(l.short_code) = lower(sqlc.arg('short_code'))
 LIMIT 1;
 
+-- name: GetTakenSlugs :many
+-- Which of slugs, all lowercase, are used on the domain
+SELECT lower(short_code)::text AS slug
+FROM links
+WHERE domain_id IS NOT DISTINCT FROM sqlc.narg('domain_id')
+AND lower(short_code) = ANY(sqlc.arg('slugs')::text[]);
+
 -- name: RecordVisit :exec
-INSERT INTO analytics (short_code, user_agent_data, geo_data, referrer_url)
-VALUES ($1, $2, $3, $4);
-
--- name: GetVisitDataForShortcode :many
-SELECT user_agent_data, geo_data, referrer_url, recorded_at
-FROM analytics
-WHERE short_code = $1
-ORDER BY created_at DESC;
+INSERT INTO analytics (link_id, link_version_id, user_agent_data, geo_data, referrer_url)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: GetVisitDataForLink :many
+-- Only visits within the plan's analytics retention period are shown
+SELECT a.user_agent_data, a.geo_data, a.referrer_url, a.recorded_at, v.version
+FROM analytics a
+LEFT JOIN link_versions v
+ON a.link_version_id = v.id
+WHERE a.link_id = sqlc.arg(link_id)
+  AND a.recorded_at > CURRENT_TIMESTAMP - make_interval(days => sqlc.arg(retention_days)::int)
+ORDER BY a.created_at DESC;
+
+-- name: CreateDomain :one
+INSERT INTO domains (workspace_id, hostname, verification_token)
+VALUES ($1, $2, $3)
+RETURNING *;
+
+-- name: GetDomainsForWorkspace :many
+SELECT *
+FROM domains
+WHERE workspace_id = $1
+ORDER BY created_at;
+
+-- name: GetVerifiedDomainsForWorkspace :many
+SELECT id, hostname
+FROM domains
+WHERE workspace_id = $1
+  AND verified_at IS NOT NULL
+ORDER BY hostname;
+
+-- name: GetDomainForWorkspace :one
+SELECT *
+FROM domains
+WHERE id = $1
+  AND workspace_id = $2;
+
+-- name: GetDomainForWorkspaceByHostname :one
+SELECT id, workspace_id, hostname
+FROM domains
+WHERE workspace_id = $1
+  AND hostname = $2;
+
+-- name: GetVerifiedDomainByHostname :one
+SELECT id, hostname
+FROM domains
+WHERE hostname = $1
+  AND verified_at IS NOT NULL;
+
+-- name: CountDomainsForWorkspace :one
+SELECT COUNT(*)
+FROM domains
+WHERE workspace_id = $1;
+
+-- name: VerifyDomain :exec
+-- Other workspaces' pending claims on the hostname are dropped once one
+-- workspace proves it owns it.
+WITH verified AS (
+  UPDATE domains
+  SET verified_at = CURRENT_TIMESTAMP,
+      updated_at = CURRENT_TIMESTAMP
+  WHERE domains.id = sqlc.arg(id)
+  RETURNING domains.id, domains.hostname
+)
+DELETE FROM domains d
+USING verified v
+WHERE d.hostname = v.hostname
+  AND d.id <> v.id
+  AND d.verified_at IS NULL;
+
+-- name: DeleteDomainForWorkspace :exec
+DELETE FROM domains
+WHERE id = $1
+  AND workspace_id = $2;
+
+-- name: CreateAuditLogEntry :exec
+INSERT INTO audit_log (workspace_id, actor_user_id, action, target_type, target_id, before, after, ip_address, user_agent)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+
+-- name: GetAuditLogForWorkspace :many
+SELECT a.id, a.actor_user_id, u.email AS actor_email, a.action, a.target_type, a.target_id, a.before, a.after, a.ip_address, a.user_agent, a.created_at
+FROM audit_log a
+LEFT JOIN users u
+ON a.actor_user_id = u.id
+WHERE a.workspace_id = sqlc.arg('workspace_id')
+  AND (sqlc.narg('action')::text IS NULL OR a.action = sqlc.narg('action'))
+  AND (sqlc.narg('target_type')::text IS NULL OR a.target_type = sqlc.narg('target_type'))
+  AND (sqlc.narg('target_id')::text IS NULL OR a.target_id = sqlc.narg('target_id'))
+  AND (sqlc.narg('actor_user_id')::int IS NULL OR a.actor_user_id = sqlc.narg('actor_user_id'))
+ORDER BY a.id DESC
+LIMIT sqlc.arg('limit')
+OFFSET sqlc.arg('offset');
+
+-- name: GetUserAccess :one
+SELECT role, disabled_at
+FROM users
+WHERE id = $1;
+
+-- name: SearchUsers :many
+SELECT id, name, email, role, disabled_at, created_at
+FROM users
+WHERE sqlc.arg(query)::text = ''
+  OR email ILIKE '%' || sqlc.arg(query)::text || '%'
+  OR name ILIKE '%' || sqlc.arg(query)::text || '%'
+ORDER BY created_at DESC
+LIMIT $1 OFFSET $2;
+
+-- name: GetUserForAdmin :one
+SELECT id, name, email, role, disabled_at, created_at
+FROM users
+WHERE id = $1;
+
+-- name: GetWorkspacesForUserAdmin :many
+SELECT w.id, w.name, wm.role, s.name AS subscription_name, us.status AS subscription_status,
+  COALESCE(u.links_created, 0)::int AS links_created, u.cycle_start_date, u.cycle_end_date
+FROM workspace_members wm
+JOIN workspaces w
+ON wm.workspace_id = w.id
+LEFT JOIN user_subscriptions us
+ON us.workspace_id = w.id
+AND us.status = 'active'
+LEFT JOIN subscriptions s
+ON us.subscription_id = s.id
+LEFT JOIN user_monthly_usage u
+ON u.workspace_id = w.id
+WHERE wm.user_id = $1
+ORDER BY w.created_at;
+
+-- name: GetSubscriptions :many
+-- Plans are ranked by how many links they allow
+SELECT s.id, s.name, s.max_links_per_month, (
+    SELECT COALESCE(jsonb_object_agg(e.key, e.value), '{}')
+    FROM plan_entitlements e
+    WHERE e.subscription_id = s.id
+  )::jsonb AS entitlements
+FROM subscriptions s
+ORDER BY s.max_links_per_month;
+
+-- name: SetUserDisabled :exec
+UPDATE users
+SET disabled_at = CASE WHEN sqlc.arg(disabled)::bool THEN CURRENT_TIMESTAMP END,
+    updated_at = CURRENT_TIMESTAMP
+WHERE id = $1;
+
+-- name: GetLinkCacheKeysForUser :many
+SELECT domain_id, short_code
+FROM links
+WHERE user_id = $1;
+
+-- name: SearchLinks :many
+SELECT l.id, l.short_code, d.hostname, l.destination_url, l.disabled_at, l.created_at,
+  w.name AS workspace_name, u.email AS user_email
+FROM links l
+JOIN workspaces w
+ON l.workspace_id = w.id
+JOIN users u
+ON l.user_id = u.id
+LEFT JOIN domains d
+ON l.domain_id = d.id
+WHERE lower(l.short_code) = lower(sqlc.arg(query)::text)
+  OR l.destination_url ILIKE '%' || sqlc.arg(query)::text || '%'
+ORDER BY l.created_at DESC
+LIMIT 50;
+
+-- name: SetLinkDisabled :one
+UPDATE links
+SET disabled_at = CASE WHEN sqlc.arg(disabled)::bool THEN CURRENT_TIMESTAMP END
+WHERE id = $1
+RETURNING id, workspace_id, domain_id, short_code;
+
+-- name: GetWorkspacePlan :one
+SELECT us.start_date, us.end_date, s.id AS subscription_id, s.name,
+  us.pending_subscription_id, p.name AS pending_subscription_name,
+  us.provider_subscription_id, us.payment_failed_at
+FROM user_subscriptions us
+JOIN subscriptions s
+ON us.subscription_id = s.id
+LEFT JOIN subscriptions p
+ON us.pending_subscription_id = p.id
+WHERE us.workspace_id = $1
+  AND us.status = 'active'
+ORDER BY us.start_date DESC
+LIMIT 1;
+
+-- name: ChangeWorkspaceSubscription :execrows
+-- Expires the active subscription and starts a new period on another plan
+-- straight away. Nothing is prorated, paid periods last a month from now.
+WITH expired AS (
+  UPDATE user_subscriptions
+  SET status = 'expired',
+      end_date = LEAST(user_subscriptions.end_date, CURRENT_TIMESTAMP)
+  WHERE user_subscriptions.workspace_id = sqlc.arg(workspace_id)
+    AND user_subscriptions.status = 'active'
+  RETURNING user_subscriptions.workspace_id
+)
+INSERT INTO user_subscriptions (workspace_id, subscription_id, start_date, end_date)
+SELECT e.workspace_id, s.id, CURRENT_TIMESTAMP,
+  CASE WHEN s.name = 'basic' THEN 'infinity'::timestamp ELSE CURRENT_TIMESTAMP + INTERVAL '1 month' END
+FROM expired e, subscriptions s
+WHERE s.id = sqlc.arg(subscription_id);
+
+-- name: SetPendingSubscription :execrows
+UPDATE user_subscriptions
+SET pending_subscription_id = sqlc.narg(pending_subscription_id)
+WHERE workspace_id = sqlc.arg(workspace_id)
+  AND status = 'active';
+
+-- name: GetDueSubscriptions :many
+-- Subscriptions paid through the payment provider are ended by its webhooks,
+-- they're only expired here if those stop arriving.
+SELECT workspace_id
+FROM user_subscriptions
+WHERE status = 'active'
+  AND end_date <= CURRENT_TIMESTAMP
+  AND (provider_subscription_id IS NULL OR end_date <= CURRENT_TIMESTAMP - INTERVAL '3 days');
+
+-- name: ExpireDueSubscription :execrows
+-- Moves a workspace whose period has ended onto basic, the one plan that
+-- needs no payment. Paid plans, pending ones included, only start when the
+-- provider reports payment. Does nothing if another run got there first.
+WITH expired AS (
+  UPDATE user_subscriptions
+  SET status = 'expired'
+  WHERE user_subscriptions.workspace_id = $1
+    AND user_subscriptions.status = 'active'
+    AND user_subscriptions.end_date <= CURRENT_TIMESTAMP
+    AND (user_subscriptions.provider_subscription_id IS NULL OR user_subscriptions.end_date <= CURRENT_TIMESTAMP - INTERVAL '3 days')
+  RETURNING user_subscriptions.workspace_id
+)
+INSERT INTO user_subscriptions (workspace_id, subscription_id, start_date, end_date)
+SELECT e.workspace_id, s.id, CURRENT_TIMESTAMP, 'infinity'::timestamp
+FROM expired e
+JOIN subscriptions s
+ON s.name = 'basic';
+
+-- name: RecordBillingEvent :execrows
+INSERT INTO billing_events (id, provider, type)
+VALUES ($1, $2, $3)
+ON CONFLICT (id) DO NOTHING;
+
+-- name: GetActiveProviderSubscriptionID :one
+SELECT provider_subscription_id
+FROM user_subscriptions
+WHERE workspace_id = $1
+  AND status = 'active'
+ORDER BY start_date DESC
+LIMIT 1;
+
+-- name: StartProviderSubscription :execrows
+-- Starts a paid period on a plan, replacing whatever the workspace was on.
+WITH expired AS (
+  UPDATE user_subscriptions
+  SET status = 'expired',
+      end_date = LEAST(user_subscriptions.end_date, CURRENT_TIMESTAMP)
+  WHERE user_subscriptions.workspace_id = sqlc.arg(workspace_id)
+    AND user_subscriptions.status = 'active'
+  RETURNING user_subscriptions.workspace_id
+)
+INSERT INTO user_subscriptions (workspace_id, subscription_id, start_date, end_date, provider_subscription_id)
+SELECT e.workspace_id, s.id, CURRENT_TIMESTAMP, sqlc.arg(end_date), sqlc.arg(provider_subscription_id)
+FROM expired e, subscriptions s
+WHERE s.name = sqlc.arg(plan);
+
+-- name: RenewProviderSubscription :one
+-- A paid pending plan is what the renewal was charged for, so it takes over
+-- from here. Basic is left pending for when the subscription ends.
+UPDATE user_subscriptions
+SET end_date = $2,
+    payment_failed_at = NULL,
+    subscription_id = COALESCE((
+      SELECT p.id FROM subscriptions p
+      WHERE p.id = user_subscriptions.pending_subscription_id
+        AND p.name <> 'basic'
+    ), user_subscriptions.subscription_id),
+    pending_subscription_id = (
+      SELECT p.id FROM subscriptions p
+      WHERE p.id = user_subscriptions.pending_subscription_id
+        AND p.name = 'basic'
+    )
+WHERE provider_subscription_id = $1
+  AND status = 'active'
+RETURNING workspace_id;
+
+-- name: MarkProviderSubscriptionPaymentFailed :one
+UPDATE user_subscriptions
+SET payment_failed_at = CURRENT_TIMESTAMP
+WHERE provider_subscription_id = $1
+  AND status = 'active'
+RETURNING workspace_id;
+
+-- name: EndProviderSubscription :one
+-- Moves a workspace whose paid subscription was cancelled onto basic. A
+-- pending paid plan would have been applied when the subscription renewed,
+-- ending means it was never paid for.
+WITH expired AS (
+  UPDATE user_subscriptions
+  SET status = 'expired',
+      end_date = LEAST(user_subscriptions.end_date, CURRENT_TIMESTAMP)
+  WHERE user_subscriptions.provider_subscription_id = $1
+    AND user_subscriptions.status = 'active'
+  RETURNING user_subscriptions.workspace_id
+)
+INSERT INTO user_subscriptions (workspace_id, subscription_id, start_date, end_date)
+SELECT e.workspace_id, s.id, CURRENT_TIMESTAMP, 'infinity'::timestamp
+FROM expired e
+JOIN subscriptions s
+ON s.name = 'basic'
+RETURNING workspace_id;
+
+-- name: RollUsageCycles :many
+-- Starts a new usage cycle for every workspace whose cycle has ended. Cycles
+-- run monthly from the day the workspace's usage started counting, skipping
+-- any months that were missed, so each workspace keeps its anniversary.
+WITH due AS (
+  SELECT user_monthly_usage.id, user_monthly_usage.links_created,
+    COALESCE(user_monthly_usage.created_at::date, user_monthly_usage.cycle_start_date) AS anniversary
+  FROM user_monthly_usage
+  WHERE user_monthly_usage.cycle_end_date <= CURRENT_DATE
+  FOR UPDATE
+),
+elapsed AS (
+  SELECT due.id, due.links_created, due.anniversary,
+    (EXTRACT(YEAR FROM age(CURRENT_DATE, due.anniversary)) * 12 + EXTRACT(MONTH FROM age(CURRENT_DATE, due.anniversary)))::int AS months
+  FROM due
+),
+cycles AS (
+  -- Anniversaries late in the month fall on the last day of shorter months
+  -- which age() doesn't count as a whole month
+  SELECT elapsed.id, elapsed.links_created, elapsed.anniversary,
+    CASE WHEN elapsed.anniversary + (elapsed.months + 1) * INTERVAL '1 month' <= CURRENT_DATE
+      THEN elapsed.months + 1
+      ELSE elapsed.months
+    END AS months
+  FROM elapsed
+)
+UPDATE user_monthly_usage
+SET links_created = 0,
+    cycle_start_date = cycles.anniversary + cycles.months * INTERVAL '1 month',
+    cycle_end_date = cycles.anniversary + (cycles.months + 1) * INTERVAL '1 month',
+    updated_at = CURRENT_TIMESTAMP
+FROM cycles
+WHERE user_monthly_usage.id = cycles.id
+RETURNING user_monthly_usage.workspace_id, cycles.links_created AS previous_links_created,
+  user_monthly_usage.cycle_start_date, user_monthly_usage.cycle_end_date;
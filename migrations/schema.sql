@@ -1,58 +1,182 @@
 CREATE TABLE users (
   id SERIAL PRIMARY KEY,
   name TEXT,
-  email TEXT UNIQUE NOT NULL,
-  oauth_provider TEXT,
+  email TEXT NOT NULL,
+  -- Set when the email came from a provider that checks it belongs to the
+  -- user. Unverified emails are never matched on, so signing up first with
+  -- someone else's address doesn't get you their account.
+  email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+  -- Admins are made by hand: UPDATE users SET role = 'admin' WHERE email = ...
+  role TEXT NOT NULL CHECK(role IN ('user', 'admin')) DEFAULT 'user',
+  -- Disabled users can't sign in and every link they created stops
+  -- redirecting, whichever workspace it's in
+  disabled_at TIMESTAMP,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
+CREATE UNIQUE INDEX idx_users_verified_email ON users (email) WHERE email_verified;
+
+-- The provider accounts a user can sign in with
+CREATE TABLE user_identities (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  provider TEXT NOT NULL,
+  provider_user_id TEXT NOT NULL,
+  email TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (provider, provider_user_id)
+);
+CREATE INDEX idx_user_identities_user_id ON user_identities (user_id);
+
+CREATE TABLE workspaces (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE workspace_members (
+  workspace_id INT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+  user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role TEXT NOT NULL CHECK(role IN ('owner', 'admin', 'editor', 'viewer')),
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (workspace_id, user_id)
+);
+CREATE INDEX idx_workspace_members_user_id ON workspace_members (user_id);
+
+CREATE TABLE workspace_invitations (
+  id SERIAL PRIMARY KEY,
+  workspace_id INT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+  email TEXT NOT NULL,
+  role TEXT NOT NULL CHECK(role IN ('admin', 'editor', 'viewer')),
+  token_hash TEXT UNIQUE NOT NULL,
+  invited_by INT REFERENCES users(id) ON DELETE SET NULL,
+  expires_at TIMESTAMP NOT NULL,
+  accepted_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+-- Only one pending invitation per email per workspace
+CREATE UNIQUE INDEX idx_workspace_invitations_workspace_id_email ON workspace_invitations (workspace_id, email) WHERE accepted_at IS NULL;
 
 CREATE TABLE subscriptions (
   id SERIAL PRIMARY KEY,
   name TEXT UNIQUE NOT NULL,
   max_links_per_month INT NOT NULL,
-  can_customise_slug BOOLEAN NOT NULL DEFAULT FALSE,
-  can_create_duplicates BOOLEAN NOT NULL DEFAULT FALSE,
-  can_view_analytics BOOLEAN NOT NULL DEFAULT FALSE,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Everything a plan allows besides its link quota. Values are limits, or 1
+-- for features that are simply on. A plan without a key doesn't get it.
+CREATE TABLE plan_entitlements (
+  subscription_id INT NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+  key TEXT NOT NULL,
+  value INT NOT NULL,
+  PRIMARY KEY (subscription_id, key)
+);
+
+-- A workspace's subscription history. Only one row per workspace is active,
+-- changing plans expires it and starts a new period.
 CREATE TABLE user_subscriptions (
-  user_id INT NOT NULL REFERENCES users(id),
+  id SERIAL PRIMARY KEY,
+  workspace_id INT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
   subscription_id INT NOT NULL REFERENCES subscriptions(id),
   status TEXT NOT NULL CHECK(status IN ('active', 'expired')) DEFAULT 'active',
   start_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP NOT NULL,
   end_date TIMESTAMP NOT NULL,
+  -- A downgrade waiting for the end of the current period
+  pending_subscription_id INT REFERENCES subscriptions(id),
+  -- Set when the period is paid for through the payment provider
+  provider_subscription_id TEXT,
+  payment_failed_at TIMESTAMP,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
+CREATE INDEX idx_user_subscriptions_workspace_id ON user_subscriptions (workspace_id) WHERE status = 'active';
+CREATE INDEX idx_user_subscriptions_provider_subscription_id ON user_subscriptions (provider_subscription_id);
+
+-- Payment provider webhook events that have been handled. Providers deliver
+-- at least once so events are only applied if they can be inserted here.
+CREATE TABLE billing_events (
+  id TEXT PRIMARY KEY,
+  provider TEXT NOT NULL,
+  type TEXT NOT NULL,
+  processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE domains (
+  id SERIAL PRIMARY KEY,
+  workspace_id INT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+  hostname TEXT NOT NULL,
+  verification_token TEXT NOT NULL,
+  verified_at TIMESTAMP,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_domains_workspace_id ON domains (workspace_id);
+-- Any number of workspaces can claim a hostname but only one can prove it.
+CREATE UNIQUE INDEX idx_domains_workspace_hostname ON domains (workspace_id, hostname);
+CREATE UNIQUE INDEX idx_domains_verified_hostname ON domains (hostname) WHERE verified_at IS NOT NULL;
 
 CREATE TABLE links (
   id SERIAL PRIMARY KEY,
+  workspace_id INT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+  -- The member who created the link
   user_id INTEGER NOT NULL,
-  short_code TEXT UNIQUE NOT NULL,
+  -- NULL means the link lives under REDIRECTOR_BASE_URL
+  domain_id INT REFERENCES domains(id),
+  short_code TEXT NOT NULL,
   destination_url TEXT NOT NULL,
   title  TEXT,
   notes  TEXT,
+  redirect_status INT NOT NULL CHECK(redirect_status IN (301, 302, 303, 307, 308)) DEFAULT 303,
+  -- Set by admins to stop a link redirecting
+  disabled_at TIMESTAMP,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+  -- Links belong to the workspace, so deleting whoever created them mustn't
+  -- take them down for everyone else in it
+  FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE RESTRICT
+);
+-- Short codes are unique per domain, the default domain included, ignoring
+-- case so Promo and promo can't both exist. Redirects ignore case too.
+CREATE UNIQUE INDEX idx_links_domain_id_short_code ON links (domain_id, lower(short_code)) NULLS NOT DISTINCT;
+CREATE INDEX idx_links_short_code ON links (short_code);
+CREATE INDEX idx_links_workspace_id ON links (workspace_id);
+-- Numbers links for SHORTCODE_STRATEGY=sequence
+CREATE SEQUENCE short_code_seq;
+
+-- Every state a link has been in, newest version first. A new version is
+-- written whenever a link is created, edited or rolled back.
+CREATE TABLE link_versions (
+  id SERIAL PRIMARY KEY,
+  link_id INT NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+  version INT NOT NULL,
+  destination_url TEXT NOT NULL,
+  title TEXT,
+  notes TEXT,
+  redirect_status INT NOT NULL,
+  created_by INT REFERENCES users(id) ON DELETE SET NULL,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (link_id, version)
 );
 
 CREATE TABLE user_monthly_usage (
   id SERIAL PRIMARY KEY,
-  user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  workspace_id INT NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
   links_created INT NOT NULL DEFAULT 0,
   cycle_start_date DATE NOT NULL,
   cycle_end_date DATE NOT NULL,
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
-CREATE UNIQUE INDEX idx_user_monthly_usage_user_id ON user_monthly_usage (user_id);
+CREATE UNIQUE INDEX idx_user_monthly_usage_workspace_id ON user_monthly_usage (workspace_id);
 
 CREATE TABLE analytics (
   id SERIAL PRIMARY KEY,
-  short_code TEXT NOT NULL REFERENCES links(short_code) ON DELETE CASCADE,
+  link_id INT NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+  -- The version of the link that served the visit
+  link_version_id INT REFERENCES link_versions(id) ON DELETE SET NULL,
   geo_data JSONB,
   user_agent_data JSONB,
   referrer_url TEXT,
@@ -60,4 +184,22 @@ CREATE TABLE analytics (
   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
-CREATE INDEX idx_analytics_short_code ON analytics (short_code);
+CREATE INDEX idx_analytics_link_id ON analytics (link_id);
+
+-- Append-only: rows are never updated or deleted. Actors and workspaces are
+-- kept as nullable references so the history outlives them.
+CREATE TABLE audit_log (
+  id BIGSERIAL PRIMARY KEY,
+  workspace_id INT REFERENCES workspaces(id) ON DELETE SET NULL,
+  actor_user_id INT REFERENCES users(id) ON DELETE SET NULL,
+  action TEXT NOT NULL CHECK(action IN ('create', 'update', 'delete', 'login', 'subscription_change')),
+  target_type TEXT NOT NULL,
+  target_id TEXT NOT NULL,
+  before JSONB,
+  after JSONB,
+  ip_address TEXT,
+  user_agent TEXT,
+  created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_audit_log_workspace_id ON audit_log (workspace_id);
+CREATE INDEX idx_audit_log_target ON audit_log (target_type, target_id);
@@ -1,6 +1,29 @@
 INSERT INTO subscriptions
-  (name, max_links_per_month, can_customise_slug, can_create_duplicates, can_view_analytics)
+  (name, max_links_per_month)
 VALUES
-  ('basic',  12, FALSE, FALSE, FALSE),
-  ('pro1',  120, FALSE, TRUE, TRUE),
-  ('pro2', 1200, TRUE,  TRUE, TRUE);
+  ('basic',  12),
+  ('pro1',  120),
+  ('pro2', 1200);
+
+INSERT INTO plan_entitlements (subscription_id, key, value)
+SELECT s.id, e.key, e.value
+FROM subscriptions s
+JOIN (VALUES
+  ('basic', 'max_team_members',          1),
+  ('basic', 'api_requests_per_minute',  30),
+  ('pro1',  'duplicate_links',           1),
+  ('pro1',  'analytics',                 1),
+  ('pro1',  'analytics_retention_days', 90),
+  ('pro1',  'max_custom_domains',        1),
+  ('pro1',  'max_team_members',          3),
+  ('pro1',  'api_requests_per_minute',  60),
+  ('pro2',  'custom_slugs',              1),
+  ('pro2',  'duplicate_links',           1),
+  ('pro2',  'analytics',                 1),
+  ('pro2',  'analytics_retention_days', 365),
+  ('pro2',  'max_custom_domains',        5),
+  ('pro2',  'max_team_members',         10),
+  ('pro2',  'api_requests_per_minute', 300),
+  ('pro2',  'password_protected_links',  1)
+) AS e (plan, key, value)
+ON s.name = e.plan;